@@ -0,0 +1,386 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Attachment measures an event group on every thread of a running process.
+// Threads created after the process is attached to are measured as well,
+// and the counts of threads which exit are kept in a running total.
+//
+// New threads are discovered using a dummy software event opened on every
+// thread, with Options.Task and Options.Comm set. The kernel reports thread
+// creation, renaming and exit as ForkRecord, CommRecord and ExitRecord
+// records on the ring buffers of the dummy events.
+type Attachment struct {
+	pid int
+	cpu int
+	g   *Group
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	threads  map[int]*attachedThread
+	exited   GroupCount
+	nexited  int
+	err      error // first error encountered while tracking threads
+	detached bool
+	final    *AttachCount // counts read by Detach
+	closeErr error        // first error encountered by Detach
+}
+
+// attachedThread is a thread measured by an Attachment.
+type attachedThread struct {
+	leader  *Event
+	tracker *Event
+	comm    string
+}
+
+// ThreadCount is a group measurement for a specific thread.
+type ThreadCount struct {
+	TID  int
+	Comm string
+	GroupCount
+}
+
+// AttachCount is a set of measurements read from an Attachment.
+type AttachCount struct {
+	// Total holds the counts of all threads measured so far, including
+	// the threads which have exited.
+	Total GroupCount
+
+	// Threads holds the counts of the live threads, sorted by thread ID.
+	Threads []ThreadCount
+
+	// Exited holds the final counts of the threads which have exited,
+	// added together. ExitedThreads is the number of such threads.
+	Exited        GroupCount
+	ExitedThreads int
+}
+
+// Attach attaches to the running process pid, and measures the group on
+// each of its threads, on the specified CPU. Each group is enabled as soon
+// as it is opened.
+//
+// When ctx is cancelled, the Attachment is detached, as if by Detach.
+// Calling Detach afterwards returns the error encountered while detaching.
+//
+// New threads are measured from the time the ForkRecord announcing them
+// is processed, so the first moments of their execution are not counted.
+// Threads created by a new thread before it is itself tracked may be
+// missed. Attach reduces the window for the initial threads by listing
+// the threads of the process until no new ones appear.
+func Attach(ctx context.Context, g *Group, pid int, cpu int) (*Attachment, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	at := &Attachment{
+		pid:     pid,
+		cpu:     cpu,
+		g:       g,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		threads: make(map[int]*attachedThread),
+	}
+	for {
+		tids, err := Threads(pid)
+		if err != nil {
+			at.Detach()
+			return nil, err
+		}
+		added := 0
+		for _, tid := range tids {
+			ok, err := at.track(ctx, tid)
+			if err != nil {
+				if targetUnavailable(err) {
+					continue // the thread exited in the meantime
+				}
+				at.Detach()
+				return nil, err
+			}
+			if ok {
+				added++
+			}
+		}
+		if added == 0 {
+			break
+		}
+	}
+	at.mu.Lock()
+	nthreads := len(at.threads)
+	at.mu.Unlock()
+	if nthreads == 0 {
+		at.Detach()
+		return nil, errors.New("perf: no threads to attach to")
+	}
+
+	go func() {
+		<-ctx.Done()
+		at.Detach()
+	}()
+	return at, nil
+}
+
+var errDetached = errors.New("perf: attachment is detached")
+
+// track starts measuring and tracking the thread tid. It reports whether
+// the thread was new.
+func (at *Attachment) track(ctx context.Context, tid int) (bool, error) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.detached {
+		return false, errDetached
+	}
+	if _, ok := at.threads[tid]; ok {
+		return false, nil
+	}
+	tracker, err := openTracker(tid, at.cpu)
+	if err != nil {
+		return false, err
+	}
+	leader, err := at.g.Open(tid, at.cpu)
+	if err != nil {
+		tracker.Close()
+		return false, err
+	}
+	if err := leader.EnableGroup(); err != nil {
+		leader.Close()
+		tracker.Close()
+		return false, err
+	}
+	at.threads[tid] = &attachedThread{
+		leader:  leader,
+		tracker: tracker,
+		comm:    readComm(at.pid, tid),
+	}
+	at.wg.Add(1)
+	go at.follow(ctx, tid, tracker)
+	return true, nil
+}
+
+// openTracker opens a dummy event which reports the threads created by
+// tid, changes to its name, and its exit.
+func openTracker(tid, cpu int) (*Event, error) {
+	attr := &Attr{
+		Label: "attach-tracker",
+		Options: Options{
+			Task:              true,
+			Comm:              true,
+			ExcludeKernel:     true,
+			ExcludeHypervisor: true,
+		},
+	}
+	Dummy.Configure(attr)
+	attr.SetWakeupWatermark(1)
+	tracker, err := Open(attr, tid, cpu, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := tracker.MapRing(); err != nil {
+		tracker.Close()
+		return nil, err
+	}
+	return tracker, nil
+}
+
+// follow reads records from the tracker of tid until tid exits, or until
+// ctx is done.
+func (at *Attachment) follow(ctx context.Context, tid int, tracker *Event) {
+	defer at.wg.Done()
+	for {
+		rec, err := tracker.ReadRecord(ctx)
+		if err == ErrDisabled {
+			// The thread exited, and the kernel may have hung up
+			// before we read the last records. Drain them without
+			// blocking, then retire the thread.
+			drain, cancel := context.WithDeadline(ctx, time.Now())
+			for {
+				rec, err := tracker.ReadRecord(drain)
+				if err != nil || at.handle(ctx, tid, rec) {
+					break
+				}
+			}
+			cancel()
+			at.retire(tid)
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				at.fail(err)
+			}
+			return
+		}
+		if at.handle(ctx, tid, rec) {
+			at.retire(tid)
+			return
+		}
+	}
+}
+
+// handle handles a record from the tracker of tid. It reports whether
+// the record announces the exit of tid.
+func (at *Attachment) handle(ctx context.Context, tid int, rec Record) bool {
+	switch rec := rec.(type) {
+	case *ForkRecord:
+		if int(rec.Pid) != at.pid || int(rec.Tid) == tid {
+			return false
+		}
+		_, err := at.track(ctx, int(rec.Tid))
+		if err != nil && err != errDetached && !targetUnavailable(err) && ctx.Err() == nil {
+			at.fail(err)
+		}
+	case *CommRecord:
+		at.mu.Lock()
+		if t, ok := at.threads[int(rec.Tid)]; ok {
+			t.comm = rec.NewName
+		}
+		at.mu.Unlock()
+	case *ExitRecord:
+		return int(rec.Tid) == tid
+	}
+	return false
+}
+
+// retire reads the final counts of the exited thread tid, adds them to the
+// running total, and closes its events.
+func (at *Attachment) retire(tid int) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	t, ok := at.threads[tid]
+	if !ok {
+		return
+	}
+	delete(at.threads, tid)
+	gc, err := t.leader.ReadGroupCount()
+	t.leader.Close()
+	t.tracker.Close()
+	if err != nil {
+		at.failLocked(err)
+		return
+	}
+	at.exited = at.exited.Add(gc)
+	at.nexited++
+}
+
+func (at *Attachment) fail(err error) {
+	at.mu.Lock()
+	at.failLocked(err)
+	at.mu.Unlock()
+}
+
+func (at *Attachment) failLocked(err error) {
+	if at.err == nil {
+		at.err = err
+	}
+}
+
+// Err returns the first error encountered while tracking threads, if any.
+// Tracking continues after errors, on a best effort basis.
+func (at *Attachment) Err() error {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.err
+}
+
+// Done returns a channel which is closed when the Attachment is detached.
+func (at *Attachment) Done() <-chan struct{} {
+	return at.done
+}
+
+// ReadCount reads the counts of all threads. Once the Attachment is
+// detached, ReadCount returns the final counts read by Detach.
+func (at *Attachment) ReadCount() (AttachCount, error) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.final != nil {
+		return *at.final, nil
+	}
+	ac, err := at.readCountLocked()
+	if err != nil {
+		return AttachCount{}, err
+	}
+	return ac, nil
+}
+
+// readCountLocked reads the counts of all threads. If reading the counts
+// of a thread fails, the thread is left out, and the first such error is
+// returned along with the counts of the other threads.
+func (at *Attachment) readCountLocked() (AttachCount, error) {
+	ac := AttachCount{ExitedThreads: at.nexited}
+	ac.Exited = ac.Exited.Add(at.exited)
+	ac.Total = ac.Total.Add(at.exited)
+	var firstErr error
+	for tid, t := range at.threads {
+		gc, err := t.leader.ReadGroupCount()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ac.Threads = append(ac.Threads, ThreadCount{TID: tid, Comm: t.comm, GroupCount: gc})
+		ac.Total = ac.Total.Add(gc)
+	}
+	sort.Slice(ac.Threads, func(i, j int) bool { return ac.Threads[i].TID < ac.Threads[j].TID })
+	return ac, firstErr
+}
+
+// Detach stops tracking threads, reads the final counts of all threads,
+// and closes all events. After Detach, ReadCount returns the final counts.
+// Detach returns the first error encountered while reading the final
+// counts or closing the events. It is safe to call Detach multiple times,
+// and concurrently.
+func (at *Attachment) Detach() error {
+	at.once.Do(func() {
+		// Mark the Attachment as detached first, so that followers
+		// which are still running do not track new threads while we
+		// wait for them to stop.
+		at.mu.Lock()
+		at.detached = true
+		at.mu.Unlock()
+
+		at.cancel()
+		at.wg.Wait()
+
+		at.mu.Lock()
+		defer at.mu.Unlock()
+		ac, err := at.readCountLocked()
+		at.final = &ac
+		at.closeErr = err
+		for _, t := range at.threads {
+			if err := t.leader.Close(); err != nil && at.closeErr == nil {
+				at.closeErr = err
+			}
+			if err := t.tracker.Close(); err != nil && at.closeErr == nil {
+				at.closeErr = err
+			}
+		}
+		close(at.done)
+	})
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.closeErr
+}
+
+// readComm reads the command name of a thread, or returns the empty string.
+func readComm(pid, tid int) string {
+	p := filepath.Join("/proc", strconv.Itoa(pid), "task", strconv.Itoa(tid), "comm")
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
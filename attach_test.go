@@ -0,0 +1,145 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"acln.ro/perf"
+)
+
+func TestAttach(t *testing.T) {
+	t.Run("NewThreads", testAttachNewThreads)
+	t.Run("Cancel", testAttachCancel)
+}
+
+func testAttachNewThreads(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	pid := os.Getpid()
+	before, err := perf.Threads(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at, err := perf.Attach(context.Background(), eventSetGroup(), pid, perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer at.Detach()
+
+	// Lock more goroutines to OS threads than there are threads in the
+	// process, so the runtime is forced to create new ones. Goroutines
+	// which exit while locked take their threads with them.
+	n := len(before) + 2
+	var locked, spun sync.WaitGroup
+	release := make(chan struct{})
+	locked.Add(n)
+	spun.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			runtime.LockOSThread()
+			locked.Done()
+			<-release
+			spin(2 * time.Millisecond)
+			spun.Done()
+		}()
+	}
+	locked.Wait()
+
+	ac := waitAttach(t, at, "a new thread to be tracked", func(ac perf.AttachCount) bool {
+		for _, tc := range ac.Threads {
+			if !containsInt(before, tc.TID) {
+				return true
+			}
+		}
+		return false
+	})
+	for _, tc := range ac.Threads {
+		if tc.Comm == "" {
+			t.Errorf("thread %d: empty command name", tc.TID)
+		}
+	}
+
+	close(release)
+	spun.Wait()
+	ac = waitAttach(t, at, "threads to exit", func(ac perf.AttachCount) bool {
+		return ac.ExitedThreads > 0
+	})
+	if ac.Exited.Values[0].Value == 0 {
+		t.Error("exited threads did not count task-clock")
+	}
+	if ac.Total.Values[0].Value < ac.Exited.Values[0].Value {
+		t.Errorf("total task-clock %d is less than that of exited threads (%d)",
+			ac.Total.Values[0].Value, ac.Exited.Values[0].Value)
+	}
+	if err := at.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitAttach reads counts from at until cond is satisfied, or until one
+// second passes.
+func waitAttach(t *testing.T, at *perf.Attachment, what string, cond func(perf.AttachCount) bool) perf.AttachCount {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		ac, err := at.ReadCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cond(ac) {
+			return ac
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s: %+v", what, ac)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func containsInt(s []int, x int) bool {
+	for _, y := range s {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+func testAttachCancel(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	at, err := perf.Attach(ctx, eventSetGroup(), os.Getpid(), perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spin(2 * time.Millisecond)
+	cancel()
+	select {
+	case <-at.Done():
+	case <-time.After(time.Second):
+		t.Fatal("attachment was not detached after cancellation")
+	}
+	if err := at.Detach(); err != nil {
+		t.Fatal(err)
+	}
+	ac, err := at.ReadCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ac.Threads) == 0 {
+		t.Fatal("no final per-thread counts")
+	}
+	if ac.Total.Values[0].Value == 0 {
+		t.Fatal("final total did not count task-clock")
+	}
+}
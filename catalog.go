@@ -0,0 +1,235 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// EventDesc describes an event supported by the system, similarly to an
+// entry in the output of ``perf list''.
+type EventDesc struct {
+	// Name is the name of the event, as accepted by ParseEvent.
+	Name string
+
+	// Aliases lists alternative names for the event.
+	Aliases []string
+
+	// PMU is the name of the PMU which provides the event, as found
+	// under /sys/bus/event_source/devices, if any.
+	PMU string
+
+	// Type and Config identify the event.
+	Type   EventType
+	Config uint64
+
+	// Description is a short description of the event, e.g.
+	// "Hardware event" or "Tracepoint event".
+	Description string
+
+	// Sampling indicates that the event supports sampling.
+	Sampling bool
+
+	// Configurator configures an Attr to measure the event.
+	Configurator Configurator
+}
+
+// ListGenericEvents lists the generic hardware, software and hardware cache
+// events which are available on the system. The availability of each event
+// is checked by opening it on the calling thread, excluding kernel and
+// hypervisor activity. Events which cannot be opened are not listed.
+// Sampling support is checked in the same way.
+func ListGenericEvents() ([]EventDesc, error) {
+	if !Supported() {
+		return nil, errors.New("perf: perf_event_open is not supported")
+	}
+
+	var descs []EventDesc
+	for _, cfg := range AllHardwareCounters() {
+		hwc := cfg.(HardwareCounter)
+		descs = append(descs, EventDesc{
+			Name:         hwc.String(),
+			Aliases:      eventAliases(hwc.eventLabel()),
+			Type:         HardwareEvent,
+			Config:       uint64(hwc),
+			Description:  "Hardware event",
+			Configurator: hwc,
+		})
+	}
+	for _, cfg := range AllSoftwareCounters() {
+		swc := cfg.(SoftwareCounter)
+		descs = append(descs, EventDesc{
+			Name:         swc.String(),
+			Aliases:      eventAliases(swc.eventLabel()),
+			Type:         SoftwareEvent,
+			Config:       uint64(swc),
+			Description:  "Software event",
+			Configurator: swc,
+		})
+	}
+	for _, cfg := range HardwareCacheCounters(AllCaches(), AllCacheOps(), AllCacheOpResults()) {
+		hwcc := cfg.(HardwareCacheCounter)
+		name := hwcc.String()
+		if name == "" {
+			continue
+		}
+		attr := new(Attr)
+		hwcc.Configure(attr)
+		descs = append(descs, EventDesc{
+			Name:         name,
+			Aliases:      cacheCounterAliases(hwcc, name),
+			Type:         HardwareCacheEvent,
+			Config:       attr.Config,
+			Description:  "Hardware cache event",
+			Configurator: hwcc,
+		})
+	}
+
+	available := descs[:0]
+	for _, desc := range descs {
+		ok, sampling := probeEvent(desc.Configurator)
+		if !ok {
+			continue
+		}
+		desc.PMU, _ = lookupPMUName(desc.Type)
+		desc.Sampling = sampling
+		available = append(available, desc)
+	}
+	return available, nil
+}
+
+// ListPMUEvents lists the named events of all the PMUs registered under
+// /sys/bus/event_source/devices.
+func ListPMUEvents() ([]EventDesc, error) {
+	pmus, err := LoadPMUs(pmuDevicesDir)
+	if err != nil {
+		return nil, err
+	}
+	var descs []EventDesc
+	for _, pmu := range pmus {
+		descs = append(descs, pmu.ListEvents()...)
+	}
+	return descs, nil
+}
+
+// ListEvents lists the named events of the PMU, sorted by name. Events are
+// named "<pmu>/<event>/". Uncore PMUs (see CPUMask) are reported as not
+// supporting sampling. Events whose terms cannot be encoded are omitted.
+func (pmu *PMU) ListEvents() []EventDesc {
+	var descs []EventDesc
+	for _, name := range pmu.EventNames() {
+		cfg, err := pmu.Event(name)
+		if err != nil {
+			continue
+		}
+		attr := new(Attr)
+		cfg.Configure(attr)
+		descs = append(descs, EventDesc{
+			Name:         attr.Label,
+			PMU:          pmu.Name,
+			Type:         pmu.Type,
+			Config:       attr.Config,
+			Description:  "Kernel PMU event",
+			Sampling:     len(pmu.CPUMask) == 0,
+			Configurator: cfg,
+		})
+	}
+	return descs
+}
+
+// ListTracepoints lists the tracepoints available in the tracing file system,
+// sorted by name. Tracepoints are named "<category>:<event>". If pattern is
+// not empty, only tracepoints whose names match pattern are listed. The
+// syntax of pattern is that of path.Match, e.g. "sched:*" or "*:sys_enter_*".
+func ListTracepoints(pattern string) ([]EventDesc, error) {
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("perf: bad tracepoint pattern %q: %v", pattern, err)
+		}
+	}
+	glob, err := tracefsPath("events", "*", "*", "id")
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, err
+	}
+	var descs []EventDesc
+	for _, p := range paths {
+		dir := filepath.Dir(p)
+		category, event := filepath.Base(filepath.Dir(dir)), filepath.Base(dir)
+		name := category + ":" + event
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, name); !ok {
+				continue
+			}
+		}
+		config, err := readUint(p, 64)
+		if err != nil {
+			continue
+		}
+		descs = append(descs, EventDesc{
+			Name:         name,
+			PMU:          "tracepoint",
+			Type:         TracepointEvent,
+			Config:       config,
+			Description:  "Tracepoint event",
+			Sampling:     true,
+			Configurator: Tracepoint(category, event),
+		})
+	}
+	sort.Slice(descs, func(i, j int) bool { return descs[i].Name < descs[j].Name })
+	return descs, nil
+}
+
+// eventAliases returns the aliases in label, if any.
+func eventAliases(label eventLabel) []string {
+	if label.Alias == "" || label.Alias == label.Name {
+		return nil
+	}
+	return []string{label.Alias}
+}
+
+// cacheCounterAliases returns the alternative names of hwcc, sorted.
+func cacheCounterAliases(hwcc HardwareCacheCounter, name string) []string {
+	var aliases []string
+	for alias, c := range hardwareCacheCountersByName {
+		if c == hwcc && !strings.EqualFold(alias, name) {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// probeEvent reports whether the event configured by cfg can be opened on
+// the calling thread, and whether it supports sampling.
+func probeEvent(cfg Configurator) (available, sampling bool) {
+	attr := new(Attr)
+	if err := cfg.Configure(attr); err != nil {
+		return false, false
+	}
+	attr.Options.ExcludeKernel = true
+	attr.Options.ExcludeHypervisor = true
+	ev, err := Open(attr, CallingThread, AnyCPU, nil)
+	if err != nil {
+		return false, false
+	}
+	ev.Close()
+
+	attr.SetSamplePeriod(1 << 20)
+	ev, err = Open(attr, CallingThread, AnyCPU, nil)
+	if err != nil {
+		return true, false
+	}
+	ev.Close()
+	return true, true
+}
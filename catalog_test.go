@@ -0,0 +1,122 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"reflect"
+	"testing"
+
+	"acln.ro/perf"
+)
+
+func TestCatalog(t *testing.T) {
+	t.Run("GenericEvents", testListGenericEvents)
+	t.Run("PMUEvents", testListPMUEvents)
+	t.Run("Tracepoints", testListTracepoints)
+}
+
+func testListGenericEvents(t *testing.T) {
+	requires(t, softwarePMU)
+
+	descs, err := perf.ListGenericEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var faults *perf.EventDesc
+	for i := range descs {
+		if descs[i].Name == "page-faults" {
+			faults = &descs[i]
+		}
+	}
+	if faults == nil {
+		t.Fatal("page-faults not listed")
+	}
+	if faults.Type != perf.SoftwareEvent || faults.Config != uint64(perf.PageFaults) {
+		t.Errorf("got type %d, config %d", faults.Type, faults.Config)
+	}
+	if !reflect.DeepEqual(faults.Aliases, []string{"faults"}) {
+		t.Errorf("got aliases %q, want [faults]", faults.Aliases)
+	}
+	if faults.PMU != "software" || !faults.Sampling {
+		t.Errorf("got PMU %q, sampling %t, want software, true", faults.PMU, faults.Sampling)
+	}
+}
+
+func testListPMUEvents(t *testing.T) {
+	pmus, err := perf.LoadPMUs(fixtureDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pmus) != 2 || pmus[0].Name != "cpu" || pmus[1].Name != "uncore_imc_0" {
+		t.Fatalf("got %d PMUs, want cpu and uncore_imc_0", len(pmus))
+	}
+
+	cpu := pmus[0].ListEvents()
+	if len(cpu) != 3 {
+		t.Fatalf("got %d cpu events, want 3", len(cpu))
+	}
+	if d := cpu[0]; d.Name != "cpu/cache-misses/" || d.Config != 0x412e || !d.Sampling {
+		t.Errorf("got %+v", d)
+	}
+
+	imc := pmus[1]
+	if !reflect.DeepEqual(imc.CPUMask, []int{0}) {
+		t.Errorf("got cpumask %v, want [0]", imc.CPUMask)
+	}
+	uncore := imc.ListEvents()
+	if len(uncore) != 3 {
+		t.Fatalf("got %d uncore events, want 3", len(uncore))
+	}
+	d := uncore[0]
+	if d.Name != "uncore_imc_0/cas_count_read/" || d.Type != 14 || d.Config != 0x304 || d.Sampling {
+		t.Errorf("got %+v", d)
+	}
+	a := new(perf.Attr)
+	if err := d.Configurator.Configure(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Type != 14 || a.Config != 0x304 {
+		t.Errorf("Configure: got type %d, config %#x", a.Type, a.Config)
+	}
+}
+
+func testListTracepoints(t *testing.T) {
+	perf.SetTracefsRoot(fixtureTracefs)
+	defer perf.SetTracefsRoot("")
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"", []string{"sched:sched_process_exec", "sched:sched_switch", "syscalls:sys_enter_getpid"}},
+		{"sched:*", []string{"sched:sched_process_exec", "sched:sched_switch"}},
+		{"*:sys_enter_*", []string{"syscalls:sys_enter_getpid"}},
+		{"nope:*", nil},
+	}
+	for _, tt := range tests {
+		descs, err := perf.ListTracepoints(tt.pattern)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.pattern, err)
+		}
+		var got []string
+		for _, d := range descs {
+			got = append(got, d.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+
+	descs, err := perf.ListTracepoints("sched:sched_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := descs[0]; d.Type != perf.TracepointEvent || d.Config != 316 || !d.Sampling {
+		t.Errorf("got %+v", d)
+	}
+	if _, err := perf.ListTracepoints("[bad"); err == nil {
+		t.Error("ListTracepoints succeeded with bad pattern")
+	}
+}
@@ -24,12 +24,17 @@ import (
 //
 // Label is set based on the Label field of the Attr associated with the
 // event. See the documentation there for more details.
+//
+// Restrictions lists the exclusion options which were applied to the event
+// by the fallback policy configured in OpenOptions, if any.
 type Count struct {
 	Value   uint64
 	Enabled time.Duration
 	Running time.Duration
 	ID      uint64
 	Label   string
+
+	Restrictions Restrictions
 }
 
 func (c Count) String() string {
@@ -62,6 +67,7 @@ func (ev *Event) ReadCount() (Count, error) {
 	f := fields(buf)
 	f.count(&c, ev.a.CountFormat)
 	c.Label = ev.a.Label
+	c.Restrictions = ev.restrictions
 
 	return c, err
 }
@@ -77,6 +83,8 @@ type GroupCount struct {
 		ID    uint64
 		Label string
 	}
+
+	Restrictions Restrictions
 }
 
 type errWriter struct {
@@ -93,25 +101,57 @@ func (ew *errWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// PrintMode configures how PrintValuesMode prints values.
+type PrintMode int
+
+// Print modes.
+const (
+	// PrintRaw prints the values read from the counters.
+	PrintRaw PrintMode = iota
+
+	// PrintScaled prints values scaled to account for multiplexing,
+	// together with the percentage of time the counters were running,
+	// like perf stat does. Counters which never ran are printed as
+	// <not counted>. See GroupCount.Scaled.
+	PrintScaled
+)
+
 // PrintValues prints a table of gc.Values to w.
 func (gc GroupCount) PrintValues(w io.Writer) error {
+	return gc.PrintValuesMode(w, PrintRaw)
+}
+
+// PrintValuesMode prints a table of gc.Values to w, in the specified mode.
+func (gc GroupCount) PrintValuesMode(w io.Writer, mode PrintMode) error {
 	ew := &errWriter{w: w}
 
 	tw := new(tabwriter.Writer)
 	tw.Init(ew, 0, 8, 1, ' ', 0)
 
+	header := "label\tvalue"
+	if mode == PrintScaled {
+		header += "\trunning"
+	}
 	if gc.Values[0].ID != 0 {
-		fmt.Fprintln(tw, "label\tvalue\tID")
-	} else {
-		fmt.Fprintln(tw, "label\tvalue")
+		header += "\tID"
 	}
+	fmt.Fprintln(tw, header)
 
-	for _, v := range gc.Values {
+	scaled := gc.Scaled()
+	for i, v := range gc.Values {
+		row := fmt.Sprintf("%s\t%d", v.Label, v.Value)
+		if mode == PrintScaled {
+			sv := scaled[i]
+			if sv.State == NotCounted {
+				row = fmt.Sprintf("%s\t%v\t", v.Label, sv.State)
+			} else {
+				row = fmt.Sprintf("%s\t%.0f\t%.2f%%", v.Label, sv.Value, sv.Percent)
+			}
+		}
 		if v.ID != 0 {
-			fmt.Fprintf(tw, "%s\t%d\t%d\n", v.Label, v.Value, v.ID)
-		} else {
-			fmt.Fprintf(tw, "%s\t%d\n", v.Label, v.Value)
+			row += fmt.Sprintf("\t%d", v.ID)
 		}
+		fmt.Fprintln(tw, row)
 	}
 
 	tw.Flush()
@@ -140,14 +180,24 @@ func (ev *Event) ReadGroupCount() (GroupCount, error) {
 
 	f := fields(buf)
 	f.groupCount(&gc, ev.a.CountFormat)
-	gc.Values[0].Label = ev.a.Label
-	for i := 0; i < len(ev.group); i++ {
-		gc.Values[i+1].Label = ev.group[i].a.Label
-	}
+	ev.labelGroupCount(&gc)
+	gc.Restrictions = ev.groupRestrictions()
 
 	return gc, nil
 }
 
+// labelGroupCount sets the labels of gc.Values, which were read from the
+// group led by ev: the leader first, then the followers, in order.
+func (ev *Event) labelGroupCount(gc *GroupCount) {
+	for i := range gc.Values {
+		if i == 0 {
+			gc.Values[i].Label = ev.a.Label
+		} else if i-1 < len(ev.group) {
+			gc.Values[i].Label = ev.group[i-1].a.Label
+		}
+	}
+}
+
 // CountFormat configures the format of Count or GroupCount measurements.
 //
 // Enabled and Running configure the Event to include time enabled and
@@ -211,3 +261,86 @@ func (f CountFormat) marshal() uint64 {
 	}
 	return marshalBitwiseUint64(fields)
 }
+
+// Add returns the sum of c and o. Value, Enabled and Running are added.
+// The Label and ID of c are kept, and the Restrictions of both counts are
+// merged.
+func (c Count) Add(o Count) Count {
+	c.Value += o.Value
+	c.Enabled += o.Enabled
+	c.Running += o.Running
+	c.Restrictions = c.Restrictions.union(o.Restrictions)
+	return c
+}
+
+// Sub returns the difference between c and prev, which was read from the
+// same event earlier: the events counted, and the time spent enabled and
+// running, since prev was read. If the event was reset in between, the
+// difference is taken from zero.
+func (c Count) Sub(prev Count) Count {
+	c.Value = subCounter(c.Value, prev.Value)
+	c.Enabled = time.Duration(subCounter(uint64(c.Enabled), uint64(prev.Enabled)))
+	c.Running = time.Duration(subCounter(uint64(c.Running), uint64(prev.Running)))
+	return c
+}
+
+// Add returns the sum of gc and o, value by value. If gc holds no values,
+// the sum takes the shape and labels of o. Enabled and Running are added,
+// and the Restrictions of both counts are merged.
+func (gc GroupCount) Add(o GroupCount) GroupCount {
+	sum := gc.clone()
+	if sum.Values == nil && len(o.Values) > 0 {
+		sum = o.clone()
+		for i := range sum.Values {
+			sum.Values[i].Value = 0
+		}
+		sum.Enabled, sum.Running = gc.Enabled, gc.Running
+		sum.Restrictions = gc.Restrictions
+	}
+	sum.Enabled += o.Enabled
+	sum.Running += o.Running
+	sum.Restrictions = sum.Restrictions.union(o.Restrictions)
+	for i := range o.Values {
+		if i < len(sum.Values) {
+			sum.Values[i].Value += o.Values[i].Value
+		}
+	}
+	return sum
+}
+
+// Sub returns the difference between gc and prev, which was read from the
+// same group earlier, value by value. See Count.Sub.
+func (gc GroupCount) Sub(prev GroupCount) GroupCount {
+	diff := gc.clone()
+	diff.Enabled = time.Duration(subCounter(uint64(gc.Enabled), uint64(prev.Enabled)))
+	diff.Running = time.Duration(subCounter(uint64(gc.Running), uint64(prev.Running)))
+	for i := range diff.Values {
+		if i < len(prev.Values) {
+			diff.Values[i].Value = subCounter(gc.Values[i].Value, prev.Values[i].Value)
+		}
+	}
+	return diff
+}
+
+// clone returns a copy of gc which does not share Values with gc.
+func (gc GroupCount) clone() GroupCount {
+	if gc.Values != nil {
+		values := gc.Values
+		gc.Values = make([]struct {
+			Value uint64
+			ID    uint64
+			Label string
+		}, len(values))
+		copy(gc.Values, values)
+	}
+	return gc
+}
+
+// subCounter returns cur - prev for a monotonic counter. If the counter
+// went backwards, it was reset, and cur is returned.
+func subCounter(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
@@ -277,7 +277,7 @@ func testL1Group(t *testing.T) {
 }
 
 func testSingleTracepoint(t *testing.T) {
-	requires(t, paranoid(1), tracepointPMU, debugfs)
+	requires(t, paranoid(1), tracepointPMU, tracefs)
 
 	tests := []singleTracepointTest{
 		{
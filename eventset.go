@@ -0,0 +1,241 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// onlineCPUsFile lists the online CPUs.
+const onlineCPUsFile = "/sys/devices/system/cpu/online"
+
+// OnlineCPUs returns the online CPUs, as listed in
+// /sys/devices/system/cpu/online.
+func OnlineCPUs() ([]int, error) {
+	content, err := ioutil.ReadFile(onlineCPUsFile)
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := parseCPUList(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("perf: bad online CPU list: %v", err)
+	}
+	return cpus, nil
+}
+
+// Threads returns the IDs of the threads of the specified process, as
+// listed in /proc/<pid>/task, in ascending order.
+func Threads(pid int) ([]int, error) {
+	names, err := ioutil.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+	if err != nil {
+		return nil, err
+	}
+	var tids []int
+	for _, fi := range names {
+		tid, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		tids = append(tids, tid)
+	}
+	sort.Ints(tids)
+	return tids, nil
+}
+
+// Target is a (pid, cpu) pair an event group is opened on. See Open for
+// the meaning of PID and CPU.
+type Target struct {
+	PID int
+	CPU int
+}
+
+// EventSetOptions configures how an EventSet is opened.
+type EventSetOptions struct {
+	// SkipUnavailable causes targets which are not available to be
+	// skipped, rather than causing the entire EventSet to fail to open.
+	// A target is unavailable if its CPU is offline (ENODEV), or if its
+	// thread has exited (ESRCH). Skipped targets are recorded in
+	// EventSet.Skipped. Other errors are reported regardless.
+	SkipUnavailable bool
+}
+
+// SkippedTarget is a target which was skipped when opening an EventSet.
+type SkippedTarget struct {
+	Target Target
+	Err    error
+}
+
+// EventSet is a set of copies of an event group, opened on multiple CPUs
+// or threads, and controlled together.
+type EventSet struct {
+	// Targets lists the targets the group was opened on, in the order
+	// in which they were specified.
+	Targets []Target
+
+	// Skipped lists the targets which were skipped, if
+	// EventSetOptions.SkipUnavailable was set.
+	Skipped []SkippedTarget
+
+	leaders []*Event
+}
+
+// OpenEventSet opens the group on each of the specified targets.
+func OpenEventSet(g *Group, targets []Target, opts EventSetOptions) (*EventSet, error) {
+	es := new(EventSet)
+	for _, t := range targets {
+		leader, err := g.Open(t.PID, t.CPU)
+		if err != nil {
+			if opts.SkipUnavailable && targetUnavailable(err) {
+				es.Skipped = append(es.Skipped, SkippedTarget{Target: t, Err: err})
+				continue
+			}
+			es.Close()
+			return nil, err
+		}
+		es.Targets = append(es.Targets, t)
+		es.leaders = append(es.leaders, leader)
+	}
+	if len(es.leaders) == 0 {
+		return nil, errors.New("perf: no targets available for event set")
+	}
+	return es, nil
+}
+
+// OpenEventSetCPUs opens the group on every online CPU, measuring the
+// specified pid. To count system-wide, use pid == AllThreads.
+func OpenEventSetCPUs(g *Group, pid int, opts EventSetOptions) (*EventSet, error) {
+	cpus, err := OnlineCPUs()
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]Target, 0, len(cpus))
+	for _, cpu := range cpus {
+		targets = append(targets, Target{PID: pid, CPU: cpu})
+	}
+	return OpenEventSet(g, targets, opts)
+}
+
+// OpenEventSetThreads opens the group on every thread of the process pid,
+// on the specified CPU. Threads created after OpenEventSetThreads returns
+// are not measured, unless the group sets Options.Inherit.
+func OpenEventSetThreads(g *Group, pid int, cpu int, opts EventSetOptions) (*EventSet, error) {
+	tids, err := Threads(pid)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]Target, 0, len(tids))
+	for _, tid := range tids {
+		targets = append(targets, Target{PID: tid, CPU: cpu})
+	}
+	return OpenEventSet(g, targets, opts)
+}
+
+// targetUnavailable reports whether err indicates that the target of an
+// Open call is gone: an offline CPU, or an exited thread.
+func targetUnavailable(err error) bool {
+	oe, ok := err.(*OpenError)
+	return ok && (oe.Errno == unix.ENODEV || oe.Errno == unix.ESRCH)
+}
+
+// Leaders returns the group leaders of the set, one for each of es.Targets.
+func (es *EventSet) Leaders() []*Event {
+	return es.leaders
+}
+
+// Enable enables all groups in the set.
+func (es *EventSet) Enable() error {
+	return es.each((*Event).EnableGroup)
+}
+
+// Disable disables all groups in the set.
+func (es *EventSet) Disable() error {
+	return es.each((*Event).DisableGroup)
+}
+
+// Reset resets the counters of all groups in the set.
+func (es *EventSet) Reset() error {
+	return es.each((*Event).ResetGroup)
+}
+
+// Close closes all groups in the set. It returns the first error
+// encountered, if any.
+func (es *EventSet) Close() error {
+	var first error
+	for _, leader := range es.leaders {
+		if err := leader.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// each calls fn on each group leader, and returns the first error, if
+// any. Leaders after the first failure are still processed.
+func (es *EventSet) each(fn func(*Event) error) error {
+	var first error
+	for i, leader := range es.leaders {
+		if err := fn(leader); err != nil && first == nil {
+			first = fmt.Errorf("perf: event set target %+v: %v", es.Targets[i], err)
+		}
+	}
+	return first
+}
+
+// EventSetCount is a set of measurements read from an EventSet.
+type EventSetCount struct {
+	// Total holds the counts of all targets, added together. Values
+	// are summed index by index, as are Enabled and Running.
+	Total GroupCount
+
+	// PerTarget holds the counts of each target, in the order of
+	// EventSet.Targets.
+	PerTarget []TargetCount
+}
+
+// TargetCount is a group measurement for a specific target.
+type TargetCount struct {
+	Target Target
+	GroupCount
+}
+
+// ReadCount reads the counts of all groups in the set.
+func (es *EventSet) ReadCount() (EventSetCount, error) {
+	var esc EventSetCount
+	for i, leader := range es.leaders {
+		gc, err := leader.ReadGroupCount()
+		if err != nil {
+			return EventSetCount{}, fmt.Errorf("perf: event set target %+v: %v", es.Targets[i], err)
+		}
+		esc.PerTarget = append(esc.PerTarget, TargetCount{Target: es.Targets[i], GroupCount: gc})
+		esc.Total = esc.Total.Add(gc)
+	}
+	return esc, nil
+}
+
+// Measure disables and resets all groups in the set, enables them, runs
+// f, disables them again, then reads the counts.
+func (es *EventSet) Measure(f func()) (EventSetCount, error) {
+	if err := es.Disable(); err != nil {
+		return EventSetCount{}, err
+	}
+	if err := es.Reset(); err != nil {
+		return EventSetCount{}, err
+	}
+	if err := es.Enable(); err != nil {
+		return EventSetCount{}, err
+	}
+	f()
+	if err := es.Disable(); err != nil {
+		return EventSetCount{}, err
+	}
+	return es.ReadCount()
+}
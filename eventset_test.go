@@ -0,0 +1,151 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"acln.ro/perf"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestEventSet(t *testing.T) {
+	t.Run("CPUs", testEventSetCPUs)
+	t.Run("Threads", testEventSetThreads)
+	t.Run("Strict", testEventSetStrict)
+	t.Run("SkipUnavailable", testEventSetSkipUnavailable)
+}
+
+func eventSetGroup() *perf.Group {
+	g := &perf.Group{
+		CountFormat: perf.CountFormat{Enabled: true, Running: true},
+		Options:     perf.Options{Disabled: true, ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+	g.Add(perf.TaskClock, perf.PageFaults)
+	return g
+}
+
+func testEventSetCPUs(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	cpus, err := perf.OnlineCPUs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := perf.OpenEventSetCPUs(eventSetGroup(), perf.CallingThread, perf.EventSetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	if len(es.Targets) != len(cpus) {
+		t.Fatalf("got %d targets, want one per online CPU (%d)", len(es.Targets), len(cpus))
+	}
+
+	esc, err := es.Measure(func() { spin(5 * time.Millisecond) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEventSetTotal(t, esc)
+	if esc.Total.Values[0].Value == 0 {
+		t.Fatal("task-clock did not count")
+	}
+}
+
+func testEventSetThreads(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	pid := os.Getpid()
+	tids, err := perf.Threads(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := perf.OpenEventSetThreads(eventSetGroup(), pid, perf.AnyCPU, perf.EventSetOptions{SkipUnavailable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	if got := len(es.Targets) + len(es.Skipped); got != len(tids) {
+		t.Fatalf("got %d targets, want one per thread (%d)", got, len(tids))
+	}
+
+	esc, err := es.Measure(func() { spin(5 * time.Millisecond) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEventSetTotal(t, esc)
+	for _, tc := range esc.PerTarget {
+		if tc.Target.CPU != perf.AnyCPU {
+			t.Errorf("got CPU %d for thread %d, want AnyCPU", tc.Target.CPU, tc.Target.PID)
+		}
+	}
+}
+
+// checkEventSetTotal checks that the total of esc is the sum of the
+// per-target counts.
+func checkEventSetTotal(t *testing.T, esc perf.EventSetCount) {
+	t.Helper()
+
+	for i, v := range esc.Total.Values {
+		var sum uint64
+		for _, tc := range esc.PerTarget {
+			sum += tc.Values[i].Value
+			if tc.Values[i].Label != v.Label {
+				t.Errorf("got label %q for target %+v, want %q", tc.Values[i].Label, tc.Target, v.Label)
+			}
+		}
+		if sum != v.Value {
+			t.Errorf("%s: total %d, want sum of targets %d", v.Label, v.Value, sum)
+		}
+	}
+}
+
+// exitedPID is above PID_MAX_LIMIT, so it never names a live process.
+const exitedPID = 1 << 30
+
+func testEventSetStrict(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	targets := []perf.Target{
+		{PID: perf.CallingThread, CPU: perf.AnyCPU},
+		{PID: exitedPID, CPU: perf.AnyCPU},
+	}
+	_, err := perf.OpenEventSet(eventSetGroup(), targets, perf.EventSetOptions{})
+	if !errors.Is(err, unix.ESRCH) {
+		t.Fatalf("got %v, want ESRCH", err)
+	}
+}
+
+func testEventSetSkipUnavailable(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	targets := []perf.Target{
+		{PID: exitedPID, CPU: perf.AnyCPU},
+		{PID: perf.CallingThread, CPU: perf.AnyCPU},
+	}
+	es, err := perf.OpenEventSet(eventSetGroup(), targets, perf.EventSetOptions{SkipUnavailable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	if len(es.Targets) != 1 || es.Targets[0] != targets[1] {
+		t.Fatalf("got targets %+v, want %+v", es.Targets, targets[1:])
+	}
+	if len(es.Skipped) != 1 || es.Skipped[0].Target != targets[0] {
+		t.Fatalf("got skipped %+v, want %+v", es.Skipped, targets[:1])
+	}
+
+	_, err = perf.OpenEventSet(eventSetGroup(), targets[:1], perf.EventSetOptions{SkipUnavailable: true})
+	if err == nil {
+		t.Fatal("opened event set with no available targets")
+	}
+}
@@ -61,9 +61,15 @@ func command(cmd *exec.Cmd, setupCounters func() error) error {
 // Command invokes the given exec.Cmd and measures the given counter,
 // analogously to Measure().
 func Command(a *Attr, cmd *exec.Cmd, cpu int, event *Event) (Count, error) {
+	return CommandWithOptions(a, cmd, cpu, event, OpenOptions{})
+}
+
+// CommandWithOptions is like Command, but opens the event using
+// OpenWithOptions.
+func CommandWithOptions(a *Attr, cmd *exec.Cmd, cpu int, event *Event, opts OpenOptions) (Count, error) {
 	var event2 *Event
 	err := command(cmd, func() (err2 error) {
-		event2, err2 = Open(a, cmd.Process.Pid, cpu, event)
+		event2, err2 = OpenWithOptions(a, cmd.Process.Pid, cpu, event, opts)
 		if err2 != nil {
 			return err2
 		}
@@ -87,8 +93,11 @@ func (g *Group) Command(cmd *exec.Cmd, cpu int) (GroupCount, error) {
 		if err2 != nil {
 			return err2
 		}
+		if err2 = event2.ResetGroup(); err2 != nil {
+			return err2
+		}
 
-		return event2.Enable()
+		return event2.EnableGroup()
 	})
 	if err != nil {
 		return GroupCount{}, err
@@ -0,0 +1,125 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Restrictions describes exclusion options which were applied to an event
+// by a fallback policy, because the event could not be opened as
+// configured. See OpenOptions.
+type Restrictions struct {
+	ExcludeKernel     bool
+	ExcludeHypervisor bool
+}
+
+// Any reports whether any restrictions were applied.
+func (r Restrictions) Any() bool {
+	return r.ExcludeKernel || r.ExcludeHypervisor
+}
+
+// String returns a description of the restrictions, e.g.
+// "excluding kernel, hypervisor", or the empty string if no restrictions
+// were applied.
+func (r Restrictions) String() string {
+	var excluded []string
+	if r.ExcludeKernel {
+		excluded = append(excluded, "kernel")
+	}
+	if r.ExcludeHypervisor {
+		excluded = append(excluded, "hypervisor")
+	}
+	if len(excluded) == 0 {
+		return ""
+	}
+	return "excluding " + strings.Join(excluded, ", ")
+}
+
+// apply applies the restrictions to a, and returns the restrictions which
+// changed a.
+func (r Restrictions) apply(a *Attr) Restrictions {
+	var changed Restrictions
+	if r.ExcludeKernel && !a.Options.ExcludeKernel {
+		a.Options.ExcludeKernel = true
+		changed.ExcludeKernel = true
+	}
+	if r.ExcludeHypervisor && !a.Options.ExcludeHypervisor {
+		a.Options.ExcludeHypervisor = true
+		changed.ExcludeHypervisor = true
+	}
+	return changed
+}
+
+// Restrictions returns the exclusion options which were applied to the
+// event by a fallback policy when it was opened. See OpenOptions.
+func (ev *Event) Restrictions() Restrictions {
+	return ev.restrictions
+}
+
+// groupRestrictions returns the restrictions applied to ev and to the
+// followers in the group it leads.
+func (ev *Event) groupRestrictions() Restrictions {
+	r := ev.restrictions
+	for _, follower := range ev.group {
+		r = r.union(follower.restrictions)
+	}
+	return r
+}
+
+// fallbackSteps lists the progressively stronger restrictions tried by
+// openWithFallback.
+var fallbackSteps = []Restrictions{
+	{ExcludeHypervisor: true},
+	{ExcludeKernel: true, ExcludeHypervisor: true},
+}
+
+// union returns the restrictions in either r or other.
+func (r Restrictions) union(other Restrictions) Restrictions {
+	return Restrictions{
+		ExcludeKernel:     r.ExcludeKernel || other.ExcludeKernel,
+		ExcludeHypervisor: r.ExcludeHypervisor || other.ExcludeHypervisor,
+	}
+}
+
+// openWithFallback is like open, but if perf_event_open fails with a
+// permission error, it retries with the restrictions in fallbackSteps
+// applied to a copy of a. Members of a restricted group inherit the
+// restrictions of their leader up front.
+func openWithFallback(a *Attr, pid, cpu int, group *Event, flags int) (*Event, error) {
+	ac := *a
+	var applied Restrictions
+	if group != nil {
+		applied = group.restrictions.apply(&ac)
+	}
+	ev, err := open(&ac, pid, cpu, group, flags)
+	for _, step := range fallbackSteps {
+		if err == nil || !permissionDenied(err) {
+			break
+		}
+		retry := ac
+		changed := step.apply(&retry)
+		if !changed.Any() {
+			continue
+		}
+		if ev, err = open(&retry, pid, cpu, group, flags); err == nil {
+			applied = applied.union(changed)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	ev.restrictions = applied
+	return ev, nil
+}
+
+// permissionDenied reports whether err is an *OpenError caused by
+// insufficient privileges.
+func permissionDenied(err error) bool {
+	oe, ok := err.(*OpenError)
+	return ok && (oe.Errno == unix.EACCES || oe.Errno == unix.EPERM)
+}
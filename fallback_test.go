@@ -0,0 +1,190 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"acln.ro/perf"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFallback(t *testing.T) {
+	t.Run("Unrestricted", testFallbackUnrestricted)
+	t.Run("ExcludeKernel", testFallbackExcludeKernel)
+	t.Run("Group", testFallbackGroup)
+	t.Run("GroupFollower", testFallbackGroupFollower)
+	t.Run("String", testRestrictionsString)
+}
+
+func testFallbackUnrestricted(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	attr := new(perf.Attr)
+	perf.TaskClock.Configure(attr)
+	attr.Options.ExcludeKernel = true
+	attr.Options.ExcludeHypervisor = true
+	opts := perf.OpenOptions{FallbackExcludeKernel: true}
+	ev, err := perf.OpenWithOptions(attr, perf.CallingThread, perf.AnyCPU, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+	if r := ev.Restrictions(); r.Any() {
+		t.Fatalf("got restrictions %v, want none", r)
+	}
+}
+
+func testFallbackExcludeKernel(t *testing.T) {
+	requires(t, paranoid(2), softwarePMU)
+	withoutPerfCaps(t, func() {
+		attr := new(perf.Attr)
+		perf.TaskClock.Configure(attr)
+		_, err := perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+		if !errors.Is(err, unix.EACCES) {
+			t.Skipf("kernel profiling is allowed: got %v, want EACCES", err)
+		}
+
+		opts := perf.OpenOptions{FallbackExcludeKernel: true}
+		ev, err := perf.OpenWithOptions(attr, perf.CallingThread, perf.AnyCPU, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ev.Close()
+		if attr.Options.ExcludeKernel {
+			t.Fatal("fallback modified the caller's Attr")
+		}
+		if r := ev.Restrictions(); !r.ExcludeKernel {
+			t.Fatalf("got restrictions %+v, want ExcludeKernel", r)
+		}
+		c, err := ev.Measure(getpidTrigger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Restrictions.ExcludeKernel {
+			t.Fatalf("got Count restrictions %+v, want ExcludeKernel", c.Restrictions)
+		}
+	})
+}
+
+func testFallbackGroup(t *testing.T) {
+	requires(t, paranoid(2), softwarePMU)
+	withoutPerfCaps(t, func() {
+		g := perf.Group{
+			CountFormat: perf.CountFormat{Enabled: true, Running: true},
+			OpenOptions: perf.OpenOptions{FallbackExcludeKernel: true},
+		}
+		g.Add(perf.TaskClock, perf.PageFaults)
+		ev, err := g.Open(perf.CallingThread, perf.AnyCPU)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ev.Close()
+		gc, err := ev.MeasureGroup(getpidTrigger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gc.Restrictions.ExcludeKernel {
+			t.Skipf("got restrictions %+v: kernel profiling is allowed", gc.Restrictions)
+		}
+	})
+}
+
+func testFallbackGroupFollower(t *testing.T) {
+	requires(t, paranoid(2), softwarePMU)
+	withoutPerfCaps(t, func() {
+		attr := new(perf.Attr)
+		perf.PageFaults.Configure(attr)
+		_, err := perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+		if !errors.Is(err, unix.EACCES) {
+			t.Skipf("kernel profiling is allowed: got %v, want EACCES", err)
+		}
+
+		g := perf.Group{
+			CountFormat: perf.CountFormat{Enabled: true, Running: true},
+			OpenOptions: perf.OpenOptions{FallbackExcludeKernel: true},
+		}
+		leader := new(perf.Attr)
+		perf.TaskClock.Configure(leader)
+		leader.CountFormat = g.CountFormat
+		leader.Options.ExcludeKernel = true
+		leader.Options.ExcludeHypervisor = true
+		g.Add(leader, perf.PageFaults)
+		ev, err := g.Open(perf.CallingThread, perf.AnyCPU)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ev.Close()
+		if r := ev.Restrictions(); r.Any() {
+			t.Fatalf("got leader restrictions %+v, want none", r)
+		}
+		gc, err := ev.MeasureGroup(getpidTrigger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gc.Restrictions.ExcludeKernel {
+			t.Fatalf("got group restrictions %+v, want ExcludeKernel", gc.Restrictions)
+		}
+	})
+}
+
+func testRestrictionsString(t *testing.T) {
+	tests := []struct {
+		r    perf.Restrictions
+		want string
+	}{
+		{perf.Restrictions{}, ""},
+		{perf.Restrictions{ExcludeHypervisor: true}, "excluding hypervisor"},
+		{perf.Restrictions{ExcludeKernel: true, ExcludeHypervisor: true}, "excluding kernel, hypervisor"},
+	}
+	for _, tt := range tests {
+		if got := tt.r.String(); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.r, got, tt.want)
+		}
+	}
+}
+
+// withoutPerfCaps runs f on a locked OS thread, with CAP_PERFMON and
+// CAP_SYS_ADMIN removed from the effective capability set of the thread,
+// so that perf_event_paranoid applies even when running as root.
+func withoutPerfCaps(t *testing.T, f func()) {
+	t.Helper()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	type capHeader struct {
+		version uint32
+		pid     int32
+	}
+	type capData struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	hdr := capHeader{version: 0x20080522}
+	var saved [2]capData
+	_, _, e := unix.Syscall(unix.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&saved[0])), 0)
+	if e != 0 {
+		t.Skipf("capget: %v", e)
+	}
+	dropped := saved
+	dropped[0].effective &^= 1 << 21 // CAP_SYS_ADMIN
+	dropped[1].effective &^= 1 << 6  // CAP_PERFMON
+	if _, _, e := unix.Syscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&dropped[0])), 0); e != 0 {
+		t.Skipf("capset: %v", e)
+	}
+	defer func() {
+		_, _, e := unix.Syscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&saved[0])), 0)
+		if e != 0 {
+			t.Fatalf("failed to restore capabilities: %v", e)
+		}
+	}()
+	f()
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// KernelFeatures describes the perf_event_open features supported by
+// the running kernel.
+//
+// Features are detected by opening cheap software events on the calling
+// thread. The kernel rejects attributes it does not understand with EINVAL.
+// A feature is considered supported unless its trial open fails with EINVAL:
+// KernelFeatures describes what the kernel understands, not what the caller
+// is allowed to use, or what software events support.
+type KernelFeatures struct {
+	// AttrSize is the size of the perf_event_attr structure supported
+	// by the kernel, capped to the size known to package perf.
+	AttrSize uint32
+
+	// CloseOnExec indicates support for the PERF_FLAG_FD_CLOEXEC flag
+	// (since Linux 3.14).
+	CloseOnExec bool
+
+	// Options has a field set for each option the kernel supports.
+	// PreciseIP is not probed, and is always zero.
+	Options Options
+
+	// WriteBackward indicates support for writing ring buffers backwards
+	// (since Linux 4.7).
+	WriteBackward bool
+
+	// SampleFormat has a field set for each sample format bit the
+	// kernel supports.
+	SampleFormat SampleFormat
+}
+
+// Features probes the features supported by the running kernel. The result
+// is computed once, and cached. Features returns an error if the kernel
+// does not allow the calling thread to open even the simplest software
+// event.
+func Features() (*KernelFeatures, error) {
+	features.Do(func() {
+		features.kf, features.err = probeFeatures()
+	})
+	return features.kf, features.err
+}
+
+var features struct {
+	sync.Once
+	kf  *KernelFeatures
+	err error
+}
+
+func probeFeatures() (*KernelFeatures, error) {
+	kf := new(KernelFeatures)
+
+	base := unix.PerfEventAttr{
+		Type:   uint32(SoftwareEvent),
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Config: uint64(Dummy),
+		Bits:   Options{Disabled: true, ExcludeKernel: true, ExcludeHypervisor: true}.marshal(),
+	}
+	err := trialOpen(&base, 0)
+	if err == unix.EINVAL {
+		// The dummy event is only available since Linux 3.12.
+		base.Config = uint64(CPUClock)
+		err = trialOpen(&base, 0)
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("perf_event_open", err)
+	}
+	flags := 0
+	if trialOpen(&base, unix.PERF_FLAG_FD_CLOEXEC) == nil {
+		kf.CloseOnExec = true
+		flags = unix.PERF_FLAG_FD_CLOEXEC
+	}
+
+	// The kernel reports the size of its perf_event_attr if we set any
+	// field past its end. Set the last field.
+	sized := base
+	sized.Sample_max_stack = 1
+	kf.AttrSize = sized.Size
+	if err := trialOpen(&sized, flags); err == unix.E2BIG {
+		kf.AttrSize = sized.Size
+	}
+
+	optv := reflect.ValueOf(&kf.Options).Elem()
+	for i := 0; i < optv.NumField(); i++ {
+		field := optv.Type().Field(i)
+		if field.PkgPath != "" || field.Type.Kind() != reflect.Bool {
+			continue
+		}
+		var opt Options
+		reflect.ValueOf(&opt).Elem().Field(i).SetBool(true)
+		attr := base
+		attr.Bits |= opt.marshal()
+		switch {
+		case opt.Freq:
+			attr.Sample = 1
+		case opt.Watermark:
+			attr.Wakeup = 1
+		case opt.UseClockID:
+			attr.Clockid = unix.CLOCK_MONOTONIC
+		}
+		optv.Field(i).SetBool(featureSupported(trialOpen(&attr, flags)))
+	}
+	attr := base
+	attr.Bits |= Options{writeBackward: true}.marshal()
+	kf.WriteBackward = featureSupported(trialOpen(&attr, flags))
+
+	sfv := reflect.ValueOf(&kf.SampleFormat).Elem()
+	for i := 0; i < sfv.NumField(); i++ {
+		var sf SampleFormat
+		reflect.ValueOf(&sf).Elem().Field(i).SetBool(true)
+		attr := base
+		attr.Sample = 1 << 20
+		attr.Sample_type = sf.marshal()
+		switch {
+		case sf.BranchStack:
+			attr.Branch_sample_type = uint64(BranchSampleAny) | uint64(BranchPrivilegeUser)
+		case sf.UserRegisters:
+			attr.Sample_regs_user = 1
+		case sf.UserStack:
+			attr.Sample_stack_user = 8
+		case sf.IntrRegisters:
+			attr.Sample_regs_intr = 1
+		}
+		sfv.Field(i).SetBool(featureSupported(trialOpen(&attr, flags)))
+	}
+
+	return kf, nil
+}
+
+// trialOpen opens and immediately closes an event on the calling thread.
+func trialOpen(attr *unix.PerfEventAttr, flags int) error {
+	fd, err := unix.PerfEventOpen(attr, CallingThread, AnyCPU, -1, flags)
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
+
+// featureSupported interprets the result of a trial open.
+func featureSupported(err error) bool {
+	return err != unix.EINVAL
+}
+
+// FeatureError is the underlying error of the *OpenError returned by Open
+// if the event attributes request features which the running kernel does
+// not support.
+type FeatureError struct {
+	// Fields names the unsupported fields, e.g. "Options.Namespaces"
+	// or "SampleMaxStack".
+	Fields []string
+
+	// Err is the error returned by perf_event_open.
+	Err error
+}
+
+func (e *FeatureError) Error() string {
+	return fmt.Sprintf("perf: perf_event_open: %s not supported by the kernel: %v", strings.Join(e.Fields, ", "), e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *FeatureError) Unwrap() error { return e.Err }
+
+// sysAttrLayout is used to compute the offsets of perf_event_attr fields.
+var sysAttrLayout unix.PerfEventAttr
+
+// attrExtFields lists the fields of Attr which were added to
+// perf_event_attr after its original version, by the offset of the end
+// of the corresponding field in perf_event_attr.
+var attrExtFields = []struct {
+	name string
+	end  uintptr
+	set  func(a *Attr) bool
+}{
+	{"Config2", unsafe.Offsetof(sysAttrLayout.Ext2) + 8, func(a *Attr) bool { return a.Config2 != 0 }},
+	{"BranchSampleFormat", unsafe.Offsetof(sysAttrLayout.Branch_sample_type) + 8, func(a *Attr) bool { return a.BranchSampleFormat.marshal() != 0 }},
+	{"SampleRegistersUser", unsafe.Offsetof(sysAttrLayout.Sample_regs_user) + 8, func(a *Attr) bool { return a.SampleRegistersUser != 0 }},
+	{"SampleStackUser", unsafe.Offsetof(sysAttrLayout.Sample_stack_user) + 4, func(a *Attr) bool { return a.SampleStackUser != 0 }},
+	{"ClockID", unsafe.Offsetof(sysAttrLayout.Clockid) + 4, func(a *Attr) bool { return a.ClockID != 0 }},
+	{"SampleRegistersIntr", unsafe.Offsetof(sysAttrLayout.Sample_regs_intr) + 8, func(a *Attr) bool { return a.SampleRegistersIntr != 0 }},
+	{"AuxWatermark", unsafe.Offsetof(sysAttrLayout.Aux_watermark) + 4, func(a *Attr) bool { return a.AuxWatermark != 0 }},
+	{"SampleMaxStack", unsafe.Offsetof(sysAttrLayout.Sample_max_stack) + 2, func(a *Attr) bool { return a.SampleMaxStack != 0 }},
+}
+
+// fieldsBeyond returns the names of the fields set in a which do not fit
+// in a perf_event_attr of the specified size.
+func fieldsBeyond(a *Attr, size uint32) []string {
+	var fields []string
+	for _, f := range attrExtFields {
+		if f.end > uintptr(size) && f.set(a) {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+// unsupportedFeatures returns the names of the options and sample format
+// bits set in a which the running kernel does not support, according to
+// Features. It returns nil if features cannot be probed.
+func unsupportedFeatures(a *Attr) []string {
+	kf, err := Features()
+	if err != nil {
+		return nil
+	}
+	var fields []string
+	want := reflect.ValueOf(a.Options)
+	have := reflect.ValueOf(kf.Options)
+	for i := 0; i < want.NumField(); i++ {
+		name := want.Type().Field(i).Name
+		if want.Type().Field(i).PkgPath != "" || want.Field(i).Kind() != reflect.Bool {
+			continue
+		}
+		if want.Field(i).Bool() && !have.Field(i).Bool() {
+			fields = append(fields, "Options."+name)
+		}
+	}
+	want = reflect.ValueOf(a.SampleFormat)
+	have = reflect.ValueOf(kf.SampleFormat)
+	for i := 0; i < want.NumField(); i++ {
+		if want.Field(i).Bool() && !have.Field(i).Bool() {
+			fields = append(fields, "SampleFormat."+want.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+
+	"acln.ro/perf"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFeatures(t *testing.T) {
+	t.Run("Probe", testFeaturesProbe)
+	t.Run("Cached", testFeaturesCached)
+	t.Run("Error", testFeatureError)
+}
+
+func testFeaturesProbe(t *testing.T) {
+	requires(t, softwarePMU)
+
+	kf, err := perf.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+	max := uint32(unsafe.Sizeof(unix.PerfEventAttr{}))
+	if kf.AttrSize == 0 || kf.AttrSize > max {
+		t.Errorf("got AttrSize %d, want in (0, %d]", kf.AttrSize, max)
+	}
+	// These have been supported since the beginning.
+	if !kf.Options.Disabled || !kf.Options.Inherit || !kf.Options.ExcludeKernel {
+		t.Errorf("basic options reported as unsupported: %+v", kf.Options)
+	}
+	if !kf.SampleFormat.IP || !kf.SampleFormat.Tid || !kf.SampleFormat.Time {
+		t.Errorf("basic sample format bits reported as unsupported: %+v", kf.SampleFormat)
+	}
+	if kf.Options.PreciseIP != 0 {
+		t.Errorf("got PreciseIP %d, want 0", kf.Options.PreciseIP)
+	}
+}
+
+func testFeaturesCached(t *testing.T) {
+	requires(t, softwarePMU)
+
+	kf1, err := perf.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kf2, _ := perf.Features()
+	if kf1 != kf2 {
+		t.Fatal("Features is not cached")
+	}
+}
+
+func testFeatureError(t *testing.T) {
+	err := &perf.FeatureError{
+		Fields: []string{"Options.Namespaces", "SampleMaxStack"},
+		Err:    unix.E2BIG,
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "Options.Namespaces, SampleMaxStack") {
+		t.Errorf("error %q does not name the fields", msg)
+	}
+	if err.Unwrap() != unix.E2BIG {
+		t.Errorf("Unwrap returned %v, want E2BIG", err.Unwrap())
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetFilter sets the filter for ev, using PERF_EVENT_IOC_SET_FILTER.
+//
+// For tracepoint events, expr is a tracing filter expression, such as
+// "prev_pid == 0 && next_comm ~ \"go*\"". See Documentation/trace/events.rst
+// in the Linux source tree for the syntax. If the format of the tracepoint
+// can be read from the tracing file system, field names used in expr are
+// checked against it before the filter is set. See also
+// (*TracepointFormat).CheckFilter.
+//
+// For PMUs which support address filters, such as intel_pt, expr is a list
+// of address filters. See SetAddressFilters.
+func (ev *Event) SetFilter(expr string) error {
+	if err := ev.ok(); err != nil {
+		return err
+	}
+	if ev.a.Type == TracepointEvent {
+		if err := checkTracepointFilter(ev.a.Config, expr); err != nil {
+			return err
+		}
+	}
+	return ev.setFilter(expr)
+}
+
+func (ev *Event) setFilter(expr string) error {
+	b := append([]byte(expr), 0)
+	err := ev.ioctlPointer(unix.PERF_EVENT_IOC_SET_FILTER, unsafe.Pointer(&b[0]))
+	return wrapIoctlError("PERF_EVENT_IOC_SET_FILTER", err)
+}
+
+// WithFilter returns a Configurator which configures an event using cfg,
+// then sets Attr.Filter to expr. The filter is applied when the event is
+// opened, including by (*Group).Open.
+func WithFilter(cfg Configurator, expr string) Configurator {
+	return configuratorFunc(func(attr *Attr) error {
+		if err := cfg.Configure(attr); err != nil {
+			return err
+		}
+		attr.Filter = expr
+		return nil
+	})
+}
+
+// checkTracepointFilter checks expr against the format of the tracepoint
+// identified by config. If the format cannot be found, the check is skipped,
+// and the kernel has the last word.
+func checkTracepointFilter(config uint64, expr string) error {
+	label := lookupLabel(eventID{Type: uint64(TracepointEvent), Config: config})
+	i := strings.Index(label.Name, ":")
+	if i < 0 {
+		return nil
+	}
+	tf, err := LookupTracepointFormat(label.Name[:i], label.Name[i+1:])
+	if err != nil {
+		return nil
+	}
+	return tf.CheckFilter(expr)
+}
+
+// FilterError is returned if a tracepoint filter refers to a field the
+// tracepoint does not have.
+type FilterError struct {
+	// Tracepoint is the name of the tracepoint.
+	Tracepoint string
+
+	// Filter is the offending filter expression.
+	Filter string
+
+	// Field is the unknown field.
+	Field string
+
+	// Fields lists the fields the tracepoint has.
+	Fields []string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("perf: filter %q: tracepoint %s has no field %q (fields: %s)",
+		e.Filter, e.Tracepoint, e.Field, strings.Join(e.Fields, ", "))
+}
+
+// filterSpecialFields lists the fields the kernel accepts in any tracepoint
+// filter, in addition to the fields of the tracepoint.
+var filterSpecialFields = []string{"common_cpu", "cpu", "CPU", "comm", "COMM"}
+
+// CheckFilter checks that the fields used in the filter expression expr
+// are fields of the tracepoint. It returns a *FilterError if they are not.
+// CheckFilter does not check the syntax of expr in full: the kernel
+// reports syntax errors as EINVAL when the filter is set.
+func (tf *TracepointFormat) CheckFilter(expr string) error {
+	for _, name := range filterFields(expr) {
+		if tf.field(name) != nil || containsString(filterSpecialFields, name) {
+			continue
+		}
+		var fields []string
+		for _, f := range tf.Fields {
+			fields = append(fields, f.Name)
+		}
+		return &FilterError{
+			Tracepoint: tf.Name,
+			Filter:     expr,
+			Field:      name,
+			Fields:     fields,
+		}
+	}
+	return nil
+}
+
+// filterOperators lists the comparison operators of tracing filters,
+// longest first.
+var filterOperators = []string{"==", "!=", "<=", ">=", "<", ">", "&", "~"}
+
+// filterFields returns the field names used in a filter expression: the
+// identifiers which appear as the left operand of a comparison.
+func filterFields(expr string) []string {
+	var fields []string
+	s := expr
+	for len(s) > 0 {
+		c := s[0]
+		switch {
+		case c == '"' || c == '\'':
+			// Skip quoted strings, which may contain anything.
+			end := strings.IndexByte(s[1:], c)
+			if end < 0 {
+				return fields
+			}
+			s = s[end+2:]
+		case '0' <= c && c <= '9':
+			// Skip numbers, including hexadecimal ones.
+			n := 1
+			for n < len(s) && isIdentChar(s[n]) {
+				n++
+			}
+			s = s[n:]
+		case isIdentStart(c):
+			n := 1
+			for n < len(s) && isIdentChar(s[n]) {
+				n++
+			}
+			ident := s[:n]
+			s = s[n:]
+			rest := strings.TrimLeft(s, " \t")
+			for _, op := range filterOperators {
+				if strings.HasPrefix(rest, op) && !strings.HasPrefix(rest, "&&") {
+					fields = append(fields, ident)
+					break
+				}
+			}
+		default:
+			s = s[1:]
+		}
+	}
+	return fields
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || '0' <= c && c <= '9'
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// AddressFilterAction is the action of an address filter.
+type AddressFilterAction int
+
+// Address filter actions.
+const (
+	// AddressFilterRange traces only within the address range.
+	AddressFilterRange AddressFilterAction = iota
+
+	// AddressFilterStart starts tracing when execution reaches the
+	// address.
+	AddressFilterStart
+
+	// AddressFilterStop stops tracing when execution reaches the address.
+	AddressFilterStop
+)
+
+// AddressFilter is an address filter for PMUs which support them, such
+// as intel_pt and cs_etm. Address filters restrict the instruction trace
+// recorded in the AUX area.
+type AddressFilter struct {
+	Action AddressFilterAction
+
+	// Addr is the start address. If Object is set, Addr is an offset in
+	// the object file. Otherwise, Addr is a kernel address.
+	Addr uint64
+
+	// Size is the size of the address range, for AddressFilterRange.
+	Size uint64
+
+	// Object is the path to an object file, or the empty string for
+	// kernel addresses.
+	Object string
+}
+
+// String returns the filter in the syntax expected by the kernel, e.g.
+// "filter 0x1000/0x200@/usr/bin/foo".
+func (f AddressFilter) String() string {
+	var s string
+	switch f.Action {
+	case AddressFilterStart:
+		s = fmt.Sprintf("start %#x", f.Addr)
+	case AddressFilterStop:
+		s = fmt.Sprintf("stop %#x", f.Addr)
+	default:
+		s = fmt.Sprintf("filter %#x/%#x", f.Addr, f.Size)
+	}
+	if f.Object != "" {
+		s += "@" + f.Object
+	}
+	return s
+}
+
+// SetAddressFilters sets the address filters for ev, which must be
+// associated with a PMU which supports them. Filters replace any
+// previously set filters.
+func (ev *Event) SetAddressFilters(filters ...AddressFilter) error {
+	if err := ev.ok(); err != nil {
+		return err
+	}
+	specs := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if f.Action == AddressFilterRange && f.Size == 0 {
+			return fmt.Errorf("perf: address filter %v has zero size", f)
+		}
+		if strings.ContainsAny(f.Object, " ,\n") {
+			return fmt.Errorf("perf: address filter object %q contains a separator", f.Object)
+		}
+		specs = append(specs, f.String())
+	}
+	return ev.setFilter(strings.Join(specs, ","))
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"acln.ro/perf"
+)
+
+func TestFilter(t *testing.T) {
+	t.Run("CheckFilter", testCheckFilter)
+	t.Run("AddressFilter", testAddressFilterString)
+	t.Run("SetFilter", testSetFilter)
+	t.Run("Group", testFilterGroup)
+}
+
+func testCheckFilter(t *testing.T) {
+	f, err := os.Open(filepath.Join(fixtureTracefs, "events", "sched", "sched_switch", "format"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tf, err := perf.ParseTracepointFormat(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := []string{
+		"prev_pid == 0",
+		"prev_pid==0&&next_pid!=0x10",
+		`next_comm ~ "go*" || (prev_prio < 120 && common_pid > 1)`,
+		`prev_comm == "a == b"`,
+		"prev_state & 2",
+		"cpu == 0",
+	}
+	for _, expr := range valid {
+		if err := tf.CheckFilter(expr); err != nil {
+			t.Errorf("%q: %v", expr, err)
+		}
+	}
+
+	invalid := []struct {
+		expr  string
+		field string
+	}{
+		{"pid == 0", "pid"},
+		{"prev_pid == 0 && nxt_comm ~ \"go*\"", "nxt_comm"},
+		{"(prev_prio >= 100)||next_prioo<=1", "next_prioo"},
+	}
+	for _, tt := range invalid {
+		err := tf.CheckFilter(tt.expr)
+		ferr, ok := err.(*perf.FilterError)
+		if !ok {
+			t.Errorf("%q: got %v, want *perf.FilterError", tt.expr, err)
+			continue
+		}
+		if ferr.Field != tt.field {
+			t.Errorf("%q: got field %q, want %q", tt.expr, ferr.Field, tt.field)
+		}
+		if len(ferr.Fields) != 7 {
+			t.Errorf("%q: got fields %v, want the 7 sched_switch fields", tt.expr, ferr.Fields)
+		}
+	}
+}
+
+func testAddressFilterString(t *testing.T) {
+	tests := []struct {
+		f    perf.AddressFilter
+		want string
+	}{
+		{
+			f:    perf.AddressFilter{Addr: 0x1000, Size: 0x200, Object: "/usr/bin/foo"},
+			want: "filter 0x1000/0x200@/usr/bin/foo",
+		},
+		{
+			f:    perf.AddressFilter{Action: perf.AddressFilterStart, Addr: 0xffffffff81000000},
+			want: "start 0xffffffff81000000",
+		},
+		{
+			f:    perf.AddressFilter{Action: perf.AddressFilterStop, Addr: 0x40, Object: "/lib/libc.so.6"},
+			want: "stop 0x40@/lib/libc.so.6",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.f.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func testSetFilter(t *testing.T) {
+	requires(t, paranoid(1), tracepointPMU, tracefs)
+
+	attr := new(perf.Attr)
+	if err := perf.Tracepoint("syscalls", "sys_enter_getpid").Configure(attr); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+
+	if _, ok := ev.SetFilter("no_such_field == 1").(*perf.FilterError); !ok {
+		t.Fatal("filter with unknown field was not rejected client-side")
+	}
+	if err := ev.SetFilter("common_pid == 1"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ev.Measure(getpidTrigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Value != 0 {
+		t.Fatalf("got %d events for filtered-out pid, want 0", c.Value)
+	}
+}
+
+func testFilterGroup(t *testing.T) {
+	requires(t, paranoid(1), tracepointPMU, tracefs)
+
+	g := new(perf.Group)
+	g.Add(
+		perf.Tracepoint("syscalls", "sys_enter_getpid"),
+		perf.WithFilter(perf.Tracepoint("syscalls", "sys_enter_getpid"), "common_pid == 1"),
+	)
+	ev, err := g.Open(perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+	gc, err := ev.MeasureGroup(getpidTrigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.Values[0].Value == 0 || gc.Values[1].Value != 0 {
+		t.Fatalf("got %d unfiltered and %d filtered events, want > 0 and 0",
+			gc.Values[0].Value, gc.Values[1].Value)
+	}
+
+	g = new(perf.Group)
+	g.Add(perf.WithFilter(perf.Tracepoint("syscalls", "sys_enter_getpid"), "bogus == 1"))
+	if _, err := g.Open(perf.CallingThread, perf.AnyCPU); err == nil {
+		t.Fatal("opened group with bad filter")
+	}
+}
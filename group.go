@@ -21,12 +21,73 @@ type Group struct {
 	// ClockID configures the clock for samples in the group.
 	ClockID int32
 
+	// OpenOptions configures how the events in the group are opened.
+	OpenOptions OpenOptions
+
+	// SampleFormat configures information requested in sample records
+	// for all events in the group.
+	SampleFormat SampleFormat
+
+	// Sample configures the sample period or sample frequency for all
+	// events in the group, based on Options.Freq. See Attr.Sample and
+	// SetSample{Period,Freq}.
+	Sample uint64
+
+	// Wakeup configures wakeups on the ring buffer of the group leader,
+	// based on Options.Watermark. See Attr.Wakeup and
+	// SetWakeup{Events,Watermark}.
+	Wakeup uint32
+
+	// RingPages is the number of data pages in the ring buffer of the
+	// group leader, which Open maps if any event in the group samples.
+	// It must be a power of two. If RingPages is zero, DefaultNumPages
+	// is used.
+	RingPages int
+
+	// LeaderSampling configures the group such that only the leader
+	// samples. Each sample carries the values of all events in the
+	// group: Open sets SampleFormat.Count on the leader, and disables
+	// sampling on the followers. The values are available, labeled, in
+	// the Count field of SampleGroupRecord.
+	LeaderSampling bool
+
 	err             error // sticky configuration error
 	attrs           []*Attr
 	leaderNeedsRing bool
 }
 
-// TODO(acln): what other fields belong on Group? SampleFormat perhaps?
+// SetSamplePeriod configures the sampling period for the group.
+//
+// It sets g.Sample to p and disables g.Options.Freq.
+func (g *Group) SetSamplePeriod(p uint64) {
+	g.Sample = p
+	g.Options.Freq = false
+}
+
+// SetSampleFreq configures the sampling frequency for the group.
+//
+// It sets g.Sample to f and enables g.Options.Freq.
+func (g *Group) SetSampleFreq(f uint64) {
+	g.Sample = f
+	g.Options.Freq = true
+}
+
+// SetWakeupEvents configures the group to wake up every n events.
+//
+// It sets g.Wakeup to n and disables g.Options.Watermark.
+func (g *Group) SetWakeupEvents(n uint32) {
+	g.Wakeup = n
+	g.Options.Watermark = false
+}
+
+// SetWakeupWatermark configures the number of bytes in overflow records
+// before wakeup.
+//
+// It sets g.Wakeup to n and enables g.Options.Watermark.
+func (g *Group) SetWakeupWatermark(n uint32) {
+	g.Wakeup = n
+	g.Options.Watermark = true
+}
 
 // Add adds events to the group, as configured by cfgs.
 //
@@ -47,6 +108,9 @@ func (g *Group) add(cfg Configurator) {
 	a.CountFormat = g.CountFormat
 	a.Options = g.Options
 	a.ClockID = g.ClockID
+	a.SampleFormat = g.SampleFormat
+	a.Sample = g.Sample
+	a.Wakeup = g.Wakeup
 	err := cfg.Configure(a)
 	if err != nil {
 		g.err = err
@@ -72,23 +136,30 @@ func (g *Group) Open(pid int, cpu int) (*Event, error) {
 	}
 	leaderattr := g.attrs[0]
 	leaderattr.CountFormat.Group = true
-	leader, err := Open(leaderattr, pid, cpu, nil)
-	if err != nil {
-		return nil, fmt.Errorf("perf: failed to open event leader: %v", err)
+	needsRing := g.leaderNeedsRing
+	if g.LeaderSampling {
+		leaderattr.SampleFormat.Count = true
+		for _, attr := range g.attrs[1:] {
+			attr.Sample = 0
+			attr.Options.Freq = false
+		}
+		needsRing = leaderattr.Sample != 0
 	}
-	if len(g.attrs) < 2 {
-		return leader, nil
+	leader, err := OpenWithOptions(leaderattr, pid, cpu, nil, g.OpenOptions)
+	if err != nil {
+		return nil, err // *OpenError or *ValidationError, labeled
 	}
-	if g.leaderNeedsRing {
-		if err := leader.MapRing(); err != nil {
+	if needsRing {
+		if err := leader.MapRingNumPages(g.ringPages()); err != nil {
+			leader.Close()
 			return nil, fmt.Errorf("perf: failed to map leader ring: %v", err)
 		}
 	}
-	for idx, attr := range g.attrs[1:] {
-		follower, err := Open(attr, pid, cpu, leader)
+	for _, attr := range g.attrs[1:] {
+		follower, err := OpenWithOptions(attr, pid, cpu, leader, g.OpenOptions)
 		if err != nil {
 			leader.Close()
-			return nil, fmt.Errorf("perf: failed to open group event #%d (%q): %v", idx, attr.Label, err)
+			return nil, err
 		}
 		leader.owned = append(leader.owned, follower)
 		if attr.Sample != 0 {
@@ -101,6 +172,13 @@ func (g *Group) Open(pid int, cpu int) (*Event, error) {
 	return leader, nil
 }
 
+func (g *Group) ringPages() int {
+	if g.RingPages == 0 {
+		return DefaultNumPages
+	}
+	return g.RingPages
+}
+
 // A Configurator configures event attributes. Implementations should only
 // set the fields they need. See (*Group).Add for more details.
 type Configurator interface {
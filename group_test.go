@@ -16,6 +16,9 @@ import (
 func TestGroup(t *testing.T) {
 	t.Run("Count", testGroupCount)
 	t.Run("Record", testGroupRecord)
+	t.Run("MeasureResetsFollowers", testGroupMeasureResetsFollowers)
+	t.Run("FollowerControl", testGroupFollowerControl)
+	t.Run("LeaderSampling", testGroupLeaderSampling)
 }
 
 func testGroupCount(t *testing.T) {
@@ -54,7 +57,7 @@ func testGroupCount(t *testing.T) {
 }
 
 func testGroupRecord(t *testing.T) {
-	requires(t, tracepointPMU, debugfs) // TODO(acln): paranoid
+	requires(t, tracepointPMU, tracefs) // TODO(acln): paranoid
 
 	ga := &perf.Attr{
 		Options: perf.Options{
@@ -146,3 +149,153 @@ func testGroupRecord(t *testing.T) {
 		t.Fatalf("equal IP 0x%x for samples of different events", wip)
 	}
 }
+
+// spin burns CPU time on the calling thread for roughly d.
+func spin(d time.Duration) {
+	for start := time.Now(); time.Since(start) < d; {
+	}
+}
+
+func testGroupMeasureResetsFollowers(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// Neither event is disabled at open: both start counting right away.
+	g := perf.Group{
+		Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+	g.Add(perf.TaskClock, perf.TaskClock)
+	ev, err := g.Open(perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+
+	spin(20 * time.Millisecond)
+	gc, err := ev.MeasureGroup(getpidTrigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range gc.Values {
+		if time.Duration(v.Value) > 10*time.Millisecond {
+			t.Errorf("%s counted %v, want only the measured region", v.Label, time.Duration(v.Value))
+		}
+	}
+}
+
+func testGroupFollowerControl(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	la := &perf.Attr{
+		CountFormat: perf.CountFormat{Group: true},
+		Options:     perf.Options{Disabled: true, ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+	perf.TaskClock.Configure(la)
+	leader, err := perf.Open(la, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	fa := &perf.Attr{
+		Options: perf.Options{Disabled: true, ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+	perf.TaskClock.Configure(fa)
+	follower, err := perf.Open(fa, perf.CallingThread, perf.AnyCPU, leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	if err := follower.EnableGroup(); err != nil {
+		t.Fatal(err)
+	}
+	spin(5 * time.Millisecond)
+	if err := follower.DisableGroup(); err != nil {
+		t.Fatal(err)
+	}
+	gc, err := leader.ReadGroupCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range gc.Values {
+		if v.Value == 0 {
+			t.Fatalf("%s did not count after follower enabled the group", v.Label)
+		}
+	}
+
+	spin(5 * time.Millisecond)
+	after, err := leader.ReadGroupCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Values[0].Value != gc.Values[0].Value {
+		t.Fatal("leader kept counting after follower disabled the group")
+	}
+
+	if err := follower.ResetGroup(); err != nil {
+		t.Fatal(err)
+	}
+	after, err = leader.ReadGroupCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range after.Values {
+		if v.Value != 0 {
+			t.Fatalf("%s = %d after ResetGroup, want 0", v.Label, v.Value)
+		}
+	}
+}
+
+func testGroupLeaderSampling(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	g := perf.Group{
+		Options:        perf.Options{Disabled: true, ExcludeKernel: true, ExcludeHypervisor: true},
+		SampleFormat:   perf.SampleFormat{Tid: true, Time: true},
+		RingPages:      8,
+		LeaderSampling: true,
+	}
+	g.SetSamplePeriod(uint64(time.Millisecond)) // task-clock counts nanoseconds
+	g.SetWakeupEvents(1)
+	g.Add(perf.TaskClock, perf.PageFaults, perf.ContextSwitches)
+	ev, err := g.Open(perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+
+	if _, err := ev.MeasureGroup(func() { spin(10 * time.Millisecond) }); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	rec, err := ev.ReadRecord(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, ok := rec.(*perf.SampleGroupRecord)
+	if !ok {
+		t.Fatalf("got %T, want *perf.SampleGroupRecord", rec)
+	}
+	want := []string{"task-clock", "page-faults", "context-switches"}
+	if len(sr.Count.Values) != len(want) {
+		t.Fatalf("got %d values in sample, want %d", len(sr.Count.Values), len(want))
+	}
+	for i, v := range sr.Count.Values {
+		if v.Label != want[i] {
+			t.Errorf("value %d: got label %q, want %q", i, v.Label, want[i])
+		}
+	}
+	if sr.Count.Values[0].Value == 0 {
+		t.Error("sample carries no task-clock value")
+	}
+}
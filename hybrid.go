@@ -0,0 +1,281 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// pmuTypeShift is the position of the PMU type in the extended Config of
+// generic hardware and hardware cache events (PERF_PMU_TYPE_SHIFT). Since
+// Linux 5.13, the upper 32 bits of Config select the core PMU which counts
+// the event, on hybrid CPUs.
+const pmuTypeShift = 32
+
+// HybridPMUs returns the core PMUs of the host, if the host has a hybrid
+// CPU, such as cpu_core and cpu_atom. On other CPUs, it returns no PMUs,
+// and a nil error.
+func HybridPMUs() ([]*PMU, error) {
+	return LoadHybridPMUs(pmuDevicesDir)
+}
+
+// LoadHybridPMUs is like HybridPMUs, but loads PMUs from the specified
+// sysfs directory. Core PMUs of hybrid CPUs are named cpu_<type>, and
+// list the CPUs of their core type in a cpus file. The PMUs are sorted
+// by name.
+func LoadHybridPMUs(dir string) ([]*PMU, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "cpu_*", "cpus"))
+	if err != nil {
+		return nil, err
+	}
+	var pmus []*PMU
+	for _, path := range paths {
+		pmu, err := LoadPMU(filepath.Dir(path))
+		if err != nil {
+			return nil, err
+		}
+		pmus = append(pmus, pmu)
+	}
+	return pmus, nil
+}
+
+// HybridAttr is the attribute of an event, targeted at a core PMU.
+type HybridAttr struct {
+	// PMU is the core PMU which counts the event. It is nil if the event
+	// is not counted by the core PMUs, e.g. for software events.
+	PMU *PMU
+
+	Attr *Attr
+}
+
+// ExpandHybrid expands a generic event into one event per core PMU in
+// pmus. Hardware and hardware cache events select the PMU using the
+// extended bits of Config. Raw events are retargeted to the PMU type.
+// Each expanded event is labeled "<pmu>/<label>/", like the perf tool
+// does.
+//
+// Other events, and all events if pmus is empty, are not expanded:
+// ExpandHybrid returns a single HybridAttr with a nil PMU.
+func ExpandHybrid(a *Attr, pmus []*PMU) []HybridAttr {
+	switch {
+	case len(pmus) == 0:
+		return []HybridAttr{{Attr: a}}
+	case a.Type == HardwareEvent, a.Type == HardwareCacheEvent, a.Type == RawEvent:
+	default:
+		return []HybridAttr{{Attr: a}}
+	}
+	label := hybridLabel(a)
+	expanded := make([]HybridAttr, 0, len(pmus))
+	for _, pmu := range pmus {
+		pa := new(Attr)
+		*pa = *a
+		if a.Type == RawEvent {
+			pa.Type = pmu.Type
+		} else {
+			pa.Config = uint64(pmu.Type)<<pmuTypeShift | a.Config&(1<<pmuTypeShift-1)
+		}
+		pa.Label = fmt.Sprintf("%s/%s/", pmu.Name, label)
+		expanded = append(expanded, HybridAttr{PMU: pmu, Attr: pa})
+	}
+	return expanded
+}
+
+// hybridLabel returns the label of a, before expansion.
+func hybridLabel(a *Attr) string {
+	if a.Label != "" {
+		return a.Label
+	}
+	return lookupLabel(eventID{
+		Type:    uint64(a.Type),
+		Config:  a.Config,
+		Config1: a.Config1,
+		Config2: a.Config2,
+	}).Name
+}
+
+// HybridEvent is a generic event, opened once per core PMU of a hybrid
+// CPU, and controlled as a single event.
+type HybridEvent struct {
+	label      string
+	systemWide bool
+	pmus       []*PMU
+	events     []*Event
+}
+
+// OpenHybrid opens a on each core PMU in pmus, as expanded by
+// ExpandHybrid. See Open for the meaning of pid and cpu.
+//
+// If cpu is AnyCPU, an event is opened on every PMU, and each event counts
+// while pid runs on the CPUs of its PMU. Otherwise, the event is only
+// opened on the PMU which lists cpu among its CPUs.
+//
+// If pid is AllThreads and cpu is AnyCPU, the event is measured
+// system-wide: each PMU is opened on every CPU listed in its CPUs field,
+// and on no other CPU.
+func OpenHybrid(a *Attr, pid, cpu int, pmus []*PMU) (*HybridEvent, error) {
+	he := &HybridEvent{
+		label:      hybridLabel(a),
+		systemWide: pid == AllThreads && cpu == AnyCPU,
+	}
+	for _, ha := range ExpandHybrid(a, pmus) {
+		cpus := []int{cpu}
+		switch {
+		case ha.PMU == nil:
+		case he.systemWide:
+			if len(ha.PMU.CPUs) == 0 {
+				he.Close()
+				return nil, fmt.Errorf("perf: PMU %s lists no CPUs", ha.PMU.Name)
+			}
+			cpus = ha.PMU.CPUs
+		case cpu != AnyCPU && !containsInt(ha.PMU.CPUs, cpu):
+			continue
+		}
+		for _, c := range cpus {
+			ev, err := Open(ha.Attr, pid, c, nil)
+			if err != nil {
+				he.Close()
+				return nil, err
+			}
+			he.pmus = append(he.pmus, ha.PMU)
+			he.events = append(he.events, ev)
+		}
+	}
+	if len(he.events) == 0 {
+		return nil, fmt.Errorf("perf: no core PMU counts on CPU %d", cpu)
+	}
+	return he, nil
+}
+
+func containsInt(list []int, x int) bool {
+	for _, e := range list {
+		if e == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Events returns the underlying events, one per core PMU, or one per core
+// PMU and CPU for system-wide events.
+func (he *HybridEvent) Events() []*Event {
+	return he.events
+}
+
+// Enable enables the event on all PMUs.
+func (he *HybridEvent) Enable() error {
+	return he.each((*Event).Enable)
+}
+
+// Disable disables the event on all PMUs.
+func (he *HybridEvent) Disable() error {
+	return he.each((*Event).Disable)
+}
+
+// Reset resets the counters on all PMUs.
+func (he *HybridEvent) Reset() error {
+	return he.each((*Event).Reset)
+}
+
+// Close closes the event on all PMUs. It returns the first error
+// encountered, if any.
+func (he *HybridEvent) Close() error {
+	return he.each((*Event).Close)
+}
+
+func (he *HybridEvent) each(fn func(*Event) error) error {
+	var first error
+	for _, ev := range he.events {
+		if err := fn(ev); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// HybridCount is a measurement taken by a HybridEvent.
+//
+// The embedded Count merges the counts of all PMUs, and Value is their
+// sum. For system-wide events, Enabled and Running are the sums of the
+// times of all underlying events. Otherwise, Enabled is the longest
+// enabled time, and Running is the sum of running times: since each PMU
+// only runs while the measured thread is on a CPU of its core type,
+// Count.Scaled accounts for multiplexing, but not for the time spent on
+// other core types.
+type HybridCount struct {
+	Count
+
+	// PerPMU holds the counts of each core PMU. For system-wide events,
+	// the counts of all the CPUs of a PMU are added together.
+	PerPMU []PMUCount
+}
+
+// PMUCount is the count of an event on a specific core PMU.
+type PMUCount struct {
+	// PMU is the name of the PMU, or the empty string if the event is
+	// not counted by a core PMU.
+	PMU string
+
+	Count
+}
+
+// ReadCount reads the counts of all PMUs, and merges them.
+func (he *HybridEvent) ReadCount() (HybridCount, error) {
+	hc := HybridCount{Count: Count{Label: he.label}}
+	for i, ev := range he.events {
+		c, err := ev.ReadCount()
+		if err != nil {
+			return HybridCount{}, err
+		}
+		if i > 0 && he.pmus[i] == he.pmus[i-1] {
+			last := &hc.PerPMU[len(hc.PerPMU)-1]
+			last.Count = last.Count.Add(c)
+			continue
+		}
+		var pmu string
+		if he.pmus[i] != nil {
+			pmu = he.pmus[i].Name
+		}
+		hc.PerPMU = append(hc.PerPMU, PMUCount{PMU: pmu, Count: c})
+	}
+	for _, pc := range hc.PerPMU {
+		if he.systemWide {
+			hc.Count = hc.Count.Add(pc.Count)
+			continue
+		}
+		hc.Value += pc.Value
+		if pc.Enabled > hc.Enabled {
+			hc.Enabled = pc.Enabled
+		}
+		hc.Running += pc.Running
+		hc.Restrictions = hc.Restrictions.union(pc.Restrictions)
+	}
+	if hc.Running > hc.Enabled {
+		hc.Running = hc.Enabled
+	}
+	return hc, nil
+}
+
+// Measure disables and resets the event on all PMUs, enables it, runs f,
+// disables it again, then reads the merged count.
+//
+// Unlike Event.Measure, the events are enabled one after another, so the
+// measured region is slightly larger than f.
+func (he *HybridEvent) Measure(f func()) (HybridCount, error) {
+	if err := he.Disable(); err != nil {
+		return HybridCount{}, err
+	}
+	if err := he.Reset(); err != nil {
+		return HybridCount{}, err
+	}
+	if err := he.Enable(); err != nil {
+		return HybridCount{}, err
+	}
+	f()
+	if err := he.Disable(); err != nil {
+		return HybridCount{}, err
+	}
+	return he.ReadCount()
+}
@@ -0,0 +1,235 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"acln.ro/perf"
+)
+
+var fixtureHybridDevices = filepath.Join("testdata", "sysfs-hybrid", "bus", "event_source", "devices")
+
+func TestHybrid(t *testing.T) {
+	t.Run("LoadPMUs", testLoadHybridPMUs)
+	t.Run("NotHybrid", testLoadHybridPMUsNotHybrid)
+	t.Run("Expand", testExpandHybrid)
+	t.Run("ExpandPassthrough", testExpandHybridPassthrough)
+	t.Run("OpenSoftware", testOpenHybridSoftware)
+	t.Run("OpenSystemWide", testOpenHybridSystemWide)
+	t.Run("Label", testHybridLabel)
+}
+
+func testLoadHybridPMUs(t *testing.T) {
+	pmus, err := perf.LoadHybridPMUs(fixtureHybridDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pmus) != 2 {
+		t.Fatalf("got %d PMUs, want 2", len(pmus))
+	}
+	want := []struct {
+		name string
+		typ  perf.EventType
+		cpus []int
+	}{
+		{"cpu_atom", 10, []int{8, 9, 10, 11, 12, 13, 14, 15}},
+		{"cpu_core", 4, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+	}
+	for i, w := range want {
+		pmu := pmus[i]
+		if pmu.Name != w.name || pmu.Type != w.typ {
+			t.Errorf("PMU %d: got %s (type %d), want %s (type %d)", i, pmu.Name, pmu.Type, w.name, w.typ)
+		}
+		if !reflect.DeepEqual(pmu.CPUs, w.cpus) {
+			t.Errorf("%s: got CPUs %v, want %v", pmu.Name, pmu.CPUs, w.cpus)
+		}
+	}
+}
+
+func testLoadHybridPMUsNotHybrid(t *testing.T) {
+	pmus, err := perf.LoadHybridPMUs(fixtureDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pmus) != 0 {
+		t.Fatalf("got %d hybrid PMUs, want none", len(pmus))
+	}
+}
+
+func testExpandHybrid(t *testing.T) {
+	pmus, err := perf.LoadHybridPMUs(fixtureHybridDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(perf.Attr)
+	perf.Instructions.Configure(a)
+	expanded := perf.ExpandHybrid(a, pmus)
+	if len(expanded) != 2 {
+		t.Fatalf("got %d attributes, want 2", len(expanded))
+	}
+	for _, ha := range expanded {
+		wantConfig := uint64(ha.PMU.Type)<<32 | uint64(perf.Instructions)
+		if ha.Attr.Type != perf.HardwareEvent || ha.Attr.Config != wantConfig {
+			t.Errorf("%s: got type %d, config %#x, want type %d, config %#x",
+				ha.PMU.Name, ha.Attr.Type, ha.Attr.Config, perf.HardwareEvent, wantConfig)
+		}
+		if want := ha.PMU.Name + "/instructions/"; ha.Attr.Label != want {
+			t.Errorf("got label %q, want %q", ha.Attr.Label, want)
+		}
+	}
+	if a.Config != uint64(perf.Instructions) {
+		t.Errorf("original attribute modified: got config %#x", a.Config)
+	}
+
+	raw := &perf.Attr{Type: perf.RawEvent, Config: 0x00c0, Label: "inst_retired"}
+	for _, ha := range perf.ExpandHybrid(raw, pmus) {
+		if ha.Attr.Type != ha.PMU.Type || ha.Attr.Config != 0x00c0 {
+			t.Errorf("%s: got type %d, config %#x, want type %d, config 0xc0",
+				ha.PMU.Name, ha.Attr.Type, ha.Attr.Config, ha.PMU.Type)
+		}
+	}
+}
+
+func testExpandHybridPassthrough(t *testing.T) {
+	pmus, err := perf.LoadHybridPMUs(fixtureHybridDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw := new(perf.Attr)
+	perf.TaskClock.Configure(sw)
+	expanded := perf.ExpandHybrid(sw, pmus)
+	if len(expanded) != 1 || expanded[0].PMU != nil || expanded[0].Attr != sw {
+		t.Errorf("software event expanded to %+v", expanded)
+	}
+
+	hw := new(perf.Attr)
+	perf.CPUCycles.Configure(hw)
+	expanded = perf.ExpandHybrid(hw, nil)
+	if len(expanded) != 1 || expanded[0].PMU != nil || expanded[0].Attr != hw {
+		t.Errorf("hardware event expanded to %+v without hybrid PMUs", expanded)
+	}
+}
+
+func testOpenHybridSoftware(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	a := &perf.Attr{
+		Options: perf.Options{Disabled: true},
+		CountFormat: perf.CountFormat{
+			Enabled: true,
+			Running: true,
+		},
+	}
+	perf.TaskClock.Configure(a)
+
+	he, err := perf.OpenHybrid(a, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer he.Close()
+
+	hc, err := he.Measure(func() {
+		spin(5 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.Label != "task-clock" {
+		t.Errorf("got label %q, want task-clock", hc.Label)
+	}
+	if len(hc.PerPMU) != 1 || hc.PerPMU[0].PMU != "" {
+		t.Fatalf("got per-PMU counts %+v, want a single count", hc.PerPMU)
+	}
+	if hc.Value == 0 || hc.Value != hc.PerPMU[0].Value {
+		t.Errorf("got merged value %d, per-PMU value %d", hc.Value, hc.PerPMU[0].Value)
+	}
+	if hc.Running > hc.Enabled {
+		t.Errorf("running time %v exceeds enabled time %v", hc.Running, hc.Enabled)
+	}
+}
+
+func testOpenHybridSystemWide(t *testing.T) {
+	requires(t, paranoid(0), softwarePMU)
+
+	cpus, err := perf.OnlineCPUs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Raw events are retargeted to the type of each PMU, so PMUs of the
+	// software type count cpu-clock (config 0) on their CPUs.
+	pmus := []*perf.PMU{
+		{Name: "cpu_atom", Type: perf.SoftwareEvent, CPUs: cpus[:1]},
+		{Name: "cpu_core", Type: perf.SoftwareEvent, CPUs: cpus},
+	}
+	a := &perf.Attr{
+		Label:   "cpu-clock",
+		Type:    perf.RawEvent,
+		Options: perf.Options{Disabled: true},
+		CountFormat: perf.CountFormat{
+			Enabled: true,
+			Running: true,
+		},
+	}
+	he, err := perf.OpenHybrid(a, perf.AllThreads, perf.AnyCPU, pmus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer he.Close()
+	if got, want := len(he.Events()), 1+len(cpus); got != want {
+		t.Fatalf("got %d events, want one per PMU and CPU (%d)", got, want)
+	}
+
+	hc, err := he.Measure(func() {
+		spin(5 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hc.PerPMU) != 2 || hc.PerPMU[0].PMU != "cpu_atom" || hc.PerPMU[1].PMU != "cpu_core" {
+		t.Fatalf("got per-PMU counts %+v, want cpu_atom and cpu_core", hc.PerPMU)
+	}
+	sum := hc.PerPMU[0].Count.Add(hc.PerPMU[1].Count)
+	if hc.Value == 0 || hc.Value != sum.Value || hc.Enabled != sum.Enabled {
+		t.Errorf("got merged count %+v, want the sum of per-PMU counts, %+v", hc.Count, sum)
+	}
+
+	bad := []*perf.PMU{{Name: "cpu_core", Type: perf.SoftwareEvent}}
+	if _, err := perf.OpenHybrid(a, perf.AllThreads, perf.AnyCPU, bad); err == nil {
+		t.Fatal("opened system-wide event on PMU without CPUs")
+	}
+}
+
+func testHybridLabel(t *testing.T) {
+	requires(t, paranoid(1))
+
+	// An extended type which matches no PMU: the event fails to open,
+	// and the error is labeled with the generic event name.
+	a := &perf.Attr{
+		Type:   perf.HardwareEvent,
+		Config: uint64(bogusPMU)<<32 | uint64(perf.Instructions),
+	}
+	ev, err := perf.Open(a, perf.CallingThread, perf.AnyCPU, nil)
+	if err == nil {
+		ev.Close()
+		t.Skip("opened event with bogus extended type")
+	}
+	oe, ok := err.(*perf.OpenError)
+	if !ok {
+		t.Fatalf("got %T, want *perf.OpenError", err)
+	}
+	if oe.Label != "instructions" {
+		t.Fatalf("got label %q, want instructions", oe.Label)
+	}
+}
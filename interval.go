@@ -0,0 +1,137 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Interval is a snapshot of the counts accumulated during an interval,
+// as taken by ReadIntervals, similarly to the output of perf stat -I.
+type Interval struct {
+	// Start and End delimit the interval, in wall clock time.
+	Start time.Time
+	End   time.Time
+
+	// Delta holds the counts accumulated during the interval. Its
+	// Enabled and Running times are also those of the interval.
+	Delta GroupCount
+
+	// Total holds the counts accumulated since the first snapshot was
+	// taken, at the start of the first interval.
+	Total GroupCount
+
+	// Scaled holds the values in Delta, scaled to account for
+	// multiplexing during the interval. See GroupCount.Scaled.
+	Scaled []ScaledValue
+
+	// Rates holds the scaled values per second of the interval, in the
+	// order of Scaled.
+	Rates []float64
+
+	// PerTarget holds the counts accumulated by each target during the
+	// interval, for intervals read from an EventSet.
+	PerTarget []TargetCount
+}
+
+// ReadIntervals reads the counts of ev every d, and calls fn with the
+// difference since the previous reading, until ctx is done or fn returns
+// an error. ev is read as it counts: ReadIntervals does not enable,
+// disable, or reset it. The first interval starts when ReadIntervals is
+// called.
+//
+// If ev is a group leader, configured with CountFormat.Group, the whole
+// group is read. Otherwise, Delta and Total hold the single value of ev.
+// Scaling requires CountFormat.Enabled and CountFormat.Running to be set.
+//
+// ReadIntervals returns the error returned by fn, an error encountered
+// while reading ev, or ctx.Err().
+func (ev *Event) ReadIntervals(ctx context.Context, d time.Duration, fn func(Interval) error) error {
+	read := func() (GroupCount, []TargetCount, error) {
+		if ev.a.CountFormat.Group {
+			gc, err := ev.ReadGroupCount()
+			return gc, nil, err
+		}
+		c, err := ev.ReadCount()
+		if err != nil {
+			return GroupCount{}, nil, err
+		}
+		gc := GroupCount{
+			Enabled:      c.Enabled,
+			Running:      c.Running,
+			Restrictions: c.Restrictions,
+		}
+		gc.Values = append(gc.Values, struct {
+			Value uint64
+			ID    uint64
+			Label string
+		}{Value: c.Value, ID: c.ID, Label: c.Label})
+		return gc, nil, nil
+	}
+	return readIntervals(ctx, d, read, fn)
+}
+
+// ReadIntervals reads the counts of all groups in the set every d, and
+// calls fn with the difference since the previous reading, until ctx is
+// done or fn returns an error. Delta and Total hold the counts of all
+// targets added together, as in EventSetCount.Total, and PerTarget holds
+// the counts of each target. See Event.ReadIntervals for details.
+func (es *EventSet) ReadIntervals(ctx context.Context, d time.Duration, fn func(Interval) error) error {
+	read := func() (GroupCount, []TargetCount, error) {
+		esc, err := es.ReadCount()
+		return esc.Total, esc.PerTarget, err
+	}
+	return readIntervals(ctx, d, read, fn)
+}
+
+// readIntervals drives interval reads for ReadIntervals.
+func readIntervals(ctx context.Context, d time.Duration, read func() (GroupCount, []TargetCount, error), fn func(Interval) error) error {
+	if d <= 0 {
+		return errors.New("perf: interval must be positive")
+	}
+	first, prevTargets, err := read()
+	if err != nil {
+		return err
+	}
+	prev, start := first, time.Now()
+
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		cur, targets, err := read()
+		if err != nil {
+			return err
+		}
+		end := time.Now()
+		iv := Interval{
+			Start: start,
+			End:   end,
+			Delta: cur.Sub(prev),
+			Total: cur.Sub(first),
+		}
+		iv.Scaled = iv.Delta.Scaled()
+		secs := end.Sub(start).Seconds()
+		for _, sv := range iv.Scaled {
+			iv.Rates = append(iv.Rates, sv.Value/secs)
+		}
+		for i, tc := range targets {
+			if i < len(prevTargets) {
+				tc.GroupCount = tc.GroupCount.Sub(prevTargets[i].GroupCount)
+			}
+			iv.PerTarget = append(iv.PerTarget, tc)
+		}
+		if err := fn(iv); err != nil {
+			return err
+		}
+		prev, prevTargets, start = cur, targets, end
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"acln.ro/perf"
+)
+
+func TestIntervals(t *testing.T) {
+	t.Run("CountArithmetic", testCountArithmetic)
+	t.Run("GroupCountArithmetic", testGroupCountArithmetic)
+	t.Run("Event", testEventIntervals)
+	t.Run("EventSet", testEventSetIntervals)
+	t.Run("Cancel", testIntervalsCancel)
+}
+
+func testCountArithmetic(t *testing.T) {
+	prev := perf.Count{Value: 100, Enabled: time.Second, Running: time.Second / 2, Label: "cycles"}
+	cur := perf.Count{Value: 250, Enabled: 3 * time.Second, Running: time.Second, Label: "cycles"}
+
+	d := cur.Sub(prev)
+	if d.Value != 150 || d.Enabled != 2*time.Second || d.Running != time.Second/2 || d.Label != "cycles" {
+		t.Errorf("got delta %+v", d)
+	}
+	if sum := prev.Add(d); sum.Value != cur.Value || sum.Enabled != cur.Enabled || sum.Running != cur.Running {
+		t.Errorf("got sum %+v, want %+v", sum, cur)
+	}
+
+	reset := perf.Count{Value: 10, Enabled: time.Millisecond, Running: time.Millisecond}
+	if d := reset.Sub(cur); d.Value != 10 || d.Enabled != time.Millisecond {
+		t.Errorf("got delta %+v across reset, want the new count", d)
+	}
+}
+
+func testGroupCountArithmetic(t *testing.T) {
+	prev := metricGroupCount(time.Second, map[string]uint64{"a": 10})
+	cur := prev.Add(prev)
+	if cur.Values[0].Value != 20 || cur.Enabled != 2*time.Second || cur.Values[0].Label != "a" {
+		t.Fatalf("got sum %+v", cur)
+	}
+	if prev.Values[0].Value != 10 {
+		t.Fatalf("Add modified its receiver: %+v", prev)
+	}
+
+	d := cur.Sub(prev)
+	if d.Values[0].Value != 10 || d.Enabled != time.Second || d.Running != time.Second {
+		t.Errorf("got delta %+v", d)
+	}
+	if cur.Values[0].Value != 20 {
+		t.Errorf("Sub modified its receiver: %+v", cur)
+	}
+
+	var empty perf.GroupCount
+	sum := empty.Add(prev)
+	if len(sum.Values) != 1 || sum.Values[0].Value != 10 || sum.Values[0].Label != "a" {
+		t.Errorf("got sum %+v, want the shape and values of %+v", sum, prev)
+	}
+}
+
+func testEventIntervals(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	a := &perf.Attr{
+		CountFormat: perf.CountFormat{
+			Enabled: true,
+			Running: true,
+		},
+	}
+	perf.TaskClock.Configure(a)
+	ev, err := perf.Open(a, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+
+	// The thread spins in fn, so each interval but the first counts the
+	// spinning done at the end of the previous one.
+	var intervals []perf.Interval
+	errEnough := errors.New("enough intervals")
+	err = ev.ReadIntervals(context.Background(), 10*time.Millisecond, func(iv perf.Interval) error {
+		intervals = append(intervals, iv)
+		if len(intervals) == 3 {
+			return errEnough
+		}
+		spin(2 * time.Millisecond)
+		return nil
+	})
+	if err != errEnough {
+		t.Fatalf("got error %v, want %v", err, errEnough)
+	}
+
+	var total uint64
+	for i, iv := range intervals {
+		if len(iv.Delta.Values) != 1 || len(iv.Scaled) != 1 || len(iv.Rates) != 1 {
+			t.Fatalf("interval %d: got %d values, %d scaled values, %d rates, want 1",
+				i, len(iv.Delta.Values), len(iv.Scaled), len(iv.Rates))
+		}
+		if !iv.End.After(iv.Start) {
+			t.Errorf("interval %d: ends at %v, before its start at %v", i, iv.End, iv.Start)
+		}
+		if i > 0 && !iv.Start.Equal(intervals[i-1].End) {
+			t.Errorf("interval %d: starts at %v, not at the end of the previous interval", i, iv.Start)
+		}
+		if i > 0 && iv.Delta.Values[0].Value == 0 {
+			t.Errorf("interval %d: task-clock did not count", i)
+		}
+		if iv.Rates[0] <= 0 {
+			t.Errorf("interval %d: got rate %v, want > 0", i, iv.Rates[0])
+		}
+		total += iv.Delta.Values[0].Value
+		if got := iv.Total.Values[0].Value; got != total {
+			t.Errorf("interval %d: got total %d, want the sum of deltas, %d", i, got, total)
+		}
+	}
+}
+
+func testEventSetIntervals(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	es, err := perf.OpenEventSetCPUs(eventSetGroup(), perf.CallingThread, perf.EventSetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	if err := es.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	var intervals []perf.Interval
+	errEnough := errors.New("enough intervals")
+	err = es.ReadIntervals(context.Background(), 10*time.Millisecond, func(iv perf.Interval) error {
+		intervals = append(intervals, iv)
+		if len(intervals) == 2 {
+			return errEnough
+		}
+		spin(2 * time.Millisecond)
+		return nil
+	})
+	if err != errEnough {
+		t.Fatalf("got error %v, want %v", err, errEnough)
+	}
+
+	iv := intervals[1]
+	if len(iv.PerTarget) != len(es.Targets) {
+		t.Fatalf("got %d per-target counts, want %d", len(iv.PerTarget), len(es.Targets))
+	}
+	if len(iv.Delta.Values) != 2 {
+		t.Fatalf("got %d values, want 2", len(iv.Delta.Values))
+	}
+	var sum uint64
+	for _, tc := range iv.PerTarget {
+		sum += tc.Values[0].Value
+	}
+	if sum != iv.Delta.Values[0].Value {
+		t.Errorf("got per-target task-clock sum %d, want the delta, %d", sum, iv.Delta.Values[0].Value)
+	}
+	if sum == 0 {
+		t.Error("task-clock did not count")
+	}
+}
+
+func testIntervalsCancel(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	a := new(perf.Attr)
+	perf.TaskClock.Configure(a)
+	ev, err := perf.Open(a, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Millisecond)
+	defer cancel()
+	n := 0
+	err = ev.ReadIntervals(ctx, 5*time.Millisecond, func(perf.Interval) error {
+		n++
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n == 0 {
+		t.Fatal("no intervals before cancellation")
+	}
+
+	if err := ev.ReadIntervals(context.Background(), 0, nil); err == nil {
+		t.Fatal("accepted zero interval")
+	}
+}
@@ -0,0 +1,695 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Metric is a value derived from event counts, such as the number of
+// instructions per cycle.
+//
+// Metrics are defined by expressions over event names, in the syntax used
+// by the MetricExpr field of the perf tool's JSON event tables:
+//
+//     instructions / cycles
+//     100 * branch-misses / branch-instructions
+//     INST_RETIRED.ANY / CPU_CLK_UNHALTED.THREAD
+//
+// Expressions support numbers, the arithmetic operators + - * /, parentheses,
+// comparisons with < and >, conditionals of the form "a if cond else b", and
+// the functions min(a, b), max(a, b) and d_ratio(a, b), which is a / b, or 0
+// if b is 0. The special name duration_time stands for the time the events
+// were enabled, in seconds.
+//
+// Event names may contain letters, digits and the characters _ . and :, as
+// well as dashes followed by a letter. Subtraction must therefore be spelled
+// with spaces around the operator, or with a digit after it. Any character
+// can be included in a name by escaping it with a backslash.
+type Metric struct {
+	// Name is the name of the metric, e.g. "IPC".
+	Name string
+
+	// Expr is the expression the metric is computed from.
+	Expr string
+
+	// Unit is the unit of the value, e.g. "%" or "insn per cycle".
+	Unit string
+
+	// Description is a short description of the metric.
+	Description string
+
+	// Groups lists the metric groups the metric belongs to, e.g.
+	// "Pipeline" or "TopdownL1".
+	Groups []string
+
+	root   metricNode
+	events []string
+}
+
+// ParseMetric parses expr and returns the named metric.
+func ParseMetric(name, expr string) (*Metric, error) {
+	p := new(metricParser)
+	if err := p.lex(expr); err != nil {
+		return nil, fmt.Errorf("perf: metric %s: %v", name, err)
+	}
+	root, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("perf: metric %s: %v", name, err)
+	}
+	m := &Metric{Name: name, Expr: expr, root: root}
+	m.events = root.events(nil)
+	return m, nil
+}
+
+// Events returns the names of the events the metric is computed from, in
+// order of first appearance in the expression.
+func (m *Metric) Events() []string {
+	return m.events
+}
+
+// Eval evaluates the metric over the counts in gc. Events are looked up by
+// their labels, and their values are scaled to account for multiplexing, as
+// by GroupCount.Scaled.
+func (m *Metric) Eval(gc GroupCount) (float64, error) {
+	if m.root == nil {
+		return 0, fmt.Errorf("perf: metric %s: not parsed", m.Name)
+	}
+	env := metricEnv{
+		values:   make(map[string]ScaledValue),
+		duration: gc.Enabled.Seconds(),
+	}
+	for _, sv := range gc.Scaled() {
+		env.values[sv.Label] = sv
+	}
+	v, err := m.root.eval(&env)
+	if err != nil {
+		return 0, fmt.Errorf("perf: metric %s: %v", m.Name, err)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("perf: metric %s: division by zero", m.Name)
+	}
+	return v, nil
+}
+
+func (m *Metric) String() string {
+	return m.Name + " = " + m.Expr
+}
+
+// BuiltinMetrics returns a set of common metrics, computed from generalized
+// hardware and software events:
+//
+//     IPC                     instructions per cycle
+//     CPI                     cycles per instruction
+//     cache-miss-ratio        percentage of cache references which miss
+//     branch-miss-ratio       percentage of branches which are mispredicted
+//     frontend-stall-ratio    percentage of cycles stalled in the frontend
+//     backend-stall-ratio     percentage of cycles stalled in the backend
+//     page-faults-per-second  page faults per second of enabled time
+func BuiltinMetrics() []*Metric {
+	metrics := make([]*Metric, 0, len(builtinMetrics))
+	for _, bm := range builtinMetrics {
+		m, err := ParseMetric(bm.name, bm.expr)
+		if err != nil {
+			panic(err)
+		}
+		m.Unit = bm.unit
+		m.Description = bm.desc
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+var builtinMetrics = []struct {
+	name, expr, unit, desc string
+}{
+	{"IPC", "instructions / cycles", "insn per cycle", "Instructions per cycle"},
+	{"CPI", "cycles / instructions", "cycles per insn", "Cycles per instruction"},
+	{"cache-miss-ratio", "100 * cache-misses / cache-references", "%", "Cache references which miss"},
+	{"branch-miss-ratio", "100 * branch-misses / branch-instructions", "%", "Branches which are mispredicted"},
+	{"frontend-stall-ratio", "100 * stalled-cycles-frontend / cycles", "%", "Cycles stalled in the frontend"},
+	{"backend-stall-ratio", "100 * stalled-cycles-backend / cycles", "%", "Cycles stalled in the backend"},
+	{"page-faults-per-second", "page-faults / duration_time", "/sec", "Page faults per second"},
+}
+
+// ParseMetricsJSON parses metric definitions in JSON format, as found in
+// the event tables of the perf tool. Entries which define events rather
+// than metrics are ignored. See ParseEventTableJSON for the supported
+// layouts.
+//
+// The MetricName, MetricExpr, MetricGroup, BriefDescription and ScaleUnit
+// fields are used. A ScaleUnit such as "100%" multiplies the value of the
+// metric by 100, and sets its unit to "%".
+func ParseMetricsJSON(r io.Reader) ([]*Metric, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseEventTableEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	var metrics []*Metric
+	for _, e := range entries {
+		if e.MetricName == "" || e.MetricExpr == "" {
+			continue
+		}
+		m, err := e.metric()
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// metric returns the metric defined by e.
+func (e *jsonVendorEvent) metric() (*Metric, error) {
+	m, err := ParseMetric(e.MetricName, e.MetricExpr)
+	if err != nil {
+		return nil, err
+	}
+	m.Description = e.BriefDescription
+	for _, g := range strings.Split(e.MetricGroup, ";") {
+		if g = strings.TrimSpace(g); g != "" {
+			m.Groups = append(m.Groups, g)
+		}
+	}
+	if e.ScaleUnit != "" {
+		i := strings.IndexFunc(e.ScaleUnit, func(r rune) bool {
+			return !strings.ContainsRune("0123456789.", r)
+		})
+		if i < 0 {
+			i = len(e.ScaleUnit)
+		}
+		scale, err := strconv.ParseFloat(e.ScaleUnit[:i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("perf: metric %s: bad ScaleUnit %q", e.MetricName, e.ScaleUnit)
+		}
+		m.Unit = e.ScaleUnit[i:]
+		if scale != 1 {
+			m.root = &metricBinary{op: '*', x: metricNumber(scale), y: m.root}
+		}
+	}
+	return m, nil
+}
+
+// MetricSet is a set of metrics which are measured together.
+type MetricSet struct {
+	// EventTable, if not nil, is used to resolve vendor event names
+	// such as INST_RETIRED.ANY. Other names are resolved by ParseEvent.
+	EventTable *EventTable
+
+	metrics []*Metric
+	events  []string
+}
+
+// Add adds metrics to the set.
+func (ms *MetricSet) Add(metrics ...*Metric) {
+	for _, m := range metrics {
+		ms.metrics = append(ms.metrics, m)
+		for _, name := range m.Events() {
+			if !containsString(ms.events, name) {
+				ms.events = append(ms.events, name)
+			}
+		}
+	}
+}
+
+// Metrics returns the metrics in the set.
+func (ms *MetricSet) Metrics() []*Metric {
+	return ms.metrics
+}
+
+// Events returns the names of the events needed to compute the metrics in
+// the set. Each event is listed once, even if it is used by several
+// metrics.
+func (ms *MetricSet) Events() []string {
+	return ms.events
+}
+
+// AddTo adds the events needed by the metrics in the set to g. The events
+// are labeled with their names, as used in metric expressions. AddTo also
+// sets the Enabled and Running count format options of g, which Evaluate
+// needs to scale values and to compute duration_time. Events which cannot
+// be resolved cause an error, and g is left unchanged.
+func (ms *MetricSet) AddTo(g *Group) error {
+	cfgs := make([]Configurator, 0, len(ms.events))
+	for _, name := range ms.events {
+		cfg, err := ms.resolve(name)
+		if err != nil {
+			return err
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	g.CountFormat.Enabled = true
+	g.CountFormat.Running = true
+	g.Add(cfgs...)
+	return nil
+}
+
+// resolve returns a Configurator for the named event, which labels the
+// event with its name.
+func (ms *MetricSet) resolve(name string) (Configurator, error) {
+	var cfg Configurator
+	if ms.EventTable != nil {
+		if ve, err := ms.EventTable.Event(name); err == nil {
+			cfg = ve
+		}
+	}
+	if cfg == nil {
+		es, err := ParseEvent(name)
+		if err != nil {
+			return nil, err
+		}
+		cfg = es
+	}
+	return configuratorFunc(func(attr *Attr) error {
+		if err := cfg.Configure(attr); err != nil {
+			return err
+		}
+		attr.Label = name
+		return nil
+	}), nil
+}
+
+// MetricValue is the value of a metric.
+type MetricValue struct {
+	Name  string
+	Unit  string
+	Value float64
+
+	// Err explains why the value could not be computed, e.g. because
+	// an event was not counted. If Err is not nil, Value is zero.
+	Err error
+}
+
+// Evaluate evaluates the metrics in the set over the counts in gc, which
+// is usually read from a group the events were added to by AddTo.
+func (ms *MetricSet) Evaluate(gc GroupCount) []MetricValue {
+	values := make([]MetricValue, 0, len(ms.metrics))
+	for _, m := range ms.metrics {
+		v, err := m.Eval(gc)
+		values = append(values, MetricValue{
+			Name:  m.Name,
+			Unit:  m.Unit,
+			Value: v,
+			Err:   err,
+		})
+	}
+	return values
+}
+
+// metricEnv is the environment metric expressions are evaluated in.
+type metricEnv struct {
+	values   map[string]ScaledValue
+	duration float64
+}
+
+// metricDurationTime names the time the events were enabled for.
+const metricDurationTime = "duration_time"
+
+// metricNode is a node in the syntax tree of a metric expression.
+type metricNode interface {
+	eval(env *metricEnv) (float64, error)
+
+	// events appends the names of the events used by the node to names,
+	// skipping names which are already present.
+	events(names []string) []string
+}
+
+type metricNumber float64
+
+func (n metricNumber) eval(*metricEnv) (float64, error) { return float64(n), nil }
+
+func (n metricNumber) events(names []string) []string { return names }
+
+type metricEvent string
+
+func (e metricEvent) eval(env *metricEnv) (float64, error) {
+	if e == metricDurationTime {
+		return env.duration, nil
+	}
+	sv, ok := env.values[string(e)]
+	if !ok {
+		return 0, fmt.Errorf("event %s not measured", string(e))
+	}
+	switch sv.State {
+	case NotCounted, NotSupported:
+		return 0, fmt.Errorf("event %s %v", string(e), sv.State)
+	}
+	return sv.Value, nil
+}
+
+func (e metricEvent) events(names []string) []string {
+	if e == metricDurationTime || containsString(names, string(e)) {
+		return names
+	}
+	return append(names, string(e))
+}
+
+type metricNeg struct{ x metricNode }
+
+func (n *metricNeg) eval(env *metricEnv) (float64, error) {
+	x, err := n.x.eval(env)
+	return -x, err
+}
+
+func (n *metricNeg) events(names []string) []string { return n.x.events(names) }
+
+type metricBinary struct {
+	op   byte // one of + - * / < >
+	x, y metricNode
+}
+
+func (n *metricBinary) eval(env *metricEnv) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	y, err := n.y.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	case '/':
+		return x / y, nil
+	case '<':
+		return metricBool(x < y), nil
+	default: // '>'
+		return metricBool(x > y), nil
+	}
+}
+
+func (n *metricBinary) events(names []string) []string {
+	return n.y.events(n.x.events(names))
+}
+
+func metricBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type metricCond struct {
+	cond, x, y metricNode // x if cond else y
+}
+
+func (n *metricCond) eval(env *metricEnv) (float64, error) {
+	c, err := n.cond.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if c != 0 {
+		return n.x.eval(env)
+	}
+	return n.y.eval(env)
+}
+
+func (n *metricCond) events(names []string) []string {
+	return n.y.events(n.x.events(n.cond.events(names)))
+}
+
+type metricCall struct {
+	fn   string // min, max or d_ratio
+	x, y metricNode
+}
+
+func (n *metricCall) eval(env *metricEnv) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	y, err := n.y.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.fn {
+	case "min":
+		return math.Min(x, y), nil
+	case "max":
+		return math.Max(x, y), nil
+	default: // d_ratio
+		if y == 0 {
+			return 0, nil
+		}
+		return x / y, nil
+	}
+}
+
+func (n *metricCall) events(names []string) []string {
+	return n.y.events(n.x.events(names))
+}
+
+// metricToken is a token in a metric expression.
+type metricToken struct {
+	kind byte // 'n' (number), 'i' (identifier), or an operator character
+	text string
+	num  float64
+}
+
+// metricParser parses metric expressions.
+type metricParser struct {
+	toks []metricToken
+	pos  int
+}
+
+func (p *metricParser) lex(s string) error {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexByte("+-*/()<>,", c) >= 0:
+			p.toks = append(p.toks, metricToken{kind: c, text: s[i : i+1]})
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(s) && isNumberChar(s, j) {
+				j++
+			}
+			num, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return fmt.Errorf("bad number %q", s[i:j])
+			}
+			p.toks = append(p.toks, metricToken{kind: 'n', text: s[i:j], num: num})
+			i = j
+		case isIdentStart(c) || c == '\\':
+			var name strings.Builder
+			j := i
+		name:
+			for j < len(s) {
+				switch c := s[j]; {
+				case c == '\\' && j+1 < len(s):
+					name.WriteByte(s[j+1])
+					j += 2
+					continue
+				case isIdentChar(c) || c == '.' || c == ':':
+				case c == '-' && j+1 < len(s) && isIdentStart(s[j+1]):
+				default:
+					break name
+				}
+				name.WriteByte(s[j])
+				j++
+			}
+			p.toks = append(p.toks, metricToken{kind: 'i', text: name.String()})
+			i = j
+		default:
+			return fmt.Errorf("unexpected %q at offset %d", c, i)
+		}
+	}
+	return nil
+}
+
+// isNumberChar reports whether s[j] continues the number preceding it.
+func isNumberChar(s string, j int) bool {
+	switch c := s[j]; {
+	case '0' <= c && c <= '9', c == '.', c == 'e', c == 'E':
+		return true
+	case c == '-', c == '+':
+		return s[j-1] == 'e' || s[j-1] == 'E'
+	default:
+		return false
+	}
+}
+
+func (p *metricParser) peek() metricToken {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return metricToken{}
+}
+
+func (p *metricParser) next() metricToken {
+	t := p.peek()
+	if p.pos < len(p.toks) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *metricParser) expect(kind byte) error {
+	if t := p.next(); t.kind != kind {
+		return p.unexpected(t)
+	}
+	return nil
+}
+
+func (p *metricParser) unexpected(t metricToken) error {
+	if t.kind == 0 {
+		return errors.New("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *metricParser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == 'i' && t.text == word
+}
+
+// parse parses a complete expression:
+//
+//     expr  = cmp [ "if" cmp "else" expr ]
+//     cmp   = sum { ("<" | ">") sum }
+//     sum   = term { ("+" | "-") term }
+//     term  = unary { ("*" | "/") unary }
+//     unary = "-" unary | primary
+//     primary = number | name | name "(" expr "," expr ")" | "(" expr ")"
+func (p *metricParser) parse() (metricNode, error) {
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != 0 {
+		return nil, p.unexpected(t)
+	}
+	return n, nil
+}
+
+func (p *metricParser) expr() (metricNode, error) {
+	x, err := p.cmp()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("if") {
+		return x, nil
+	}
+	p.next()
+	cond, err := p.cmp()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("else") {
+		return nil, errors.New(`"if" without "else"`)
+	}
+	p.next()
+	y, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &metricCond{cond: cond, x: x, y: y}, nil
+}
+
+func (p *metricParser) cmp() (metricNode, error) {
+	return p.binary("<>", p.sum)
+}
+
+func (p *metricParser) sum() (metricNode, error) {
+	return p.binary("+-", p.term)
+}
+
+func (p *metricParser) term() (metricNode, error) {
+	return p.binary("*/", p.unary)
+}
+
+// binary parses a left-associative sequence of operands, separated by the
+// operators in ops.
+func (p *metricParser) binary(ops string, operand func() (metricNode, error)) (metricNode, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind == 0 || strings.IndexByte(ops, t.kind) < 0 {
+			return x, nil
+		}
+		p.next()
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		x = &metricBinary{op: t.kind, x: x, y: y}
+	}
+}
+
+func (p *metricParser) unary() (metricNode, error) {
+	if p.peek().kind == '-' {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &metricNeg{x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *metricParser) primary() (metricNode, error) {
+	t := p.next()
+	switch t.kind {
+	case 'n':
+		return metricNumber(t.num), nil
+	case '(':
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return x, nil
+	case 'i':
+		if p.peek().kind != '(' {
+			return metricEvent(t.text), nil
+		}
+		switch t.text {
+		case "min", "max", "d_ratio":
+		default:
+			return nil, fmt.Errorf("unknown function %q", t.text)
+		}
+		p.next()
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+		y, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return &metricCall{fn: t.text, x: x, y: y}, nil
+	default:
+		return nil, p.unexpected(t)
+	}
+}
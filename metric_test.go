@@ -0,0 +1,328 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"acln.ro/perf"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("Parse", testParseMetric)
+	t.Run("Eval", testEvalMetric)
+	t.Run("Builtin", testBuiltinMetrics)
+	t.Run("JSON", testParseMetricsJSON)
+	t.Run("EventTable", testEventTableMetrics)
+	t.Run("Software", testMetricSetSoftware)
+	t.Run("AddToCountFormat", testMetricSetAddToCountFormat)
+}
+
+func testParseMetric(t *testing.T) {
+	valid := []struct {
+		expr   string
+		events []string
+	}{
+		{"instructions / cycles", []string{"instructions", "cycles"}},
+		{"100 * branch-misses / branch-instructions", []string{"branch-misses", "branch-instructions"}},
+		{"INST_RETIRED.ANY / CPU_CLK_UNHALTED.THREAD", []string{"INST_RETIRED.ANY", "CPU_CLK_UNHALTED.THREAD"}},
+		{"(cycles - stalled-cycles-frontend) / cycles", []string{"cycles", "stalled-cycles-frontend"}},
+		{"d_ratio(page-faults, duration_time)", []string{"page-faults"}},
+		{"min(a, b) if a > 1e3 else -max(a,b)", []string{"a", "b"}},
+		{`cpu\-cycles:u-1`, []string{"cpu-cycles:u"}},
+	}
+	for _, tt := range valid {
+		m, err := perf.ParseMetric("m", tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := m.Events(); !reflect.DeepEqual(got, tt.events) {
+			t.Errorf("%q: got events %q, want %q", tt.expr, got, tt.events)
+		}
+	}
+
+	invalid := []string{"", "a +", "(a", "a if b", "foo(a, b)", "a $ b", "min(a)"}
+	for _, expr := range invalid {
+		if _, err := perf.ParseMetric("m", expr); err == nil {
+			t.Errorf("%q: parsed successfully", expr)
+		}
+	}
+}
+
+// metricGroupCount returns a GroupCount holding the specified values, enabled
+// for a second and running for running.
+func metricGroupCount(running time.Duration, values map[string]uint64) perf.GroupCount {
+	gc := perf.GroupCount{Enabled: time.Second, Running: running}
+	for label, value := range values {
+		gc.Values = append(gc.Values, struct {
+			Value uint64
+			ID    uint64
+			Label string
+		}{Value: value, Label: label})
+	}
+	return gc
+}
+
+func testEvalMetric(t *testing.T) {
+	values := map[string]uint64{"instructions": 300, "cycles": 100, "zero": 0}
+	tests := []struct {
+		expr    string
+		running time.Duration
+		want    float64
+	}{
+		{"instructions / cycles", time.Second, 3},
+		{"instructions - cycles", time.Second / 2, 400}, // scaled by 2
+		{"d_ratio(instructions, zero)", time.Second, 0},
+		{"1 if instructions > cycles else 2", time.Second, 1},
+		{"cycles / duration_time", time.Second, 100},
+	}
+	for _, tt := range tests {
+		m, err := perf.ParseMetric("m", tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.Eval(metricGroupCount(tt.running, values))
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	failing := []struct {
+		expr    string
+		running time.Duration
+		err     string
+	}{
+		{"instructions / zero", time.Second, "division by zero"},
+		{"instructions / missing", time.Second, "not measured"},
+		{"instructions / cycles", 0, "not counted"},
+	}
+	for _, tt := range failing {
+		m, err := perf.ParseMetric("m", tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.Eval(metricGroupCount(tt.running, values))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func testBuiltinMetrics(t *testing.T) {
+	var ms perf.MetricSet
+	ms.Add(perf.BuiltinMetrics()...)
+	want := []string{
+		"IPC", "CPI", "cache-miss-ratio", "branch-miss-ratio",
+		"frontend-stall-ratio", "backend-stall-ratio", "page-faults-per-second",
+	}
+	var names []string
+	for _, m := range ms.Metrics() {
+		names = append(names, m.Name)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got metrics %q, want %q", names, want)
+	}
+
+	// instructions and cycles are shared between metrics.
+	if got := len(ms.Events()); got != 9 {
+		t.Errorf("got %d events (%q), want 9", got, ms.Events())
+	}
+	if err := ms.AddTo(new(perf.Group)); err != nil {
+		t.Fatal(err)
+	}
+
+	gc := metricGroupCount(time.Second, map[string]uint64{
+		"instructions": 200,
+		"cycles":       100,
+	})
+	mv := ms.Evaluate(gc)
+	if mv[0].Err != nil || mv[0].Value != 2 || mv[0].Unit != "insn per cycle" {
+		t.Errorf("got IPC %+v, want 2 insn per cycle", mv[0])
+	}
+	if mv[1].Err != nil || mv[1].Value != 0.5 {
+		t.Errorf("got CPI %+v, want 0.5", mv[1])
+	}
+	if mv[2].Err == nil {
+		t.Errorf("got cache miss ratio %+v without cache events", mv[2])
+	}
+}
+
+func testParseMetricsJSON(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "pmu-events", "skylakex", "pipeline.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	metrics, err := perf.ParseMetricsJSON(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "IPC" {
+		t.Fatalf("got %v, want the IPC metric", metrics)
+	}
+	want := []string{"INST_RETIRED.ANY", "CPU_CLK_UNHALTED.THREAD"}
+	if got := metrics[0].Events(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+
+	const scaled = `[{
+		"MetricName": "L1D_miss_rate",
+		"MetricExpr": "L1D.REPLACEMENT / INST_RETIRED.ANY",
+		"MetricGroup": "Cache;Mem",
+		"ScaleUnit": "100%"
+	}]`
+	metrics, err = perf.ParseMetricsJSON(strings.NewReader(scaled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := metrics[0]
+	if m.Unit != "%" || !reflect.DeepEqual(m.Groups, []string{"Cache", "Mem"}) {
+		t.Errorf("got unit %q, groups %q, want %q, [Cache Mem]", m.Unit, m.Groups, "%")
+	}
+	v, err := m.Eval(metricGroupCount(time.Second, map[string]uint64{
+		"L1D.REPLACEMENT":  1,
+		"INST_RETIRED.ANY": 4,
+	}))
+	if err != nil || v != 25 {
+		t.Errorf("got %v, %v, want 25", v, err)
+	}
+
+	const bad = `[{"MetricName": "bad", "MetricExpr": "a +"}]`
+	if _, err := perf.ParseMetricsJSON(strings.NewReader(bad)); err == nil {
+		t.Error("parsed metric with bad expression")
+	}
+}
+
+func testEventTableMetrics(t *testing.T) {
+	table, err := perf.LoadEventTable(fixtureEventTables, "GenuineIntel-6-55-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := table.Metrics()
+	if len(metrics) != 1 || metrics[0].Name != "IPC" {
+		t.Fatalf("got %v, want the IPC metric", metrics)
+	}
+
+	ms := perf.MetricSet{EventTable: table}
+	m, err := perf.ParseMetric("assists", "OTHER_ASSISTS.ANY / instructions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.Add(m)
+	if err := ms.AddTo(new(perf.Group)); err != nil {
+		t.Fatal(err)
+	}
+	ms.Add(metrics...)
+	if err := ms.AddTo(new(perf.Group)); err == nil {
+		t.Fatal("resolved events missing from the table")
+	}
+}
+
+func testMetricSetSoftware(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	m, err := perf.ParseMetric("faults-per-ms", "minor-faults / (duration_time * 1000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ms perf.MetricSet
+	ms.Add(m)
+	g := &perf.Group{
+		CountFormat: perf.CountFormat{Enabled: true, Running: true},
+		Options:     perf.Options{Disabled: true, ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+	if err := ms.AddTo(g); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := g.Open(perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+
+	// Fresh anonymous pages fault on first touch, unlike heap memory,
+	// which may have been faulted in by earlier tests.
+	buf, err := unix.Mmap(-1, 0, 1<<20, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Munmap(buf)
+	gc, err := ev.MeasureGroup(func() {
+		for i := 0; i < len(buf); i += os.Getpagesize() {
+			buf[i] = 1
+		}
+		spin(time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mv := ms.Evaluate(gc)
+	if mv[0].Err != nil {
+		t.Fatal(mv[0].Err)
+	}
+	if mv[0].Value <= 0 {
+		t.Fatalf("got %v faults per millisecond, want > 0", mv[0].Value)
+	}
+}
+
+func testMetricSetAddToCountFormat(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	m, err := perf.ParseMetric("utilization", "task-clock / (duration_time * 1e9)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ms perf.MetricSet
+	ms.Add(m)
+
+	// The group does not ask for times: AddTo must.
+	g := &perf.Group{
+		Options: perf.Options{Disabled: true, ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+	if err := ms.AddTo(g); err != nil {
+		t.Fatal(err)
+	}
+	if !g.CountFormat.Enabled || !g.CountFormat.Running {
+		t.Fatalf("got count format %+v, want Enabled and Running", g.CountFormat)
+	}
+	ev, err := g.Open(perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+
+	gc, err := ev.MeasureGroup(func() {
+		spin(5 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mv := ms.Evaluate(gc)
+	if mv[0].Err != nil {
+		t.Fatal(mv[0].Err)
+	}
+	if mv[0].Value <= 0 || mv[0].Value > 1.01 {
+		t.Fatalf("got utilization %v, want in (0, 1]", mv[0].Value)
+	}
+}
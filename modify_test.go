@@ -0,0 +1,122 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"acln.ro/perf"
+)
+
+func TestModifyAttributes(t *testing.T) {
+	t.Run("Breakpoint", testModifyBreakpoint)
+	t.Run("Unmodifiable", testModifyUnmodifiable)
+	t.Run("ModifiableFields", testModifiableFields)
+}
+
+var watched [2]uint64
+
+//go:noinline
+func writeWatched(i int) {
+	watched[i]++
+}
+
+func testModifyBreakpoint(t *testing.T) {
+	requires(t, paranoid(1))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	addr := func(i int) uint64 { return uint64(uintptr(unsafe.Pointer(&watched[i]))) }
+	attr := new(perf.Attr)
+	perf.Breakpoint(perf.BreakpointTypeW, addr(0), perf.BreakpointLength8).Configure(attr)
+	attr.Options.ExcludeKernel = true
+	attr.Options.ExcludeHypervisor = true
+	ev, err := perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Skipf("cannot open hardware breakpoint: %v", err)
+	}
+	defer ev.Close()
+
+	c, err := ev.Measure(func() {
+		writeWatched(0)
+		writeWatched(1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Value != 1 {
+		t.Fatalf("before modification: got %d hits, want 1", c.Value)
+	}
+
+	mod := *attr
+	mod.Config1 = addr(1)
+	if err := ev.ModifyAttributes(&mod); err != nil {
+		t.Fatal(err)
+	}
+	c, err = ev.Measure(func() {
+		writeWatched(0)
+		writeWatched(1)
+		writeWatched(1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Value != 2 {
+		t.Fatalf("after modification: got %d hits, want 2", c.Value)
+	}
+}
+
+func testModifyUnmodifiable(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	attr := new(perf.Attr)
+	perf.TaskClock.Configure(attr)
+	attr.Options.ExcludeKernel = true
+	attr.Options.ExcludeHypervisor = true
+	ev, err := perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+
+	mod := *attr
+	mod.Options.Disabled = true
+	err = ev.ModifyAttributes(&mod)
+	if err == nil || !strings.Contains(err.Error(), "only breakpoint events") {
+		t.Fatalf("got %v, want error about breakpoint events", err)
+	}
+
+	var x uint64
+	attr = new(perf.Attr)
+	perf.Breakpoint(perf.BreakpointTypeW, uint64(uintptr(unsafe.Pointer(&x))), perf.BreakpointLength8).Configure(attr)
+	attr.Options.ExcludeKernel = true
+	attr.Options.ExcludeHypervisor = true
+	ev, err = perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Skipf("cannot open hardware breakpoint: %v", err)
+	}
+	defer ev.Close()
+
+	mod = *attr
+	mod.Sample = 1
+	mod.SampleFormat.IP = true
+	err = ev.ModifyAttributes(&mod)
+	if err == nil || !strings.Contains(err.Error(), "cannot modify Sample, SampleFormat") {
+		t.Fatalf("got %v, want error naming Sample and SampleFormat", err)
+	}
+}
+
+func testModifiableFields(t *testing.T) {
+	if got := perf.ModifiableFields(perf.BreakpointEvent); len(got) == 0 {
+		t.Errorf("got no modifiable fields for breakpoint events")
+	}
+	if got := perf.ModifiableFields(perf.HardwareEvent); got != nil {
+		t.Errorf("got modifiable fields %v for hardware events, want none", got)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenError is returned by Open and related functions if the
+// perf_event_open system call fails.
+type OpenError struct {
+	// Label, PID, CPU, GroupFD and Flags are the arguments to the failed
+	// perf_event_open call. GroupFD is -1 if the event was not opened as
+	// part of a group.
+	Label   string
+	PID     int
+	CPU     int
+	GroupFD int
+	Flags   int
+
+	// Errno is the error number returned by perf_event_open.
+	Errno unix.Errno
+
+	// Err is the underlying error: either Errno, or a *FeatureError
+	// which names unsupported fields of the event attributes.
+	Err error
+
+	// Diagnosis is a description of the likely cause of the error,
+	// derived from the error number, the event attributes and the
+	// environment. It may be empty.
+	Diagnosis string
+}
+
+func (e *OpenError) Error() string {
+	label := e.Label
+	if label == "" {
+		label = "event"
+	}
+	msg := fmt.Sprintf("perf: perf_event_open (%s, pid %d, cpu %d, group fd %d, flags %#x): %v",
+		label, e.PID, e.CPU, e.GroupFD, e.Flags, e.Err)
+	if e.Diagnosis != "" {
+		msg += ": " + e.Diagnosis
+	}
+	return msg
+}
+
+// Unwrap returns e.Err.
+func (e *OpenError) Unwrap() error { return e.Err }
+
+func newOpenError(a *Attr, pid, cpu, groupfd, flags int, err error) *OpenError {
+	label := a.Label
+	if label == "" {
+		label = lookupLabel(eventID{
+			Type:    uint64(a.Type),
+			Config:  a.Config,
+			Config1: a.Config1,
+			Config2: a.Config2,
+		}).Name
+	}
+	oe := &OpenError{
+		Label:   label,
+		PID:     pid,
+		CPU:     cpu,
+		GroupFD: groupfd,
+		Flags:   flags,
+		Err:     err,
+	}
+	switch err := err.(type) {
+	case unix.Errno:
+		oe.Errno = err
+	case *FeatureError:
+		oe.Errno, _ = err.Err.(unix.Errno)
+		return oe // the FeatureError is diagnosis enough
+	}
+	oe.Diagnosis = diagnoseOpen(a, pid, cpu, oe.Errno)
+	return oe
+}
+
+// diagnoseOpen describes the likely cause of a perf_event_open failure.
+func diagnoseOpen(a *Attr, pid, cpu int, errno unix.Errno) string {
+	switch errno {
+	case unix.EACCES, unix.EPERM:
+		return diagnosePermissions(a, pid, cpu)
+	case unix.ENOENT:
+		return fmt.Sprintf("unknown event: type %d, config %#x is not supported by the kernel or the PMU", a.Type, a.Config)
+	case unix.EOPNOTSUPP:
+		if a.Sample != 0 {
+			return "the PMU cannot sample this event, or does not support the requested sampling options"
+		}
+		return "the PMU does not support the requested event options"
+	case unix.EMFILE:
+		var rlim unix.Rlimit
+		if unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim) == nil {
+			return fmt.Sprintf("the file descriptor limit (%d) was hit", rlim.Cur)
+		}
+		return "the file descriptor limit was hit"
+	case unix.ENOSPC:
+		return "out of hardware counters (or breakpoint slots)"
+	case unix.EBUSY:
+		return "an exclusive event is already using the PMU"
+	case unix.ESRCH:
+		return fmt.Sprintf("no such process %d", pid)
+	case unix.ENODEV:
+		return fmt.Sprintf("CPU %d does not exist, or the PMU is not available on it", cpu)
+	case unix.EINVAL:
+		if err := a.Validate(); err != nil {
+			return strings.Join(err.(*ValidationError).Problems, "; ")
+		}
+	}
+	return ""
+}
+
+// diagnosePermissions describes the privilege settings relevant to
+// a failed perf_event_open call.
+func diagnosePermissions(a *Attr, pid, cpu int) string {
+	var facts []string
+	paranoid, err := readInt("/proc/sys/kernel/perf_event_paranoid")
+	if err == nil {
+		facts = append(facts, fmt.Sprintf("perf_event_paranoid is %d", paranoid))
+	}
+	if kptr, err := readInt("/proc/sys/kernel/kptr_restrict"); err == nil {
+		facts = append(facts, fmt.Sprintf("kptr_restrict is %d", kptr))
+	}
+	perfmon, sysadmin := effectiveCaps()
+	facts = append(facts, fmt.Sprintf("CAP_PERFMON %s, CAP_SYS_ADMIN %s", present(perfmon), present(sysadmin)))
+
+	if err == nil && !perfmon && !sysadmin {
+		switch {
+		case paranoid > 2:
+			facts = append(facts, "unprivileged use of perf_event_open is disallowed")
+		case paranoid >= 2 && !(a.Options.ExcludeKernel && a.Options.ExcludeHypervisor):
+			facts = append(facts, "only user space measurement is allowed: set Options.ExcludeKernel and Options.ExcludeHypervisor")
+		case paranoid >= 1 && pid == AllThreads:
+			facts = append(facts, "CPU-wide measurement requires perf_event_paranoid <= 0")
+		case paranoid >= 0 && a.Type == TracepointEvent && a.SampleFormat.Raw:
+			facts = append(facts, "raw tracepoint samples require perf_event_paranoid == -1")
+		}
+	}
+	return strings.Join(facts, "; ")
+}
+
+func present(ok bool) string {
+	if ok {
+		return "present"
+	}
+	return "absent"
+}
+
+// readInt reads a signed decimal integer from a file.
+func readInt(path string) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// Capability numbers, from uapi/linux/capability.h.
+const (
+	capSysAdmin = 21
+	capPerfmon  = 38
+	capV3       = 0x20080522
+)
+
+// effectiveCaps reports whether CAP_PERFMON and CAP_SYS_ADMIN are in the
+// effective capability set of the calling thread.
+func effectiveCaps() (perfmon, sysadmin bool) {
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: capV3}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	_, _, e := unix.Syscall(unix.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if e != 0 {
+		return false, false
+	}
+	sysadmin = data[capSysAdmin/32].effective&(1<<(capSysAdmin%32)) != 0
+	perfmon = data[capPerfmon/32].effective&(1<<(capPerfmon%32)) != 0
+	return perfmon, sysadmin
+}
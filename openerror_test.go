@@ -0,0 +1,88 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"acln.ro/perf"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenError(t *testing.T) {
+	t.Run("UnknownEvent", testOpenErrorUnknownEvent)
+	t.Run("NoSuchProcess", testOpenErrorNoSuchProcess)
+	t.Run("Group", testOpenErrorGroup)
+}
+
+// bogusPMU is an event type which no PMU is registered for.
+const bogusPMU perf.EventType = 0x7fffffff
+
+func testOpenErrorUnknownEvent(t *testing.T) {
+	requires(t, paranoid(1))
+
+	attr := &perf.Attr{Label: "bogus", Type: bogusPMU}
+	_, err := perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+	oe, ok := err.(*perf.OpenError)
+	if !ok {
+		t.Fatalf("got %T (%v), want *perf.OpenError", err, err)
+	}
+	if oe.Errno != unix.ENOENT || !errors.Is(err, unix.ENOENT) {
+		t.Fatalf("got errno %v, want ENOENT", oe.Errno)
+	}
+	if oe.Label != "bogus" || oe.PID != perf.CallingThread || oe.CPU != perf.AnyCPU || oe.GroupFD != -1 {
+		t.Errorf("got %+v, want matching open arguments", oe)
+	}
+	if !strings.Contains(oe.Diagnosis, "unknown event") {
+		t.Errorf("got diagnosis %q, want unknown event", oe.Diagnosis)
+	}
+}
+
+func testOpenErrorNoSuchProcess(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	const pid = 1 << 30 // above PID_MAX_LIMIT
+	attr := new(perf.Attr)
+	perf.TaskClock.Configure(attr)
+	_, err := perf.Open(attr, pid, perf.AnyCPU, nil)
+	if !errors.Is(err, unix.ESRCH) {
+		t.Fatalf("got %v, want ESRCH", err)
+	}
+	oe := err.(*perf.OpenError)
+	if oe.Label != "task-clock" || oe.PID != pid {
+		t.Errorf("got label %q, pid %d, want %q, %d", oe.Label, oe.PID, "task-clock", pid)
+	}
+	if !strings.Contains(err.Error(), "no such process") {
+		t.Errorf("got %q, want diagnosis in error string", err.Error())
+	}
+}
+
+type bogusEvent struct{}
+
+func (bogusEvent) Configure(attr *perf.Attr) error {
+	attr.Label = "bogus"
+	attr.Type = bogusPMU
+	return nil
+}
+
+func testOpenErrorGroup(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	g := perf.Group{
+		Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+	g.Add(perf.TaskClock, bogusEvent{})
+	_, err := g.Open(perf.CallingThread, perf.AnyCPU)
+	oe, ok := err.(*perf.OpenError)
+	if !ok {
+		t.Fatalf("got %T (%v), want *perf.OpenError", err, err)
+	}
+	if oe.Label != "bogus" || oe.GroupFD < 0 {
+		t.Errorf("got label %q, group fd %d, want bogus follower", oe.Label, oe.GroupFD)
+	}
+}
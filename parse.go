@@ -0,0 +1,630 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseEvent parses an event specification, in the syntax used by the
+// perf tool, and returns a Configurator for the event.
+//
+// The following forms are supported:
+//
+//     * hardware and software event names and aliases, as listed by
+//       ``perf list'': "cycles", "instructions", "page-faults", "cs"
+//
+//     * hardware cache events: "L1-dcache-load-misses", "LLC-loads"
+//
+//     * raw events, as a hexadecimal config value: "r01c2"
+//
+//     * tracepoints: "sched:sched_switch"
+//
+//     * breakpoints: "mem:0x1000/8:rw"
+//
+//     * PMU events with named terms, or named PMU events, as described
+//       by PMU: "cpu/event=0x3c,umask=0x0/", "msr/tsc/"
+//
+// Each form may be followed by a colon and a string of modifiers. For PMU
+// events, the colon is optional. The supported modifiers are:
+//
+//     u: count in user space
+//     k: count in kernel space
+//     h: count in the hypervisor
+//     G: count in guests
+//     H: count on the host
+//     I: do not count while idle
+//     D: pin the event to the PMU
+//     p: request more precise IPs; may be repeated up to three times
+//
+// If any of u, k or h are specified, the privilege levels which are not
+// specified are excluded. Ditto for G and H.
+//
+// The Configurator returned by ParseEvent sets the Label field to spec,
+// unless a PMU event sets the name term, in which case that is used
+// instead.
+func ParseEvent(spec string) (Configurator, error) {
+	es, err := parseEvent(strings.TrimSpace(spec))
+	if err != nil {
+		return nil, fmt.Errorf("perf: bad event %q: %v", spec, err)
+	}
+	return es, nil
+}
+
+// ParseEventList parses a comma separated list of event specifications,
+// as accepted by ParseEvent. Events enclosed in braces form a group:
+//
+//     {cycles,instructions}:u,page-faults
+//
+// ParseEventList returns one slice of Configurators per group. Events
+// outside braces form a group of their own. A modifier string following
+// the closing brace applies to all events in the group, in addition to
+// any modifiers set on the events themselves.
+func ParseEventList(spec string) ([][]Configurator, error) {
+	items, err := splitEventList(spec)
+	if err != nil {
+		return nil, fmt.Errorf("perf: bad event list %q: %v", spec, err)
+	}
+	var groups [][]Configurator
+	for _, item := range items {
+		if !strings.HasPrefix(item, "{") {
+			cfg, err := ParseEvent(item)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, []Configurator{cfg})
+			continue
+		}
+		end := strings.LastIndex(item, "}")
+		var gmods modifiers
+		if suffix := item[end+1:]; suffix != "" {
+			if !strings.HasPrefix(suffix, ":") {
+				return nil, fmt.Errorf("perf: bad event group %q: junk after closing brace", item)
+			}
+			gmods, err = parseModifiers(suffix[1:])
+			if err != nil {
+				return nil, fmt.Errorf("perf: bad event group %q: %v", item, err)
+			}
+		}
+		members, err := splitEventList(item[1:end])
+		if err != nil {
+			return nil, fmt.Errorf("perf: bad event group %q: %v", item, err)
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("perf: empty event group %q", item)
+		}
+		var group []Configurator
+		for _, member := range members {
+			es, err := parseEvent(member)
+			if err != nil {
+				return nil, fmt.Errorf("perf: bad event %q: %v", member, err)
+			}
+			if gmods != (modifiers{}) {
+				es.mods = es.mods.merge(gmods)
+				if !es.named {
+					es.label = withModifiers(es.name, es.mods.String())
+				}
+			}
+			group = append(group, es)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// FormatEvent returns the canonical event specification for the event
+// configured by cfg, in the syntax accepted by ParseEvent.
+//
+// The Options fields which can be expressed as modifiers are included in
+// the specification. Other Attr fields, such as SampleFormat or
+// CountFormat, are not.
+func FormatEvent(cfg Configurator) (string, error) {
+	a := new(Attr)
+	if err := cfg.Configure(a); err != nil {
+		return "", err
+	}
+	return formatAttr(a)
+}
+
+// eventSpec is a parsed event specification.
+type eventSpec struct {
+	name  string // the specification, without modifiers
+	label string
+	named bool // label was set explicitly, using the name term
+	base  Configurator
+	mods  modifiers
+}
+
+// Configure implements the Configurator interface.
+func (es *eventSpec) Configure(attr *Attr) error {
+	if err := es.base.Configure(attr); err != nil {
+		return err
+	}
+	es.mods.apply(&attr.Options)
+	attr.Label = es.label
+	return nil
+}
+
+func parseEvent(spec string) (*eventSpec, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("empty event specification")
+	}
+	es := &eventSpec{label: spec}
+
+	// PMU events: pmu/terms/[mods]
+	if slash := strings.Index(spec, "/"); slash > 0 && !strings.HasPrefix(spec, "mem:") {
+		end := strings.LastIndex(spec, "/")
+		if end == slash {
+			return nil, fmt.Errorf("missing closing / for PMU terms")
+		}
+		pe := &pmuEvent{pmu: spec[:slash]}
+		terms, err := parsePMUTerms(spec[slash+1 : end])
+		if err != nil {
+			return nil, err
+		}
+		pe.terms = terms
+		es.name = spec[:end+1]
+		for _, t := range terms {
+			if t.name == "name" {
+				es.label = t.str
+				es.named = true
+			}
+		}
+		mods := strings.TrimPrefix(spec[end+1:], ":")
+		if es.mods, err = parseModifiers(mods); err != nil {
+			return nil, err
+		}
+		es.base = pe
+		return es, nil
+	}
+
+	// Breakpoints: mem:addr[/len][:access[:mods]]
+	if strings.HasPrefix(spec, "mem:") {
+		bp, mods, err := parseBreakpoint(strings.TrimPrefix(spec, "mem:"))
+		if err != nil {
+			return nil, err
+		}
+		es.name = strings.Join(strings.SplitN(spec, ":", 4)[:3], ":")
+		es.base = bp
+		es.mods = mods
+		return es, nil
+	}
+
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("too many colons")
+	}
+	name := parts[0]
+	es.name = name
+	if cfg := lookupEventName(name); cfg != nil {
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("too many colons")
+		}
+		es.base = cfg
+		if len(parts) == 2 {
+			mods, err := parseModifiers(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			es.mods = mods
+		}
+		return es, nil
+	}
+	if len(parts) == 1 {
+		return nil, fmt.Errorf("unknown event %q", name)
+	}
+
+	// Tracepoints: category:event[:mods]
+	if parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("bad tracepoint %q", spec)
+	}
+	es.name = parts[0] + ":" + parts[1]
+	es.base = Tracepoint(parts[0], parts[1])
+	if len(parts) == 3 {
+		mods, err := parseModifiers(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		es.mods = mods
+	}
+	return es, nil
+}
+
+// lookupEventName returns a Configurator for the named hardware, software,
+// hardware cache or raw event, or nil if name does not name such an event.
+func lookupEventName(name string) Configurator {
+	lname := strings.ToLower(name)
+	if cfg, ok := eventsByName[lname]; ok {
+		return cfg
+	}
+	if hwcc, ok := hardwareCacheCountersByName[lname]; ok {
+		return hwcc
+	}
+	if len(name) > 1 && name[0] == 'r' {
+		config, err := strconv.ParseUint(name[1:], 16, 64)
+		if err == nil {
+			return RawCounter(config)
+		}
+	}
+	return nil
+}
+
+// eventsByName maps lower case hardware and software event names and
+// aliases to the events themselves.
+var eventsByName = map[string]Configurator{}
+
+func init() {
+	for hwc, label := range hardwareLabels {
+		eventsByName[label.Name] = hwc
+		if label.Alias != "" {
+			eventsByName[label.Alias] = hwc
+		}
+	}
+	for swc, label := range softwareLabels {
+		eventsByName[label.Name] = swc
+		if label.Alias != "" {
+			eventsByName[label.Alias] = swc
+		}
+	}
+}
+
+// RawCounter is a raw, model specific, hardware performance counter.
+// Its value is the Config value for the event, as documented by the
+// CPU vendor.
+type RawCounter uint64
+
+// Configure configures attr to measure rc. It sets attr.Type and attr.Config.
+func (rc RawCounter) Configure(attr *Attr) error {
+	attr.Type = RawEvent
+	attr.Config = uint64(rc)
+	return nil
+}
+
+// String returns the perf tool name of the raw event: an "r" followed by
+// the hexadecimal value of the counter.
+func (rc RawCounter) String() string {
+	return fmt.Sprintf("r%x", uint64(rc))
+}
+
+// modifiers are event modifiers, as used by the perf tool.
+type modifiers struct {
+	user, kernel, hypervisor bool
+	guest, host              bool
+	idle                     bool
+	pinned                   bool
+	precise                  int
+}
+
+func parseModifiers(s string) (modifiers, error) {
+	var m modifiers
+	for _, c := range s {
+		switch c {
+		case 'u':
+			m.user = true
+		case 'k':
+			m.kernel = true
+		case 'h':
+			m.hypervisor = true
+		case 'G':
+			m.guest = true
+		case 'H':
+			m.host = true
+		case 'I':
+			m.idle = true
+		case 'D':
+			m.pinned = true
+		case 'p':
+			m.precise++
+		default:
+			return m, fmt.Errorf("unknown modifier %q", c)
+		}
+	}
+	if m.precise > int(MustHaveZeroSkid) {
+		return m, fmt.Errorf("too many p modifiers")
+	}
+	return m, nil
+}
+
+// modifiersFromOptions computes the modifiers corresponding to opts.
+func modifiersFromOptions(opts Options) modifiers {
+	var m modifiers
+	if opts.ExcludeUser || opts.ExcludeKernel || opts.ExcludeHypervisor {
+		m.user = !opts.ExcludeUser
+		m.kernel = !opts.ExcludeKernel
+		m.hypervisor = !opts.ExcludeHypervisor
+	}
+	if opts.ExcludeHost != opts.ExcludeGuest {
+		m.guest = !opts.ExcludeGuest
+		m.host = !opts.ExcludeHost
+	}
+	m.idle = opts.ExcludeIdle
+	m.pinned = opts.Pinned
+	m.precise = int(opts.PreciseIP)
+	return m
+}
+
+// apply applies the modifiers to opts.
+func (m modifiers) apply(opts *Options) {
+	if m.user || m.kernel || m.hypervisor {
+		opts.ExcludeUser = !m.user
+		opts.ExcludeKernel = !m.kernel
+		opts.ExcludeHypervisor = !m.hypervisor
+	}
+	if m.guest || m.host {
+		opts.ExcludeGuest = !m.guest
+		opts.ExcludeHost = !m.host
+	}
+	if m.idle {
+		opts.ExcludeIdle = true
+	}
+	if m.pinned {
+		opts.Pinned = true
+	}
+	if m.precise > 0 {
+		opts.PreciseIP = Skid(m.precise)
+	}
+}
+
+// merge returns the union of m and other.
+func (m modifiers) merge(other modifiers) modifiers {
+	m.user = m.user || other.user
+	m.kernel = m.kernel || other.kernel
+	m.hypervisor = m.hypervisor || other.hypervisor
+	m.guest = m.guest || other.guest
+	m.host = m.host || other.host
+	m.idle = m.idle || other.idle
+	m.pinned = m.pinned || other.pinned
+	if other.precise > m.precise {
+		m.precise = other.precise
+	}
+	return m
+}
+
+// String returns the canonical modifier string for m.
+func (m modifiers) String() string {
+	sb := new(strings.Builder)
+	if m.user {
+		sb.WriteByte('u')
+	}
+	if m.kernel {
+		sb.WriteByte('k')
+	}
+	if m.hypervisor {
+		sb.WriteByte('h')
+	}
+	if m.guest {
+		sb.WriteByte('G')
+	}
+	if m.host {
+		sb.WriteByte('H')
+	}
+	if m.idle {
+		sb.WriteByte('I')
+	}
+	if m.pinned {
+		sb.WriteByte('D')
+	}
+	for i := 0; i < m.precise; i++ {
+		sb.WriteByte('p')
+	}
+	return sb.String()
+}
+
+// withModifiers appends the modifier string mods to the event
+// specification spec, which must not contain modifiers already.
+func withModifiers(spec, mods string) string {
+	switch {
+	case mods == "":
+		return spec
+	case strings.HasSuffix(spec, "/"):
+		return spec + mods
+	default:
+		return spec + ":" + mods
+	}
+}
+
+// splitEventList splits a comma separated list of events into its items,
+// while keeping brace groups and PMU terms intact.
+func splitEventList(s string) ([]string, error) {
+	var (
+		items []string
+		depth int
+		slash bool
+		start int // start of the current top-level item
+		item  int // start of the current event, at any depth
+	)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			if slash {
+				return nil, fmt.Errorf("unexpected { in PMU terms")
+			}
+			depth++
+			if depth > 1 {
+				return nil, fmt.Errorf("nested event groups")
+			}
+			item = i + 1
+		case '}':
+			if slash {
+				return nil, fmt.Errorf("unexpected } in PMU terms")
+			}
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced }")
+			}
+		case '/':
+			if !strings.HasPrefix(strings.TrimLeft(s[item:i], " {"), "mem:") {
+				slash = !slash
+			}
+		case ',':
+			if !slash {
+				item = i + 1
+			}
+			if depth == 0 && !slash {
+				item := strings.TrimSpace(s[start:i])
+				if item == "" {
+					return nil, fmt.Errorf("empty event")
+				}
+				items = append(items, item)
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced {")
+	}
+	if slash {
+		return nil, fmt.Errorf("missing closing / for PMU terms")
+	}
+	if item := strings.TrimSpace(s[start:]); item != "" {
+		items = append(items, item)
+	} else if len(items) > 0 {
+		return nil, fmt.Errorf("empty event")
+	}
+	return items, nil
+}
+
+// pmuEvent is an event specified using the pmu/terms/ syntax.
+type pmuEvent struct {
+	pmu   string
+	terms []pmuTerm
+}
+
+// Configure implements the Configurator interface.
+func (pe *pmuEvent) Configure(attr *Attr) error {
+	pmu, err := LookupPMU(pe.pmu)
+	if err != nil {
+		return err
+	}
+	return pmu.configure(attr, pe.terms)
+}
+
+// parseBreakpoint parses a breakpoint specification of the form
+// addr[/len][:access[:mods]], following the mem: prefix.
+func parseBreakpoint(s string) (Configurator, modifiers, error) {
+	var mods modifiers
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return nil, mods, fmt.Errorf("too many colons")
+	}
+	addrlen := strings.SplitN(parts[0], "/", 2)
+	addr, err := strconv.ParseUint(addrlen[0], 0, 64)
+	if err != nil {
+		return nil, mods, fmt.Errorf("bad breakpoint address: %v", err)
+	}
+	typ := BreakpointTypeRW
+	length := BreakpointLength4
+	if len(parts) > 1 {
+		typ = BreakpointTypeEmpty
+		for _, c := range parts[1] {
+			switch c {
+			case 'r':
+				typ |= BreakpointTypeR
+			case 'w':
+				typ |= BreakpointTypeW
+			case 'x':
+				typ |= BreakpointTypeX
+			default:
+				return nil, mods, fmt.Errorf("bad breakpoint access %q", parts[1])
+			}
+		}
+		if typ == BreakpointTypeEmpty {
+			return nil, mods, fmt.Errorf("empty breakpoint access")
+		}
+	}
+	if typ == BreakpointTypeX {
+		length = ExecutionBreakpointLength()
+	}
+	if len(addrlen) == 2 {
+		l, err := strconv.ParseUint(addrlen[1], 0, 64)
+		if err != nil {
+			return nil, mods, fmt.Errorf("bad breakpoint length: %v", err)
+		}
+		length = BreakpointLength(l)
+	}
+	if len(parts) == 3 {
+		if mods, err = parseModifiers(parts[2]); err != nil {
+			return nil, mods, err
+		}
+	}
+	return Breakpoint(typ, addr, length), mods, nil
+}
+
+// formatAttr returns the canonical event specification for a.
+func formatAttr(a *Attr) (string, error) {
+	mods := modifiersFromOptions(a.Options).String()
+	switch a.Type {
+	case HardwareEvent:
+		label, ok := hardwareLabels[HardwareCounter(a.Config)]
+		if !ok {
+			return "", fmt.Errorf("perf: unknown hardware event %#x", a.Config)
+		}
+		return withModifiers(label.Name, mods), nil
+	case SoftwareEvent:
+		label, ok := softwareLabels[SoftwareCounter(a.Config)]
+		if !ok {
+			return "", fmt.Errorf("perf: unknown software event %#x", a.Config)
+		}
+		return withModifiers(label.Name, mods), nil
+	case HardwareCacheEvent:
+		hwcc := hardwareCacheCounterFromConfig(a.Config)
+		name := hwcc.String()
+		if name == "" {
+			return "", fmt.Errorf("perf: unknown hardware cache event %#x", a.Config)
+		}
+		return withModifiers(name, mods), nil
+	case RawEvent:
+		if a.Config1 == 0 && a.Config2 == 0 {
+			return withModifiers(RawCounter(a.Config).String(), mods), nil
+		}
+		return formatPMUEvent("cpu", a, mods), nil
+	case TracepointEvent:
+		parts := strings.Split(a.Label, ":")
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			id := eventID{Type: uint64(a.Type), Config: a.Config}
+			parts = strings.Split(lookupLabel(id).Name, ":")
+		}
+		if len(parts) < 2 {
+			return "", fmt.Errorf("perf: unknown tracepoint %d", a.Config)
+		}
+		return withModifiers(parts[0]+":"+parts[1], mods), nil
+	case BreakpointEvent:
+		spec := fmt.Sprintf("mem:%#x/%d:%s", a.Config1, a.Config2, formatBreakpointType(BreakpointType(a.BreakpointType)))
+		return withModifiers(spec, mods), nil
+	default:
+		pmu, err := lookupPMUName(a.Type)
+		if err != nil {
+			return "", err
+		}
+		return formatPMUEvent(pmu, a, mods), nil
+	}
+}
+
+func formatPMUEvent(pmu string, a *Attr, mods string) string {
+	terms := []string{fmt.Sprintf("config=%#x", a.Config)}
+	if a.Config1 != 0 {
+		terms = append(terms, fmt.Sprintf("config1=%#x", a.Config1))
+	}
+	if a.Config2 != 0 {
+		terms = append(terms, fmt.Sprintf("config2=%#x", a.Config2))
+	}
+	return pmu + "/" + strings.Join(terms, ",") + "/" + mods
+}
+
+func formatBreakpointType(typ BreakpointType) string {
+	sb := new(strings.Builder)
+	if typ&BreakpointTypeR != 0 {
+		sb.WriteByte('r')
+	}
+	if typ&BreakpointTypeW != 0 {
+		sb.WriteByte('w')
+	}
+	if typ&BreakpointTypeX != 0 {
+		sb.WriteByte('x')
+	}
+	return sb.String()
+}
@@ -0,0 +1,302 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"testing"
+
+	"acln.ro/perf"
+)
+
+func TestParseEvent(t *testing.T) {
+	t.Run("Names", testParseEventNames)
+	t.Run("Modifiers", testParseEventModifiers)
+	t.Run("Breakpoint", testParseEventBreakpoint)
+	t.Run("PMU", testParseEventPMU)
+	t.Run("Errors", testParseEventErrors)
+	t.Run("List", testParseEventList)
+	t.Run("RoundTrip", testParseEventRoundTrip)
+}
+
+func testParseEventNames(t *testing.T) {
+	tests := []struct {
+		spec   string
+		typ    perf.EventType
+		config uint64
+	}{
+		{"cycles", perf.HardwareEvent, uint64(perf.CPUCycles)},
+		{"cpu-cycles", perf.HardwareEvent, uint64(perf.CPUCycles)},
+		{"instructions", perf.HardwareEvent, uint64(perf.Instructions)},
+		{"branches", perf.HardwareEvent, uint64(perf.BranchInstructions)},
+		{"page-faults", perf.SoftwareEvent, uint64(perf.PageFaults)},
+		{"cs", perf.SoftwareEvent, uint64(perf.ContextSwitches)},
+		{"L1-dcache-load-misses", perf.HardwareCacheEvent, 0x10000},
+		{"L1-dcache-loads", perf.HardwareCacheEvent, 0x0},
+		{"LLC-store-misses", perf.HardwareCacheEvent, 0x10102},
+		{"dTLB-prefetches", perf.HardwareCacheEvent, 0x00203},
+		{"l1i-misses", perf.HardwareCacheEvent, 0x10001},
+		{"r01c2", perf.RawEvent, 0x1c2},
+	}
+	for _, tt := range tests {
+		cfg, err := perf.ParseEvent(tt.spec)
+		if err != nil {
+			t.Errorf("ParseEvent(%q): %v", tt.spec, err)
+			continue
+		}
+		a := new(perf.Attr)
+		if err := cfg.Configure(a); err != nil {
+			t.Errorf("%q: Configure: %v", tt.spec, err)
+			continue
+		}
+		if a.Type != tt.typ || a.Config != tt.config {
+			t.Errorf("%q: got type %d, config %#x, want type %d, config %#x",
+				tt.spec, a.Type, a.Config, tt.typ, tt.config)
+		}
+		if a.Label != tt.spec {
+			t.Errorf("%q: got label %q", tt.spec, a.Label)
+		}
+	}
+}
+
+func testParseEventModifiers(t *testing.T) {
+	tests := []struct {
+		spec string
+		want perf.Options
+	}{
+		{
+			spec: "cycles:u",
+			want: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+		},
+		{
+			spec: "instructions:k",
+			want: perf.Options{ExcludeUser: true, ExcludeHypervisor: true},
+		},
+		{
+			spec: "instructions:uk",
+			want: perf.Options{ExcludeHypervisor: true},
+		},
+		{
+			spec: "cycles:G",
+			want: perf.Options{ExcludeHost: true},
+		},
+		{
+			spec: "cycles:H",
+			want: perf.Options{ExcludeGuest: true},
+		},
+		{
+			spec: "cycles:ppp",
+			want: perf.Options{PreciseIP: perf.MustHaveZeroSkid},
+		},
+		{
+			spec: "cycles:upD",
+			want: perf.Options{
+				ExcludeKernel:     true,
+				ExcludeHypervisor: true,
+				PreciseIP:         perf.MustHaveConstantSkid,
+				Pinned:            true,
+			},
+		},
+		{
+			spec: "page-faults:I",
+			want: perf.Options{ExcludeIdle: true},
+		},
+	}
+	for _, tt := range tests {
+		cfg, err := perf.ParseEvent(tt.spec)
+		if err != nil {
+			t.Errorf("ParseEvent(%q): %v", tt.spec, err)
+			continue
+		}
+		a := new(perf.Attr)
+		if err := cfg.Configure(a); err != nil {
+			t.Errorf("%q: Configure: %v", tt.spec, err)
+			continue
+		}
+		if a.Options != tt.want {
+			t.Errorf("%q: got options %+v, want %+v", tt.spec, a.Options, tt.want)
+		}
+	}
+}
+
+func testParseEventBreakpoint(t *testing.T) {
+	cfg, err := perf.ParseEvent("mem:0x1000/8:w:u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := new(perf.Attr)
+	if err := cfg.Configure(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Type != perf.BreakpointEvent {
+		t.Fatalf("got type %d, want %d", a.Type, perf.BreakpointEvent)
+	}
+	if a.BreakpointType != uint32(perf.BreakpointTypeW) {
+		t.Errorf("got breakpoint type %d, want %d", a.BreakpointType, perf.BreakpointTypeW)
+	}
+	if a.Config1 != 0x1000 || a.Config2 != 8 {
+		t.Errorf("got address %#x, length %d, want 0x1000, 8", a.Config1, a.Config2)
+	}
+	if !a.Options.ExcludeKernel {
+		t.Errorf("u modifier not applied")
+	}
+}
+
+func testParseEventPMU(t *testing.T) {
+	requires(t, softwarePMU)
+
+	cfg, err := perf.ParseEvent("software/config=0x2,name=faults,period=100/u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := new(perf.Attr)
+	if err := cfg.Configure(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Type != perf.SoftwareEvent || a.Config != uint64(perf.PageFaults) {
+		t.Errorf("got type %d, config %#x", a.Type, a.Config)
+	}
+	if a.Label != "faults" {
+		t.Errorf("got label %q, want %q", a.Label, "faults")
+	}
+	if a.Sample != 100 || a.Options.Freq {
+		t.Errorf("got sample %d, freq %t, want period 100", a.Sample, a.Options.Freq)
+	}
+	if !a.Options.ExcludeKernel {
+		t.Errorf("u modifier not applied")
+	}
+
+	cfg, err = perf.ParseEvent("software/bogus=1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Configure(new(perf.Attr)); err == nil {
+		t.Errorf("configured unknown PMU term")
+	}
+}
+
+func testParseEventErrors(t *testing.T) {
+	specs := []string{
+		"",
+		"not-an-event",
+		"cycles:x",
+		"cycles:pppp",
+		"cycles:u:k",
+		"cpu/event=0x3c",
+		"cpu/event=zzz/",
+		"mem:0x1000:q",
+		":sched_switch",
+	}
+	for _, spec := range specs {
+		if _, err := perf.ParseEvent(spec); err == nil {
+			t.Errorf("ParseEvent(%q) succeeded", spec)
+		}
+	}
+}
+
+func testParseEventList(t *testing.T) {
+	groups, err := perf.ParseEventList("{cycles,instructions:k}:u, page-faults,cpu/event=0x3c,umask=0x0/pp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("got %d groups, want 3", len(groups))
+	}
+	if len(groups[0]) != 2 || len(groups[1]) != 1 || len(groups[2]) != 1 {
+		t.Fatalf("got group sizes %d, %d, %d, want 2, 1, 1",
+			len(groups[0]), len(groups[1]), len(groups[2]))
+	}
+
+	a := new(perf.Attr)
+	if err := groups[0][1].Configure(a); err != nil {
+		t.Fatal(err)
+	}
+	want := perf.Options{ExcludeHypervisor: true}
+	if a.Options != want {
+		t.Errorf("got merged options %+v, want %+v", a.Options, want)
+	}
+	if a.Label != "instructions:uk" {
+		t.Errorf("got label %q, want %q", a.Label, "instructions:uk")
+	}
+
+	// Breakpoint lengths use a slash, which must not be taken for the
+	// start of PMU terms, wherever the breakpoint is in the list.
+	for _, spec := range []string{
+		"cycles,mem:0x1000/8",
+		"{mem:0x1000/8,cycles}",
+		"{cycles,mem:0x1000/8}",
+		"{cycles, mem:0x1000/8:w},cpu/event=0x3c/",
+	} {
+		if _, err := perf.ParseEventList(spec); err != nil {
+			t.Errorf("ParseEventList(%q): %v", spec, err)
+		}
+	}
+
+	bad := []string{
+		"{cycles,instructions",
+		"cycles}",
+		"{{cycles}}",
+		"cycles,,instructions",
+		"{}",
+		"{cycles}u",
+	}
+	for _, spec := range bad {
+		if _, err := perf.ParseEventList(spec); err == nil {
+			t.Errorf("ParseEventList(%q) succeeded", spec)
+		}
+	}
+}
+
+func testParseEventRoundTrip(t *testing.T) {
+	tests := []struct {
+		spec, canonical string
+	}{
+		{"cycles", "cpu-cycles"},
+		{"cycles:u", "cpu-cycles:u"},
+		{"instructions:kpp", "instructions:kpp"},
+		{"cs:H", "context-switches:H"},
+		{"l1d-load-miss", "L1-dcache-load-misses"},
+		{"LLC-loads:u", "LLC-loads:u"},
+		{"r01c2:u", "r1c2:u"},
+		{"mem:0x1000/4:rw", "mem:0x1000/4:rw"},
+		{"mem:0x2000/8:w:k", "mem:0x2000/8:w:k"},
+	}
+	for _, tt := range tests {
+		cfg, err := perf.ParseEvent(tt.spec)
+		if err != nil {
+			t.Errorf("ParseEvent(%q): %v", tt.spec, err)
+			continue
+		}
+		got, err := perf.FormatEvent(cfg)
+		if err != nil {
+			t.Errorf("FormatEvent(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.canonical {
+			t.Errorf("FormatEvent(ParseEvent(%q)) = %q, want %q", tt.spec, got, tt.canonical)
+			continue
+		}
+		cfg2, err := perf.ParseEvent(got)
+		if err != nil {
+			t.Errorf("ParseEvent(%q): %v", got, err)
+			continue
+		}
+		a1, a2 := new(perf.Attr), new(perf.Attr)
+		cfg.Configure(a1)
+		cfg2.Configure(a2)
+		a1.Label, a2.Label = "", ""
+		if *a1 != *a2 {
+			t.Errorf("%q and %q configure different attributes", tt.spec, got)
+		}
+	}
+
+	hwcc := perf.HardwareCacheCounter{
+		Cache:  perf.DTLB,
+		Op:     perf.Write,
+		Result: perf.Miss,
+	}
+	if got, err := perf.FormatEvent(hwcc); err != nil || got != "dTLB-store-misses" {
+		t.Errorf("FormatEvent(%v) = %q, %v, want %q", hwcc, got, err, "dTLB-store-misses")
+	}
+}
@@ -10,7 +10,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -64,6 +67,9 @@ type Event struct {
 	// has no access to. The Event owns them all, Close closes them all.
 	owned []*Event
 
+	// leader is the group leader, if the event is a group follower.
+	leader *Event
+
 	// a is the set of attributes the Event was configured with. It is
 	// a clone of the original, save for the Label field, which may have
 	// been set, if the original *Attr didn't set it.
@@ -98,6 +104,10 @@ type Event struct {
 	// and ReadRawRecord. This means memory for records returned from those
 	// methods will be overwritten by successive calls.
 	recordBuffer []byte
+
+	// restrictions records the exclusion options applied by a fallback
+	// policy when the event was opened. See OpenOptions.
+	restrictions Restrictions
 }
 
 // Open opens the event configured by attr.
@@ -131,6 +141,36 @@ func OpenWithFlags(a *Attr, pid, cpu int, group *Event, flags int) (*Event, erro
 	return open(a, pid, cpu, group, flags)
 }
 
+// OpenOptions configures optional behavior of OpenWithOptions and
+// (*Group).Open.
+type OpenOptions struct {
+	// Validate runs Attr.Validate before opening the event. If
+	// validation fails, the *ValidationError is returned, and
+	// perf_event_open is not called.
+	Validate bool
+
+	// FallbackExcludeKernel enables a fallback policy similar to that
+	// of perf stat: if perf_event_open fails with EACCES or EPERM, the
+	// event is opened again, first excluding the hypervisor, then
+	// excluding both the kernel and the hypervisor. The restrictions
+	// which were applied are reported by (*Event).Restrictions, and in
+	// the Restrictions field of Count and GroupCount.
+	FallbackExcludeKernel bool
+}
+
+// OpenWithOptions is like Open, but takes additional options.
+func OpenWithOptions(a *Attr, pid, cpu int, group *Event, opts OpenOptions) (*Event, error) {
+	if opts.Validate {
+		if err := a.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FallbackExcludeKernel {
+		return openWithFallback(a, pid, cpu, group, 0)
+	}
+	return open(a, pid, cpu, group, 0)
+}
+
 // OpenCGroup is like Open, but activates per-container system-wide
 // monitoring. If cgroupfs is mounted on /dev/cgroup, and the group to
 // monitor is called "test", then cgroupfd must be a file descriptor opened
@@ -150,7 +190,12 @@ func open(a *Attr, pid, cpu int, group *Event, flags int) (*Event, error) {
 
 	fd, err := perfEventOpen(a, pid, cpu, groupfd, flags)
 	if err != nil {
-		return nil, os.NewSyscallError("perf_event_open", err)
+		if err == unix.EINVAL {
+			if fields := unsupportedFeatures(a); len(fields) > 0 {
+				err = &FeatureError{Fields: fields, Err: err}
+			}
+		}
+		return nil, newOpenError(a, pid, cpu, groupfd, flags, err)
 	}
 	if err := unix.SetNonblock(fd, true); err != nil {
 		unix.Close(fd)
@@ -163,8 +208,10 @@ func open(a *Attr, pid, cpu int, group *Event, flags int) (*Event, error) {
 	*ac = *a // ok to copy since no slices
 	if ac.Label == "" {
 		evID := eventID{
-			Type:   uint64(a.Type),
-			Config: uint64(a.Config),
+			Type:    uint64(a.Type),
+			Config:  a.Config,
+			Config1: a.Config1,
+			Config2: a.Config2,
 		}
 		ac.Label = lookupLabel(evID).Name
 	}
@@ -179,12 +226,19 @@ func open(a *Attr, pid, cpu int, group *Event, flags int) (*Event, error) {
 		return nil, err
 	}
 	ev.id = id
+	if ac.Filter != "" {
+		if err := ev.SetFilter(ac.Filter); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
 	if group != nil {
 		if group.groupByID == nil {
 			group.groupByID = map[uint64]*Event{}
 		}
 		group.group = append(group.group, ev)
 		group.groupByID[id] = ev
+		ev.leader = group
 	}
 
 	return ev, nil
@@ -196,7 +250,29 @@ func perfEventOpen(a *Attr, pid, cpu, groupfd, flags int) (fd int, err error) {
 	sysAttr := a.sysAttr()
 	cloexecFlags := flags | unix.PERF_FLAG_FD_CLOEXEC
 
+	// The kernel reads the kprobe function or uprobe path from the
+	// address in Config1 during perf_event_open, so the string must
+	// stay alive (and in place) until the system call returns.
+	if a.probeTarget != "" {
+		target, err := unix.BytePtrFromString(a.probeTarget)
+		if err != nil {
+			return -1, err
+		}
+		sysAttr.Ext1 = uint64(uintptr(unsafe.Pointer(target)))
+		defer runtime.KeepAlive(target)
+	}
+
 	fd, err = unix.PerfEventOpen(sysAttr, pid, cpu, groupfd, cloexecFlags)
+	if err == unix.E2BIG {
+		// The kernel's perf_event_attr is smaller than ours, and
+		// we set fields past its end. The kernel wrote its size back
+		// into sysAttr.Size. If the offending fields are known, name
+		// them. Otherwise, try again using the kernel's size.
+		if fields := fieldsBeyond(a, sysAttr.Size); len(fields) > 0 {
+			return -1, &FeatureError{Fields: fields, Err: err}
+		}
+		fd, err = unix.PerfEventOpen(sysAttr, pid, cpu, groupfd, cloexecFlags)
+	}
 	switch err {
 	case nil:
 		return fd, nil
@@ -325,23 +401,19 @@ func (ev *Event) Measure(f func()) (Count, error) {
 	return ev.ReadCount()
 }
 
-// MeasureGroup is like Measure, but for event groups.
+// MeasureGroup is like Measure, but for event groups. All events in the
+// group are disabled, reset, enabled and disabled again together, using
+// the group-wide variants of Disable, Reset and Enable.
 func (ev *Event) MeasureGroup(f func()) (GroupCount, error) {
-	if err := ev.Disable(); err != nil {
+	if err := ev.DisableGroup(); err != nil {
 		return GroupCount{}, err
 	}
-	if err := ev.Reset(); err != nil {
-		return GroupCount{}, err
-	}
-	if err := ev.Enable(); err != nil {
+	if err := ev.ResetGroup(); err != nil {
 		return GroupCount{}, err
 	}
 
-	f()
+	doEnableRunDisable(uintptr(ev.perffd), unix.PERF_IOC_FLAG_GROUP, f)
 
-	if err := ev.Disable(); err != nil {
-		return GroupCount{}, err
-	}
 	return ev.ReadGroupCount()
 }
 
@@ -364,8 +436,57 @@ func (ev *Event) Disable() error {
 	return wrapIoctlError("PERF_EVENT_IOC_DISABLE", err)
 }
 
-// TODO(acln): add support for PERF_IOC_FLAG_GROUP and for event followers
-// to disable the entire group?
+// EnableGroup enables all events in the group ev is part of, atomically.
+// ev may be the group leader, or any of its followers.
+func (ev *Event) EnableGroup() error {
+	if err := ev.ok(); err != nil {
+		return err
+	}
+	err := ev.ioctlInt(unix.PERF_EVENT_IOC_ENABLE, unix.PERF_IOC_FLAG_GROUP)
+	return wrapIoctlError("PERF_EVENT_IOC_ENABLE", err)
+}
+
+// DisableGroup disables all events in the group ev is part of, atomically.
+// ev may be the group leader, or any of its followers.
+func (ev *Event) DisableGroup() error {
+	if err := ev.ok(); err != nil {
+		return err
+	}
+	err := ev.ioctlInt(unix.PERF_EVENT_IOC_DISABLE, unix.PERF_IOC_FLAG_GROUP)
+	return wrapIoctlError("PERF_EVENT_IOC_DISABLE", err)
+}
+
+// ResetGroup resets the counters of all events in the group ev is part of,
+// atomically. ev may be the group leader, or any of its followers.
+func (ev *Event) ResetGroup() error {
+	if err := ev.ok(); err != nil {
+		return err
+	}
+	err := ev.ioctlInt(unix.PERF_EVENT_IOC_RESET, unix.PERF_IOC_FLAG_GROUP)
+	return wrapIoctlError("PERF_EVENT_IOC_RESET", err)
+}
+
+// RefreshGroup is like Refresh, but for the group ev is part of. ev may be
+// the group leader, or any of its followers.
+//
+// The kernel does not support PERF_IOC_FLAG_GROUP for refreshes, and the
+// group leader controls when the group counts. RefreshGroup therefore
+// enables the followers of the group, then calls Refresh on the leader.
+func (ev *Event) RefreshGroup(delta int) error {
+	if err := ev.ok(); err != nil {
+		return err
+	}
+	leader := ev
+	if ev.leader != nil {
+		leader = ev.leader
+	}
+	for _, follower := range leader.group {
+		if err := follower.Enable(); err != nil {
+			return err
+		}
+	}
+	return leader.Refresh(delta)
+}
 
 // Refresh adds delta to a counter associated with the event. This counter
 // decrements every time the event overflows. Once the counter reaches zero,
@@ -455,8 +576,6 @@ func (ev *Event) canReadRecordFrom(f *Event) bool {
 		ff.StreamID
 }
 
-// BUG(acln): PERF_EVENT_IOC_SET_FILTER is not implemented
-
 // ID returns the unique event ID value for ev.
 func (ev *Event) ID() (uint64, error) {
 	if err := ev.ok(); err != nil {
@@ -514,7 +633,80 @@ func (ev *Event) QueryBPF(max uint32) ([]uint32, error) {
 	return fds, nil
 }
 
-// BUG(acln): PERF_EVENT_IOC_MODIFY_ATTRIBUTES is not implemented
+// ModifyAttributes modifies the attributes of ev in place, without closing
+// the event or discarding its ring buffer. The kernel only allows modifying
+// a small set of fields, for some event types: see ModifiableFields. All
+// other fields of a must match the attributes ev was opened with, with the
+// exception of Label and Filter, which are ignored. On success, the copy of
+// the attributes held by ev is updated, so records read from ev are decoded
+// according to the new attributes.
+//
+// ModifyAttributes requires Linux 4.17 or later.
+func (ev *Event) ModifyAttributes(a *Attr) error {
+	if err := ev.ok(); err != nil {
+		return err
+	}
+	if err := checkModifiable(ev.a, a); err != nil {
+		return err
+	}
+	err := ev.ioctlPointer(unix.PERF_EVENT_IOC_MODIFY_ATTRIBUTES, unsafe.Pointer(a.sysAttr()))
+	if err != nil {
+		return wrapIoctlError("PERF_EVENT_IOC_MODIFY_ATTRIBUTES", err)
+	}
+	ev.a.BreakpointType = a.BreakpointType
+	ev.a.Config1 = a.Config1
+	ev.a.Config2 = a.Config2
+	ev.a.Options.Disabled = a.Options.Disabled
+	return nil
+}
+
+// ModifiableFields returns the names of the Attr fields which
+// ModifyAttributes can change, for events of type t. It returns nil if
+// the kernel does not support modifying events of type t.
+//
+// Only breakpoint events can be modified: their address (Config1), length
+// (Config2), type (BreakpointType) and Options.Disabled.
+func ModifiableFields(t EventType) []string {
+	if t == BreakpointEvent {
+		return []string{"BreakpointType", "Config1", "Config2", "Options.Disabled"}
+	}
+	return nil
+}
+
+// checkModifiable checks that the kernel can modify the attributes old
+// into the attributes a.
+func checkModifiable(old, a *Attr) error {
+	modifiable := ModifiableFields(old.Type)
+	if modifiable == nil {
+		return fmt.Errorf("perf: cannot modify attributes of %q: only breakpoint events can be modified", old.Label)
+	}
+	if a.Type != old.Type {
+		return fmt.Errorf("perf: cannot modify attributes of %q: Type cannot be changed", old.Label)
+	}
+	want := *a
+	want.Label = old.Label
+	want.Filter = old.Filter
+	want.probeTarget = old.probeTarget
+	want.BreakpointType = old.BreakpointType
+	want.Config1 = old.Config1
+	want.Config2 = old.Config2
+	want.Options.Disabled = old.Options.Disabled
+	if want == *old {
+		return nil
+	}
+	var changed []string
+	wv, ov := reflect.ValueOf(want), reflect.ValueOf(*old)
+	for i := 0; i < wv.NumField(); i++ {
+		if wv.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		if wv.Field(i).Interface() != ov.Field(i).Interface() {
+			changed = append(changed, wv.Type().Field(i).Name)
+		}
+	}
+	return fmt.Errorf("perf: cannot modify %s of %q: only %s can be modified",
+		strings.Join(changed, ", "), old.Label, strings.Join(modifiable, ", "))
+}
 
 func (ev *Event) ioctlNoArg(number int) error {
 	return ev.ioctlInt(number, 0)
@@ -584,7 +776,7 @@ type Attr struct {
 	// string), it is included verbatim.
 	//
 	// For most events, the computed Label matches the label specified by
-	// ``perf list'' for the same event (but see Bugs).
+	// ``perf list'' for the same event.
 	Label string
 
 	// Type is the major type of the event.
@@ -629,7 +821,8 @@ type Attr struct {
 	//
 	// For breakpoint events, Config1 is the breakpoint address.
 	// For kprobes, it is the kprobe function. For uprobes, it is the
-	// uprobe path.
+	// uprobe path. See Kprobe and Uprobe for Configurators which manage
+	// these strings.
 	Config1 uint64
 
 	// Config2 is a further extension of the Config1 field.
@@ -668,6 +861,16 @@ type Attr struct {
 	// SampleMaxStack is the maximum number of frame pointers in a
 	// callchain. The value must be < MaxStack().
 	SampleMaxStack uint16
+
+	// Filter is a filter expression which is set on the event using
+	// SetFilter, when the event is opened. See SetFilter and WithFilter.
+	Filter string
+
+	// probeTarget is the kprobe function or the uprobe path, for events
+	// on the kprobe and uprobe PMUs. If set, Config1 is set to the address
+	// of a NUL-terminated copy of probeTarget when the event is opened.
+	// See Kprobe and Uprobe.
+	probeTarget string
 }
 
 func (a Attr) sysAttr() *unix.PerfEventAttr {
@@ -736,7 +939,7 @@ func (a *Attr) SetWakeupWatermark(n uint32) {
 // LookupEventType probes /sys/bus/event_source/devices/<device>/type
 // for the EventType value associated with the specified PMU.
 func LookupEventType(pmu string) (EventType, error) {
-	path := filepath.Join("/sys/bus/event_source/devices", pmu, "type")
+	path := filepath.Join(pmuDevicesDir, pmu, "type")
 	et, err := readUint(path, 32)
 	return EventType(et), err
 }
@@ -946,6 +1149,104 @@ func (hwcc HardwareCacheCounter) Configure(attr *Attr) error {
 	return nil
 }
 
+// String returns the name of the counter, as listed by ``perf list'',
+// e.g. "L1-dcache-load-misses". String returns the empty string if hwcc
+// is not a known counter.
+func (hwcc HardwareCacheCounter) String() string {
+	cache, ok := cacheNames[hwcc.Cache]
+	if !ok {
+		return ""
+	}
+	op, ok := cacheOpNames[hwcc.Op]
+	if !ok {
+		return ""
+	}
+	switch hwcc.Result {
+	case Access:
+		return cache[0] + "-" + op[1]
+	case Miss:
+		return cache[0] + "-" + op[0] + "-misses"
+	default:
+		return ""
+	}
+}
+
+// hardwareCacheCounterFromConfig decodes an Attr.Config value for a
+// HardwareCacheEvent.
+func hardwareCacheCounterFromConfig(config uint64) HardwareCacheCounter {
+	return HardwareCacheCounter{
+		Cache:  Cache(config & 0xff),
+		Op:     CacheOp((config >> 8) & 0xff),
+		Result: CacheOpResult((config >> 16) & 0xff),
+	}
+}
+
+// Cache, cache operation and cache operation result names, as used by the
+// perf tool. The first name is canonical, the others are aliases.
+var (
+	cacheNames = map[Cache][]string{
+		L1D:  {"L1-dcache", "l1-d", "l1d", "L1-data"},
+		L1I:  {"L1-icache", "l1-i", "l1i", "L1-instruction"},
+		LL:   {"LLC", "L2"},
+		DTLB: {"dTLB", "d-tlb", "Data-TLB"},
+		ITLB: {"iTLB", "i-tlb", "Instruction-TLB"},
+		BPU:  {"branch", "branches", "bpu", "btb", "bpc"},
+		NODE: {"node"},
+	}
+	cacheOpNames = map[CacheOp][]string{
+		Read:     {"load", "loads", "read"},
+		Write:    {"store", "stores", "write"},
+		Prefetch: {"prefetch", "prefetches", "speculative-read", "speculative-load"},
+	}
+	cacheOpResultNames = map[CacheOpResult][]string{
+		Access: {"refs", "Reference", "ops", "access"},
+		Miss:   {"misses", "miss"},
+	}
+)
+
+// hardwareCacheCountersByName maps lower case hardware cache counter names
+// to the counters themselves. Names are of the form cache-op-result,
+// cache-op or cache-result. If the operation is omitted, it defaults to
+// Read. If the result is omitted, it defaults to Access.
+var hardwareCacheCountersByName = map[string]HardwareCacheCounter{}
+
+func init() {
+	for cache, cnames := range cacheNames {
+		for _, cname := range cnames {
+			for result, rnames := range cacheOpResultNames {
+				for _, rname := range rnames {
+					name := strings.ToLower(cname + "-" + rname)
+					hardwareCacheCountersByName[name] = HardwareCacheCounter{
+						Cache:  cache,
+						Op:     Read,
+						Result: result,
+					}
+				}
+			}
+			for op, onames := range cacheOpNames {
+				for _, oname := range onames {
+					name := strings.ToLower(cname + "-" + oname)
+					hardwareCacheCountersByName[name] = HardwareCacheCounter{
+						Cache:  cache,
+						Op:     op,
+						Result: Access,
+					}
+					for result, rnames := range cacheOpResultNames {
+						for _, rname := range rnames {
+							name := strings.ToLower(cname + "-" + oname + "-" + rname)
+							hardwareCacheCountersByName[name] = HardwareCacheCounter{
+								Cache:  cache,
+								Op:     op,
+								Result: result,
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
 // HardwareCacheCounters returns cache counters which measure the cartesian
 // product of the specified caches, operations and results.
 func HardwareCacheCounters(caches []Cache, ops []CacheOp, results []CacheOpResult) []Configurator {
@@ -982,11 +1283,14 @@ func Tracepoint(category, event string) Configurator {
 	})
 }
 
-// LookupTracepointConfig probes
-// /sys/kernel/debug/tracing/events/<category>/<event>/id for the Attr.Config
-// value associated with the specified category and event.
+// LookupTracepointConfig probes <tracefs>/events/<category>/<event>/id for
+// the Attr.Config value associated with the specified category and event.
+// The root of the tracing file system is given by TracefsRoot.
 func LookupTracepointConfig(category, event string) (uint64, error) {
-	p := filepath.Join("/sys/kernel/debug/tracing/events", category, event, "id")
+	p, err := tracefsPath("events", category, event, "id")
+	if err != nil {
+		return 0, err
+	}
 	return readUint(p, 64)
 }
 
@@ -1217,7 +1521,7 @@ func (opt Options) marshal() uint64 {
 	if opt.PreciseIP&0x01 != 0 {
 		val |= 1 << skidlsb
 	}
-	if opt.PreciseIP&0x10 != 0 {
+	if opt.PreciseIP&0x02 != 0 {
 		val |= 1 << skidmsb
 	}
 
@@ -1402,7 +1706,8 @@ func (el eventLabel) String() string {
 }
 
 type eventID struct {
-	Type, Config uint64
+	Type, Config     uint64
+	Config1, Config2 uint64
 }
 
 var eventLabels sync.Map // of eventID to eventLabel
@@ -1428,6 +1733,12 @@ func init() {
 }
 
 func lookupLabel(id eventID) eventLabel {
+	switch EventType(id.Type) {
+	case HardwareEvent, HardwareCacheEvent:
+		// Strip the extended PMU type, which selects a core PMU on
+		// hybrid CPUs, and does not change the identity of the event.
+		id.Config &= 1<<pmuTypeShift - 1
+	}
 	v, ok := eventLabels.Load(id)
 	if ok {
 		return v.(eventLabel)
@@ -1437,8 +1748,88 @@ func lookupLabel(id eventID) eventLabel {
 	return label
 }
 
+// lookupLabelInSysfs computes the label for an event which is not a
+// generic hardware or software event. Hardware cache events are named
+// according to the scheme used by the perf tool. Tracepoints are looked up
+// by ID in the tracing file system. Events on other PMUs, including raw
+// events on the cpu PMU, are matched against the event aliases the PMU
+// describes in sysfs. Raw events which do not match an alias are named
+// using the r<config> syntax.
 func lookupLabelInSysfs(id eventID) eventLabel {
+	switch EventType(id.Type) {
+	case HardwareCacheEvent:
+		hwcc := hardwareCacheCounterFromConfig(id.Config)
+		return eventLabel{Name: hwcc.String()}
+	case TracepointEvent:
+		return lookupTracepointLabel(id)
+	case BreakpointEvent:
+		return eventLabel{}
+	}
+	name, err := lookupPMUName(EventType(id.Type))
+	if err != nil {
+		return eventLabel{}
+	}
+	if label, ok := lookupPMUEventLabel(name, id); ok {
+		return label
+	}
+	if EventType(id.Type) == RawEvent && id.Config1 == 0 && id.Config2 == 0 {
+		return eventLabel{Name: RawCounter(id.Config).String()}
+	}
 	return eventLabel{}
 }
 
-// BUG(acln): generic Attr.Label lookup is not implemented
+// lookupPMUEventLabel searches the events described by the named PMU for
+// an event matching id. The label is of the form "<pmu>/<event>/", which
+// is how ``perf list'' names such events.
+func lookupPMUEventLabel(name string, id eventID) (eventLabel, bool) {
+	pmu, err := LookupPMU(name)
+	if err != nil {
+		return eventLabel{}, false
+	}
+	for _, ev := range pmu.EventNames() {
+		var a Attr
+		if err := pmu.Encode(&a, ev); err != nil {
+			continue
+		}
+		evID := eventID{
+			Type:    uint64(a.Type),
+			Config:  a.Config,
+			Config1: a.Config1,
+			Config2: a.Config2,
+		}
+		if evID == id {
+			return eventLabel{Name: fmt.Sprintf("%s/%s/", name, ev)}, true
+		}
+	}
+	return eventLabel{}, false
+}
+
+// lookupTracepointLabel searches the tracing file system for the tracepoint
+// identified by id. All the tracepoints found along the way are stored in
+// eventLabels, such that later lookups are served from the cache.
+func lookupTracepointLabel(id eventID) eventLabel {
+	pattern, err := tracefsPath("events", "*", "*", "id")
+	if err != nil {
+		return eventLabel{}
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return eventLabel{}
+	}
+	var found eventLabel
+	for _, path := range paths {
+		config, err := readUint(path, 64)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Dir(path)
+		category, event := filepath.Base(filepath.Dir(dir)), filepath.Base(dir)
+		label := eventLabel{Name: fmt.Sprintf("%s:%s", category, event)}
+		evID := eventID{Type: uint64(TracepointEvent), Config: config}
+		eventLabels.Store(evID, label)
+		if evID == id {
+			found = label
+		}
+	}
+	return found
+}
@@ -6,6 +6,7 @@ package perf
 
 // doEnableRunDisable enables the counters, executes f, and disables them. It is
 // implemented in assembly to minimize non-deterministic overhead. It is assumed
-// that perfFD is known to be a valid file descriptor at the time of the call,
-// no error checking occurs.
-func doEnableRunDisable(perfFD uintptr, f func())
+// that fd is known to be a valid file descriptor at the time of the call,
+// no error checking occurs. flag is passed as the argument to the ioctls:
+// either 0, or PERF_IOC_FLAG_GROUP to operate on the entire group.
+func doEnableRunDisable(fd uintptr, flag uintptr, f func())
@@ -48,6 +48,51 @@ func ExampleHardwareCounter_iPC() {
 		sum, gc.Running, insns, cycles, float64(insns)/float64(cycles))
 }
 
+func ExampleMetricSet_iPC() {
+	var ms perf.MetricSet
+	for _, m := range perf.BuiltinMetrics() {
+		if m.Name == "IPC" || m.Name == "CPI" {
+			ms.Add(m)
+		}
+	}
+
+	g := perf.Group{
+		CountFormat: perf.CountFormat{
+			Enabled: true,
+			Running: true,
+		},
+	}
+	if err := ms.AddTo(&g); err != nil {
+		log.Fatal(err)
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ev, err := g.Open(perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ev.Close()
+
+	sum := 0
+	gc, err := ev.MeasureGroup(func() {
+		for i := 0; i < 100000; i++ {
+			sum += i
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, mv := range ms.Evaluate(gc) {
+		if mv.Err != nil {
+			log.Fatal(mv.Err)
+		}
+		fmt.Printf("%s: %.2f %s\n", mv.Name, mv.Value, mv.Unit)
+	}
+}
+
 func ExampleSoftwareCounter_pageFaults() {
 	pfa := new(perf.Attr)
 	perf.PageFaults.Configure(pfa)
@@ -14,14 +14,16 @@ import (
 
 // doEnableRunDisable enables the counters, executes f, and disables them. Where
 // possible it is implemented in assembly to minimize non-deterministic
-// overhead. It is assumed that perfFD is known to be a valid file descriptor at
-// the time of the call, no error checking occurs.
-func doEnableRunDisable(fd uintptr, f func()) {
+// overhead. It is assumed that fd is known to be a valid file descriptor at
+// the time of the call, no error checking occurs. flag is passed as the
+// argument to the ioctls: either 0, or PERF_IOC_FLAG_GROUP to operate on
+// the entire group.
+func doEnableRunDisable(fd uintptr, flag uintptr, f func()) {
 	// syscall.RawSyscall is the most economic way we can do this
 	// generically. It's one branch less than unix.RawSyscall, and many
 	// instructions less than the generic unix.Syscall, which must notify
 	// the runtime by eventually calling runtime.{enter,exit}syscall.
-	syscall.RawSyscall(unix.SYS_IOCTL, fd, uintptr(unix.PERF_EVENT_IOC_ENABLE), 0)
+	syscall.RawSyscall(unix.SYS_IOCTL, fd, uintptr(unix.PERF_EVENT_IOC_ENABLE), flag)
 	f()
-	syscall.RawSyscall(unix.SYS_IOCTL, fd, uintptr(unix.PERF_EVENT_IOC_DISABLE), 0)
+	syscall.RawSyscall(unix.SYS_IOCTL, fd, uintptr(unix.PERF_EVENT_IOC_DISABLE), flag)
 }
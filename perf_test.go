@@ -5,7 +5,6 @@
 package perf_test
 
 import (
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -25,6 +24,9 @@ func TestOpen(t *testing.T) {
 	t.Run("BadGroup", testOpenBadGroup)
 	t.Run("BadAttrType", testOpenBadAttrType)
 	t.Run("PopulatesLabel", testOpenPopulatesLabel)
+	t.Run("PopulatesCacheLabel", testOpenPopulatesCacheLabel)
+	t.Run("PopulatesRawLabel", testOpenPopulatesRawLabel)
+	t.Run("PopulatesPMUEventLabel", testOpenPopulatesPMUEventLabel)
 	t.Run("EventIDsDifferentByCPU", testEventIDsDifferentByCPU)
 }
 
@@ -68,7 +70,6 @@ func testOpenBadAttrType(t *testing.T) {
 }
 
 func testOpenPopulatesLabel(t *testing.T) {
-	// TODO(acln): extend when we implement general label lookup
 	requires(t, paranoid(1), hardwarePMU)
 
 	runtime.LockOSThread()
@@ -94,6 +95,91 @@ func testOpenPopulatesLabel(t *testing.T) {
 	}
 }
 
+func testOpenPopulatesCacheLabel(t *testing.T) {
+	requires(t, paranoid(1), hardwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	hwca := &perf.Attr{
+		Type:   perf.HardwareCacheEvent,
+		Config: 0x10000, // L1D, Read, Miss
+	}
+	l1dmisses, err := perf.Open(hwca, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1dmisses.Close()
+
+	c, err := l1dmisses.Measure(getpidTrigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "L1-dcache-load-misses"; c.Label != want {
+		t.Fatalf("got label %q, want %q", c.Label, want)
+	}
+}
+
+func testOpenPopulatesRawLabel(t *testing.T) {
+	requires(t, paranoid(1), hardwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// 0xc0 is INST_RETIRED.ANY_P on Intel CPUs and
+	// ex_ret_instr on AMD CPUs.
+	ra := &perf.Attr{
+		Type:   perf.RawEvent,
+		Config: 0xc0,
+	}
+	insns, err := perf.Open(ra, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer insns.Close()
+
+	c, err := insns.Measure(getpidTrigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label == "" {
+		t.Fatal("Open did not set label for raw event")
+	}
+}
+
+func testOpenPopulatesPMUEventLabel(t *testing.T) {
+	requires(t, paranoid(0), pmu("msr"))
+
+	msr, err := perf.LookupPMU("msr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msr.Events["tsc"]; !ok {
+		t.Skip("msr PMU does not describe the tsc event")
+	}
+	ta := new(perf.Attr)
+	if err := msr.Encode(ta, "tsc"); err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	tsc, err := perf.Open(ta, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tsc.Close()
+
+	c, err := tsc.Measure(getpidTrigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "msr/tsc/"; c.Label != want {
+		t.Fatalf("got label %q, want %q", c.Label, want)
+	}
+}
+
 func testEventIDsDifferentByCPU(t *testing.T) {
 	requires(t, paranoid(1))
 
@@ -152,13 +238,6 @@ type perfTestEnv struct {
 		value int
 	}
 
-	debugfs struct {
-		sync.Once
-		mounted  bool
-		readable bool
-		readErr  error
-	}
-
 	pmu struct {
 		sync.Mutex
 		ok      map[string]struct{}
@@ -223,30 +302,6 @@ func (env *perfTestEnv) initParanoid() {
 	env.paranoid.value = int(paranoid)
 }
 
-func (env *perfTestEnv) initDebugfs() {
-	_, err := os.Stat("/sys/kernel/debug")
-	if err != nil {
-		return
-	}
-	env.debugfs.mounted = true
-	_, err = ioutil.ReadDir("/sys/kernel/debug")
-	if err != nil {
-		env.debugfs.readErr = err
-		return
-	}
-	env.debugfs.readable = true
-}
-
-func (env *perfTestEnv) debugfsMounted() bool {
-	env.debugfs.Once.Do(env.initDebugfs)
-	return env.debugfs.mounted
-}
-
-func (env *perfTestEnv) debugfsReadable() (bool, error) {
-	env.debugfs.Once.Do(env.initDebugfs)
-	return env.debugfs.readable, env.debugfs.readErr
-}
-
 func (env *perfTestEnv) havePMU(u string) (bool, error) {
 	env.pmu.Lock()
 	defer env.pmu.Unlock()
@@ -294,21 +349,16 @@ func (p paranoid) Evaluate() error {
 	return nil
 }
 
-// debugfsreq specifies a debugfs requirement for a test: debugfs must be
-// mounted at /sys/kernel/debug, and it must be readable.
-type debugfsreq struct{}
+// tracefsreq specifies a tracefs requirement for a test: the tracing file
+// system must be mounted, and it must be readable.
+type tracefsreq struct{}
 
-func (debugfsreq) Evaluate() error {
-	if !testenv.debugfsMounted() {
-		return errors.New("debugfs is not mounted at /sys/kernel/debug")
-	}
-	if ok, err := testenv.debugfsReadable(); !ok {
-		return fmt.Errorf("debugfs is not readable: %v", err)
-	}
-	return nil
+func (tracefsreq) Evaluate() error {
+	_, err := perf.TracefsRoot()
+	return err
 }
 
-var debugfs = debugfsreq{}
+var tracefs = tracefsreq{}
 
 // pmu specifies a PMU requirement for a test.
 type pmu string
@@ -0,0 +1,351 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A Planner splits a set of events into groups which the PMU can schedule
+// at the same time, then opens all the groups together.
+//
+// A group asking for more hardware counters than the PMU has fails to
+// open, or opens but never runs. A Planner detects such limits by trial:
+// it opens candidate groups on the calling thread, and checks that they
+// open successfully, and that they are scheduled when enabled. Groups
+// which are opened together are multiplexed by the kernel, so the counts
+// read from a planned set carry a multiplexing ratio.
+type Planner struct {
+	// CountFormat configures the format of counts read from the groups.
+	// The Enabled and Running options are set automatically.
+	CountFormat CountFormat
+
+	// Options configures options for all events.
+	Options Options
+
+	// ClockID configures the clock for samples.
+	ClockID int32
+
+	// OpenOptions configures how the events are opened.
+	OpenOptions OpenOptions
+
+	// MaxGroupSize, if non-zero, limits the number of events in
+	// each group, in addition to the limits detected by trial.
+	MaxGroupSize int
+
+	units []planUnit
+	n     int // number of events added so far
+}
+
+// planUnit is a set of events which must be scheduled together.
+type planUnit struct {
+	cfgs  []Configurator
+	first int // index of the first event in the unit
+}
+
+// Add adds events to the planner. The events may be placed in different
+// groups.
+func (p *Planner) Add(cfgs ...Configurator) {
+	for _, cfg := range cfgs {
+		p.AddTogether(cfg)
+	}
+}
+
+// AddTogether adds a set of events which must be placed in the same
+// group, for example because they are used to compute a ratio.
+func (p *Planner) AddTogether(cfgs ...Configurator) {
+	if len(cfgs) == 0 {
+		return
+	}
+	p.units = append(p.units, planUnit{cfgs: cfgs, first: p.n})
+	p.n += len(cfgs)
+}
+
+// Plan is the result of planning: a list of groups, each of which the
+// PMU can schedule on its own.
+type Plan struct {
+	// Groups holds the planned groups.
+	Groups []*Group
+
+	// events[i] holds the indices of the events in Groups[i], in the
+	// order in which they were added to the Planner.
+	events [][]int
+	n      int
+}
+
+// Plan splits the events into groups. Events are placed in the first
+// group they fit in, in the order in which they were added.
+//
+// Plan opens trial groups on the calling thread, on any CPU. An error is
+// returned if a set of events added by AddTogether does not fit in a group
+// on its own, or if an event fails to open for reasons unrelated to
+// counter limits.
+func (p *Planner) Plan() (*Plan, error) {
+	if len(p.units) == 0 {
+		return nil, errors.New("perf: no events to plan")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var placed [][]planUnit
+	for _, u := range p.units {
+		fit := false
+		for i := range placed {
+			candidate := append(placed[i][:len(placed[i]):len(placed[i])], u)
+			ok, err := p.fits(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				placed[i] = candidate
+				fit = true
+				break
+			}
+		}
+		if fit {
+			continue
+		}
+		alone := []planUnit{u}
+		ok, err := p.fits(alone)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("perf: events %d through %d cannot be scheduled together", u.first, u.first+len(u.cfgs)-1)
+		}
+		placed = append(placed, alone)
+	}
+
+	plan := &Plan{n: p.n}
+	for _, units := range placed {
+		plan.Groups = append(plan.Groups, p.group(units))
+		var events []int
+		for _, u := range units {
+			for i := range u.cfgs {
+				events = append(events, u.first+i)
+			}
+		}
+		plan.events = append(plan.events, events)
+	}
+	return plan, nil
+}
+
+// Open plans the events, then opens the planned groups. See Plan.Open.
+func (p *Planner) Open(pid int, cpu int) (*PlannedSet, error) {
+	plan, err := p.Plan()
+	if err != nil {
+		return nil, err
+	}
+	return plan.Open(pid, cpu)
+}
+
+// group creates a group holding the events in units.
+func (p *Planner) group(units []planUnit) *Group {
+	g := &Group{
+		CountFormat: p.CountFormat,
+		Options:     p.Options,
+		ClockID:     p.ClockID,
+		OpenOptions: p.OpenOptions,
+	}
+	g.CountFormat.Enabled = true
+	g.CountFormat.Running = true
+	for _, u := range units {
+		g.Add(u.cfgs...)
+	}
+	return g
+}
+
+// fits reports whether the events in units can be scheduled as a group.
+// The calling goroutine must be locked to its thread.
+func (p *Planner) fits(units []planUnit) (bool, error) {
+	if p.MaxGroupSize > 0 {
+		n := 0
+		for _, u := range units {
+			n += len(u.cfgs)
+		}
+		if n > p.MaxGroupSize {
+			return false, nil
+		}
+	}
+
+	g := p.group(units)
+	g.Options.Disabled = true
+	leader, err := g.Open(CallingThread, AnyCPU)
+	if err != nil {
+		// The kernel reports ENOSPC, or EINVAL on some architectures,
+		// when a group validates but cannot fit on the PMU. Don't
+		// blame the limit on single units: their errors are real.
+		if len(units) > 1 && tooManyCounters(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer leader.Close()
+	gc, err := leader.MeasureGroup(planTrialWork)
+	if err != nil {
+		return false, err
+	}
+	if gc.Enabled > 0 && gc.Running == 0 {
+		return false, nil
+	}
+	return true, nil
+}
+
+// tooManyCounters reports whether err indicates that a group asked for
+// more counters than the PMU has.
+func tooManyCounters(err error) bool {
+	oe, ok := err.(*OpenError)
+	return ok && (oe.Errno == unix.ENOSPC || oe.Errno == unix.EINVAL)
+}
+
+// planTrialWork gives trial groups a chance to be scheduled.
+func planTrialWork() {
+	for i := 0; i < 100; i++ {
+		unix.Getpid()
+	}
+}
+
+// Open opens the planned groups. See Open for the meaning of pid and cpu.
+func (plan *Plan) Open(pid int, cpu int) (*PlannedSet, error) {
+	ps := &PlannedSet{plan: plan}
+	for _, g := range plan.Groups {
+		leader, err := g.Open(pid, cpu)
+		if err != nil {
+			ps.Close()
+			return nil, err
+		}
+		ps.leaders = append(ps.leaders, leader)
+	}
+	return ps, nil
+}
+
+// PlannedSet is a set of planned groups, opened together.
+type PlannedSet struct {
+	plan    *Plan
+	leaders []*Event
+}
+
+// Plan returns the plan the set was opened from.
+func (ps *PlannedSet) Plan() *Plan {
+	return ps.plan
+}
+
+// Leaders returns the group leaders, one for each of the planned groups.
+func (ps *PlannedSet) Leaders() []*Event {
+	return ps.leaders
+}
+
+// Enable enables all groups.
+func (ps *PlannedSet) Enable() error {
+	return ps.each((*Event).EnableGroup)
+}
+
+// Disable disables all groups.
+func (ps *PlannedSet) Disable() error {
+	return ps.each((*Event).DisableGroup)
+}
+
+// Reset resets the counters of all groups.
+func (ps *PlannedSet) Reset() error {
+	return ps.each((*Event).ResetGroup)
+}
+
+// Close closes all groups. It returns the first error encountered, if any.
+func (ps *PlannedSet) Close() error {
+	var first error
+	for _, leader := range ps.leaders {
+		if err := leader.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (ps *PlannedSet) each(fn func(*Event) error) error {
+	var first error
+	for i, leader := range ps.leaders {
+		if err := fn(leader); err != nil && first == nil {
+			first = fmt.Errorf("perf: planned group %d: %v", i, err)
+		}
+	}
+	return first
+}
+
+// PlannedCount is a measurement of a single planned event.
+type PlannedCount struct {
+	Label string
+	Value uint64
+
+	// Group is the index of the group the event was placed in, in
+	// Plan.Groups.
+	Group int
+
+	// Enabled and Running are the times the group was enabled and
+	// running for.
+	Enabled time.Duration
+	Running time.Duration
+
+	// Ratio is the multiplexing ratio of the group: Running divided by
+	// Enabled. It is 1 if the group ran for the whole time it was
+	// enabled, and 0 if it was never enabled.
+	Ratio float64
+}
+
+// Scaled scales pc to account for multiplexing.
+func (pc PlannedCount) Scaled() ScaledValue {
+	return scale(pc.Label, pc.Value, int64(pc.Enabled), int64(pc.Running))
+}
+
+// ReadCount reads the counts of all events, in the order in which they
+// were added to the Planner.
+func (ps *PlannedSet) ReadCount() ([]PlannedCount, error) {
+	counts := make([]PlannedCount, ps.plan.n)
+	for i, leader := range ps.leaders {
+		gc, err := leader.ReadGroupCount()
+		if err != nil {
+			return nil, fmt.Errorf("perf: planned group %d: %v", i, err)
+		}
+		var ratio float64
+		if gc.Enabled > 0 {
+			ratio = float64(gc.Running) / float64(gc.Enabled)
+		}
+		for j, v := range gc.Values {
+			counts[ps.plan.events[i][j]] = PlannedCount{
+				Label:   v.Label,
+				Value:   v.Value,
+				Group:   i,
+				Enabled: gc.Enabled,
+				Running: gc.Running,
+				Ratio:   ratio,
+			}
+		}
+	}
+	return counts, nil
+}
+
+// Measure disables and resets all groups, enables them, runs f, disables
+// them again, then reads the counts.
+func (ps *PlannedSet) Measure(f func()) ([]PlannedCount, error) {
+	if err := ps.Disable(); err != nil {
+		return nil, err
+	}
+	if err := ps.Reset(); err != nil {
+		return nil, err
+	}
+	if err := ps.Enable(); err != nil {
+		return nil, err
+	}
+	f()
+	if err := ps.Disable(); err != nil {
+		return nil, err
+	}
+	return ps.ReadCount()
+}
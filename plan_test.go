@@ -0,0 +1,109 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"acln.ro/perf"
+)
+
+func TestPlanner(t *testing.T) {
+	t.Run("Split", testPlannerSplit)
+	t.Run("TogetherTooLarge", testPlannerTogetherTooLarge)
+	t.Run("HardwareCounterLimit", testPlannerHardwareCounterLimit)
+}
+
+func testPlannerSplit(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	p := &perf.Planner{
+		Options:      perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+		MaxGroupSize: 2,
+	}
+	p.Add(perf.TaskClock, perf.PageFaults, perf.CPUClock)
+	p.AddTogether(perf.MinorPageFaults, perf.MajorPageFaults)
+	ps, err := p.Open(perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if n := len(ps.Plan().Groups); n != 3 {
+		t.Fatalf("got %d groups, want 3", n)
+	}
+
+	counts, err := ps.Measure(func() { spin(5 * time.Millisecond) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := []string{"task-clock", "page-faults", "cpu-clock", "minor-faults", "major-faults"}
+	wantGroups := []int{0, 0, 1, 2, 2}
+	if len(counts) != len(wantLabels) {
+		t.Fatalf("got %d counts, want %d", len(counts), len(wantLabels))
+	}
+	for i, c := range counts {
+		if c.Label != wantLabels[i] {
+			t.Errorf("event %d: got label %q, want %q", i, c.Label, wantLabels[i])
+		}
+		if c.Group != wantGroups[i] {
+			t.Errorf("%s: got group %d, want %d", c.Label, c.Group, wantGroups[i])
+		}
+		if c.Ratio <= 0 || c.Ratio > 1 {
+			t.Errorf("%s: got multiplexing ratio %v, want in (0, 1]", c.Label, c.Ratio)
+		}
+	}
+	if counts[0].Value == 0 {
+		t.Error("task-clock did not count")
+	}
+}
+
+func testPlannerTogetherTooLarge(t *testing.T) {
+	requires(t, paranoid(1), softwarePMU)
+
+	p := &perf.Planner{
+		Options:      perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+		MaxGroupSize: 1,
+	}
+	p.AddTogether(perf.TaskClock, perf.PageFaults)
+	if _, err := p.Plan(); err == nil {
+		t.Fatal("planned a must-be-together set larger than the group limit")
+	}
+}
+
+func testPlannerHardwareCounterLimit(t *testing.T) {
+	requires(t, paranoid(1), hardwarePMU)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	p := &perf.Planner{
+		Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+	for i := 0; i < 20; i++ {
+		p.Add(perf.Instructions)
+	}
+	ps, err := p.Open(perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if len(ps.Plan().Groups) < 2 {
+		t.Fatal("20 hardware events fit in a single group")
+	}
+	counts, err := ps.Measure(func() { spin(20 * time.Millisecond) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range counts {
+		if c.Running == 0 {
+			t.Errorf("event %d in group %d never ran", i, c.Group)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pmuDevicesDir is the sysfs directory under which the kernel registers
+// performance monitoring units.
+const pmuDevicesDir = "/sys/bus/event_source/devices"
+
+// PMU is a performance monitoring unit, as described by the kernel under
+// /sys/bus/event_source/devices/<name>.
+//
+// Dynamic PMUs, such as uncore, kprobe, uprobe, msr or power PMUs, publish
+// the layout of their event configuration in the format directory, and
+// named events in the events directory. PMU uses this information to encode
+// events specified using name=value terms, for example:
+//
+//	cpu, err := perf.LookupPMU("cpu")
+//	// ...
+//	ld, err := cpu.Event("event=0xcd,umask=0x1,ldlat=3")
+//	// ...
+//	mem, err := cpu.Event("mem-loads,ldlat=30")
+type PMU struct {
+	// Name is the name of the PMU, e.g. "cpu" or "uncore_imc_0".
+	Name string
+
+	// Type is the event type associated with the PMU.
+	Type EventType
+
+	// Formats maps term names to the layout of the corresponding bit
+	// fields, as described by the files in the format directory.
+	Formats map[string]PMUFormat
+
+	// Events maps event names to the terms which describe them, as
+	// found in the files in the events directory, e.g. "event=0x3c".
+	Events map[string]string
+
+	// Scales maps event names to the factor by which their counts must be
+	// multiplied to obtain a value in the unit given by Units, as found
+	// in the <event>.scale files in the events directory.
+	Scales map[string]float64
+
+	// Units maps event names to the unit of their scaled values, e.g.
+	// "MiB" or "Joules", as found in the <event>.unit files.
+	Units map[string]string
+
+	// CPUMask lists the CPUs on which events for the PMU should be
+	// opened, as found in the cpumask file. It is set for uncore PMUs,
+	// which count system-wide, and do not support per-task events or
+	// sampling.
+	CPUMask []int
+
+	// CPUs lists the CPUs the PMU counts on, as found in the cpus file.
+	// It is set for the core PMUs of hybrid CPUs, such as cpu_core and
+	// cpu_atom, each of which only counts on CPUs of its own core type.
+	CPUs []int
+}
+
+// LookupPMU loads the description of the named PMU from
+// /sys/bus/event_source/devices/<name>.
+func LookupPMU(name string) (*PMU, error) {
+	return LoadPMU(filepath.Join(pmuDevicesDir, name))
+}
+
+// LoadPMU loads the description of a PMU from the specified sysfs
+// directory. The name of the PMU is the last element of dir.
+func LoadPMU(dir string) (*PMU, error) {
+	pmu := &PMU{
+		Name:    filepath.Base(dir),
+		Formats: map[string]PMUFormat{},
+		Events:  map[string]string{},
+		Scales:  map[string]float64{},
+		Units:   map[string]string{},
+	}
+	typ, err := readUint(filepath.Join(dir, "type"), 32)
+	if err != nil {
+		return nil, fmt.Errorf("perf: unknown PMU %q: %v", pmu.Name, err)
+	}
+	pmu.Type = EventType(typ)
+
+	formats, err := readDirFiles(filepath.Join(dir, "format"))
+	if err != nil {
+		return nil, fmt.Errorf("perf: PMU %s: %v", pmu.Name, err)
+	}
+	for name, content := range formats {
+		f, err := ParsePMUFormat(content)
+		if err != nil {
+			return nil, fmt.Errorf("perf: PMU %s: format %s: %v", pmu.Name, name, err)
+		}
+		pmu.Formats[name] = f
+	}
+
+	events, err := readDirFiles(filepath.Join(dir, "events"))
+	if err != nil {
+		return nil, fmt.Errorf("perf: PMU %s: %v", pmu.Name, err)
+	}
+	for name, content := range events {
+		switch {
+		case strings.HasSuffix(name, ".scale"):
+			scale, err := strconv.ParseFloat(content, 64)
+			if err != nil {
+				return nil, fmt.Errorf("perf: PMU %s: event attribute %s: %v", pmu.Name, name, err)
+			}
+			pmu.Scales[strings.TrimSuffix(name, ".scale")] = scale
+			continue
+		case strings.HasSuffix(name, ".unit"):
+			pmu.Units[strings.TrimSuffix(name, ".unit")] = content
+			continue
+		case isEventAttributeFile(name):
+			continue
+		}
+		pmu.Events[name] = content
+	}
+
+	mask, err := ioutil.ReadFile(filepath.Join(dir, "cpumask"))
+	if err == nil {
+		pmu.CPUMask, err = parseCPUList(string(mask))
+		if err != nil {
+			return nil, fmt.Errorf("perf: PMU %s: cpumask: %v", pmu.Name, err)
+		}
+	}
+
+	cpus, err := ioutil.ReadFile(filepath.Join(dir, "cpus"))
+	if err == nil {
+		pmu.CPUs, err = parseCPUList(string(cpus))
+		if err != nil {
+			return nil, fmt.Errorf("perf: PMU %s: cpus: %v", pmu.Name, err)
+		}
+	}
+
+	return pmu, nil
+}
+
+// LoadPMUs loads the descriptions of all the PMUs in the specified sysfs
+// directory, usually /sys/bus/event_source/devices. The PMUs are sorted
+// by name. PMUs which cannot be loaded, for example because they describe
+// their events using an unknown format, are skipped.
+func LoadPMUs(dir string) ([]*PMU, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var pmus []*PMU
+	for _, info := range infos {
+		pmu, err := LoadPMU(filepath.Join(dir, info.Name()))
+		if err != nil {
+			continue
+		}
+		pmus = append(pmus, pmu)
+	}
+	return pmus, nil
+}
+
+// Event returns a Configurator for an event on the PMU, specified by a
+// comma separated list of terms. Each term is either a name=value pair,
+// or a name on its own. The name may be the name of a format, a named
+// event, or one of the generic terms config, config1, config2, period,
+// freq and name. A format name on its own stands for name=1. Named events
+// expand to the terms that describe them, and may be combined with other
+// terms.
+//
+// Event validates the terms against the formats of the PMU: unknown terms
+// and values which do not fit in the associated bit fields are reported as
+// errors.
+//
+// The Configurator sets the Label field to "<pmu>/<terms>/", unless the
+// name term is used, in which case its value is used as the label.
+func (pmu *PMU) Event(terms string) (Configurator, error) {
+	ts, err := parsePMUTerms(terms)
+	if err != nil {
+		return nil, fmt.Errorf("perf: PMU %s: %v", pmu.Name, err)
+	}
+	if err := pmu.configure(new(Attr), ts); err != nil {
+		return nil, err
+	}
+	label := fmt.Sprintf("%s/%s/", pmu.Name, terms)
+	return configuratorFunc(func(attr *Attr) error {
+		attr.Label = label
+		return pmu.configure(attr, ts)
+	}), nil
+}
+
+// Encode encodes terms into the Type, Config, Config1 and Config2 fields
+// of attr, as described in the documentation for Event.
+func (pmu *PMU) Encode(attr *Attr, terms string) error {
+	ts, err := parsePMUTerms(terms)
+	if err != nil {
+		return fmt.Errorf("perf: PMU %s: %v", pmu.Name, err)
+	}
+	return pmu.configure(attr, ts)
+}
+
+// EventNames returns the names of the events described by the PMU, in
+// sorted order.
+func (pmu *PMU) EventNames() []string {
+	names := make([]string, 0, len(pmu.Events))
+	for name := range pmu.Events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configure encodes terms into attr.
+func (pmu *PMU) configure(attr *Attr, terms []pmuTerm) error {
+	attr.Type = pmu.Type
+	return pmu.encodeTerms(attr, terms, true)
+}
+
+// encodeTerms encodes terms into attr. If expand is set, named events are
+// expanded into the terms describing them.
+func (pmu *PMU) encodeTerms(attr *Attr, terms []pmuTerm, expand bool) error {
+	for _, t := range terms {
+		switch t.name {
+		case "config":
+			attr.Config = t.val
+		case "config1":
+			attr.Config1 = t.val
+		case "config2":
+			attr.Config2 = t.val
+		case "period":
+			attr.SetSamplePeriod(t.val)
+		case "freq":
+			attr.SetSampleFreq(t.val)
+		case "name":
+			attr.Label = t.str
+		default:
+			if f, ok := pmu.Formats[t.name]; ok {
+				if err := f.Encode(attr, t.val); err != nil {
+					return fmt.Errorf("perf: PMU %s: term %s: %v", pmu.Name, t.name, err)
+				}
+				continue
+			}
+			if ev, ok := pmu.Events[t.name]; ok && expand && t.bare {
+				evterms, err := parsePMUTerms(ev)
+				if err != nil {
+					return fmt.Errorf("perf: PMU %s: event %s: %v", pmu.Name, t.name, err)
+				}
+				if err := pmu.encodeTerms(attr, evterms, false); err != nil {
+					return err
+				}
+				continue
+			}
+			return fmt.Errorf("perf: PMU %s: unknown term %q (known terms: %s)",
+				pmu.Name, t.name, strings.Join(pmu.termNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// termNames returns the names of the formats known to the PMU, in sorted
+// order.
+func (pmu *PMU) termNames() []string {
+	names := make([]string, 0, len(pmu.Formats))
+	for name := range pmu.Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PMUFormat describes how the value of a named PMU term is laid out in the
+// Config, Config1 or Config2 fields of an Attr.
+//
+// Some PMUs describe terms in the config3 field, which was added to the
+// kernel's perf_event_attr after Config2. Such formats are parsed, so that
+// the PMU can be loaded, but encoding values into them is not supported.
+type PMUFormat struct {
+	// Field is the name of the field: "config", "config1", "config2"
+	// or "config3".
+	Field string
+
+	// Bits are the bit ranges which make up the value, in order: the
+	// low order bits of the value are placed in the first range.
+	Bits []BitRange
+}
+
+// BitRange is an inclusive range of bits.
+type BitRange struct {
+	Lo, Hi uint
+}
+
+// ParsePMUFormat parses a format specification, as found in the files
+// under /sys/bus/event_source/devices/<pmu>/format. Examples of valid
+// specifications are "config:0-7", "config1:8" and "config:0-7,32-35".
+func ParsePMUFormat(s string) (PMUFormat, error) {
+	s = strings.TrimSpace(s)
+	colon := strings.Index(s, ":")
+	if colon < 0 {
+		return PMUFormat{}, fmt.Errorf("bad PMU format %q", s)
+	}
+	f := PMUFormat{Field: s[:colon]}
+	switch f.Field {
+	case "config", "config1", "config2", "config3":
+	default:
+		return PMUFormat{}, fmt.Errorf("bad PMU format %q: unknown field %q", s, f.Field)
+	}
+	for _, rs := range strings.Split(s[colon+1:], ",") {
+		var r BitRange
+		bounds := strings.SplitN(rs, "-", 2)
+		lo, err := strconv.ParseUint(bounds[0], 10, 6)
+		if err != nil {
+			return PMUFormat{}, fmt.Errorf("bad PMU format %q: %v", s, err)
+		}
+		r.Lo, r.Hi = uint(lo), uint(lo)
+		if len(bounds) == 2 {
+			hi, err := strconv.ParseUint(bounds[1], 10, 6)
+			if err != nil {
+				return PMUFormat{}, fmt.Errorf("bad PMU format %q: %v", s, err)
+			}
+			r.Hi = uint(hi)
+		}
+		if r.Hi < r.Lo {
+			return PMUFormat{}, fmt.Errorf("bad PMU format %q: bad bit range", s)
+		}
+		f.Bits = append(f.Bits, r)
+	}
+	return f, nil
+}
+
+// Width returns the total number of bits described by the format.
+func (f PMUFormat) Width() uint {
+	var n uint
+	for _, r := range f.Bits {
+		n += r.Hi - r.Lo + 1
+	}
+	return n
+}
+
+// Encode sets the bits described by the format to val, in the
+// corresponding field of attr. If val does not fit in the bits described
+// by the format, Encode returns an error.
+func (f PMUFormat) Encode(attr *Attr, val uint64) error {
+	if n := f.Width(); n < 64 && val>>n != 0 {
+		return fmt.Errorf("value %#x does not fit in %d bits", val, n)
+	}
+	var field *uint64
+	switch f.Field {
+	case "config":
+		field = &attr.Config
+	case "config1":
+		field = &attr.Config1
+	case "config2":
+		field = &attr.Config2
+	case "config3":
+		return errors.New("field config3 is not supported")
+	default:
+		return fmt.Errorf("unknown field %q", f.Field)
+	}
+	for _, r := range f.Bits {
+		width := r.Hi - r.Lo + 1
+		mask := ^uint64(0)
+		if width < 64 {
+			mask = uint64(1)<<width - 1
+		}
+		*field &^= mask << r.Lo
+		*field |= (val & mask) << r.Lo
+		val >>= width
+	}
+	return nil
+}
+
+// Decode extracts the value described by the format from the
+// corresponding field of attr. Values in config3 always decode as zero.
+func (f PMUFormat) Decode(attr *Attr) uint64 {
+	var field uint64
+	switch f.Field {
+	case "config":
+		field = attr.Config
+	case "config1":
+		field = attr.Config1
+	case "config2":
+		field = attr.Config2
+	}
+	var val uint64
+	var shift uint
+	for _, r := range f.Bits {
+		width := r.Hi - r.Lo + 1
+		mask := ^uint64(0)
+		if width < 64 {
+			mask = uint64(1)<<width - 1
+		}
+		val |= ((field >> r.Lo) & mask) << shift
+		shift += width
+	}
+	return val
+}
+
+// pmuTerm is a term in a PMU event specification, such as event=0x3c.
+type pmuTerm struct {
+	name string
+	val  uint64
+	str  string // the value of the name term
+	bare bool   // the term was specified without a value
+}
+
+func parsePMUTerms(s string) ([]pmuTerm, error) {
+	var terms []pmuTerm
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	for _, ts := range strings.Split(s, ",") {
+		ts = strings.TrimSpace(ts)
+		if ts == "" {
+			return nil, fmt.Errorf("empty PMU term")
+		}
+		eq := strings.Index(ts, "=")
+		if eq < 0 {
+			// A bare term is either a flag, in which case
+			// term means term=1, or the name of an event.
+			terms = append(terms, pmuTerm{name: ts, val: 1, bare: true})
+			continue
+		}
+		t := pmuTerm{name: ts[:eq]}
+		if t.name == "name" {
+			t.str = ts[eq+1:]
+		} else {
+			val, err := strconv.ParseUint(ts[eq+1:], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad value for PMU term %q: %v", t.name, err)
+			}
+			t.val = val
+		}
+		terms = append(terms, t)
+	}
+	return terms, nil
+}
+
+// isEventAttributeFile returns a boolean indicating whether the named file
+// in a PMU events directory describes an attribute of an event (such as
+// its scale or unit), rather than an event.
+func isEventAttributeFile(name string) bool {
+	for _, suffix := range []string{".scale", ".unit", ".per-pkg", ".snapshot"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readDirFiles reads all the regular files in dir, and returns a map of
+// file names to their contents, stripped of surrounding white space. If
+// dir does not exist, readDirFiles returns an empty map.
+func readDirFiles(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[info.Name()] = strings.TrimSpace(string(content))
+	}
+	return files, nil
+}
+
+// parseCPUList parses a list of CPUs such as "0-3,8,10-11".
+func parseCPUList(s string) ([]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			hi, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if hi < lo {
+			return nil, fmt.Errorf("bad CPU range %q", part)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// lookupPMUName probes /sys/bus/event_source/devices/*/type for the PMU
+// associated with the specified EventType.
+func lookupPMUName(typ EventType) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(pmuDevicesDir, "*", "type"))
+	if err != nil {
+		return "", err
+	}
+	for _, path := range paths {
+		et, err := readUint(path, 32)
+		if err != nil {
+			continue
+		}
+		if EventType(et) == typ {
+			return filepath.Base(filepath.Dir(path)), nil
+		}
+	}
+	return "", fmt.Errorf("perf: no PMU for event type %d", typ)
+}
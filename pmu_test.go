@@ -0,0 +1,184 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"acln.ro/perf"
+)
+
+// fixtureDevices is the directory containing fixture PMUs.
+var fixtureDevices = filepath.Join("testdata", "sysfs", "bus", "event_source", "devices")
+
+func TestPMU(t *testing.T) {
+	t.Run("ParseFormat", testParsePMUFormat)
+	t.Run("Load", testLoadPMU)
+	t.Run("Encode", testPMUEncode)
+	t.Run("EncodeErrors", testPMUEncodeErrors)
+	t.Run("Lookup", testLookupPMU)
+	t.Run("Config3", testPMUConfig3)
+	t.Run("LoadSkipsBroken", testLoadPMUsSkipsBroken)
+}
+
+// fixtureMixedDevices is the directory containing a PMU which uses the
+// config3 field, and a PMU with an unknown format field.
+var fixtureMixedDevices = filepath.Join("testdata", "sysfs-mixed", "bus", "event_source", "devices")
+
+func testParsePMUFormat(t *testing.T) {
+	tests := []struct {
+		spec string
+		want perf.PMUFormat
+	}{
+		{"config:0-7", perf.PMUFormat{Field: "config", Bits: []perf.BitRange{{0, 7}}}},
+		{"config1:8", perf.PMUFormat{Field: "config1", Bits: []perf.BitRange{{8, 8}}}},
+		{"config:0-7,32-35\n", perf.PMUFormat{Field: "config", Bits: []perf.BitRange{{0, 7}, {32, 35}}}},
+	}
+	for _, tt := range tests {
+		got, err := perf.ParsePMUFormat(tt.spec)
+		if err != nil {
+			t.Errorf("ParsePMUFormat(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePMUFormat(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"", "config", "config4:0", "config:7-0", "config:x", "config:64"} {
+		if _, err := perf.ParsePMUFormat(spec); err == nil {
+			t.Errorf("ParsePMUFormat(%q) succeeded", spec)
+		}
+	}
+}
+
+func testLoadPMU(t *testing.T) {
+	pmu, err := perf.LoadPMU(filepath.Join(fixtureDevices, "cpu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmu.Name != "cpu" || pmu.Type != perf.RawEvent {
+		t.Errorf("got name %q, type %d, want %q, %d", pmu.Name, pmu.Type, "cpu", perf.RawEvent)
+	}
+	if len(pmu.Formats) != 7 {
+		t.Errorf("got %d formats, want 7", len(pmu.Formats))
+	}
+	want := []string{"cache-misses", "cpu-cycles", "mem-loads"}
+	if got := pmu.EventNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+}
+
+func testPMUEncode(t *testing.T) {
+	pmu, err := perf.LoadPMU(filepath.Join(fixtureDevices, "cpu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		terms           string
+		config, config1 uint64
+		label           string
+	}{
+		{"event=0x3c,umask=0x0", 0x3c, 0, "cpu/event=0x3c,umask=0x0/"},
+		{"event=0xc2,umask=0x1,inv,cmask=1", 0x18001c2, 0, "cpu/event=0xc2,umask=0x1,inv,cmask=1/"},
+		{"mem-loads", 0x1cd, 3, "cpu/mem-loads/"},
+		{"mem-loads,ldlat=30", 0x1cd, 30, "cpu/mem-loads,ldlat=30/"},
+		{"split=0xfff", 0xf000000ff, 0, "cpu/split=0xfff/"},
+		{"config=0x1234,name=custom", 0x1234, 0, "custom"},
+	}
+	for _, tt := range tests {
+		cfg, err := pmu.Event(tt.terms)
+		if err != nil {
+			t.Errorf("Event(%q): %v", tt.terms, err)
+			continue
+		}
+		a := new(perf.Attr)
+		if err := cfg.Configure(a); err != nil {
+			t.Errorf("%q: Configure: %v", tt.terms, err)
+			continue
+		}
+		if a.Type != perf.RawEvent || a.Config != tt.config || a.Config1 != tt.config1 {
+			t.Errorf("%q: got type %d, config %#x, config1 %#x, want %d, %#x, %#x",
+				tt.terms, a.Type, a.Config, a.Config1, perf.RawEvent, tt.config, tt.config1)
+		}
+		if a.Label != tt.label {
+			t.Errorf("%q: got label %q, want %q", tt.terms, a.Label, tt.label)
+		}
+	}
+
+	split := pmu.Formats["split"]
+	a := &perf.Attr{Config: 0xa000000bc}
+	if got := split.Decode(a); got != 0xabc {
+		t.Errorf("Decode: got %#x, want 0xabc", got)
+	}
+}
+
+func testPMUEncodeErrors(t *testing.T) {
+	pmu, err := perf.LoadPMU(filepath.Join(fixtureDevices, "cpu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, terms := range []string{
+		"event=0x100",
+		"bogus=1",
+		"edge=2",
+		"event=",
+		"umask=0x1,,event=1",
+		"mem-loads=1",
+	} {
+		if _, err := pmu.Event(terms); err == nil {
+			t.Errorf("Event(%q) succeeded", terms)
+		}
+	}
+}
+
+func testLookupPMU(t *testing.T) {
+	requires(t, softwarePMU)
+
+	pmu, err := perf.LookupPMU("software")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmu.Type != perf.SoftwareEvent {
+		t.Fatalf("got type %d, want %d", pmu.Type, perf.SoftwareEvent)
+	}
+	if _, err := perf.LookupPMU("no-such-pmu"); err == nil {
+		t.Fatal("LookupPMU succeeded for missing PMU")
+	}
+}
+
+func testPMUConfig3(t *testing.T) {
+	spe, err := perf.LoadPMU(filepath.Join(fixtureMixedDevices, "arm_spe_0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := spe.Formats["inv_event_filter"]
+	if f.Field != "config3" || f.Width() != 64 {
+		t.Fatalf("got format %+v, want config3:0-63", f)
+	}
+	if _, err := spe.Event("ts_enable"); err != nil {
+		t.Errorf("Event(ts_enable): %v", err)
+	}
+	if _, err := spe.Event("inv_event_filter=1"); err == nil {
+		t.Error("Event(inv_event_filter=1) succeeded, want config3 unsupported")
+	}
+}
+
+func testLoadPMUsSkipsBroken(t *testing.T) {
+	pmus, err := perf.LoadPMUs(fixtureMixedDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pmu := range pmus {
+		names = append(names, pmu.Name)
+	}
+	want := []string{"arm_spe_0", "cpu"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got PMUs %q, want %q", names, want)
+	}
+}
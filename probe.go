@@ -0,0 +1,120 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kprobe returns a Configurator for a kprobe on the kernel function fn,
+// at the specified offset from the start of the function. The probe is
+// created through the kprobe PMU (since Linux 4.17), and is removed
+// automatically when the event is closed.
+//
+// The returned Configurator sets the Label, Type, Config and Config2 fields
+// on attr. The kernel expects Config1 to point to the name of the function:
+// Open takes care of this, and keeps the name alive for the duration of the
+// perf_event_open system call.
+func Kprobe(fn string, offset uint64) Configurator {
+	label := "kprobe:" + fn
+	if offset != 0 {
+		label = fmt.Sprintf("%s+%#x", label, offset)
+	}
+	return dynamicProbe{
+		pmu:    "kprobe",
+		label:  label,
+		target: fn,
+		offset: offset,
+	}
+}
+
+// KprobeAddr returns a Configurator for a kprobe at the specified kernel
+// address. See Kprobe for more details.
+func KprobeAddr(addr uint64) Configurator {
+	return dynamicProbe{
+		pmu:    "kprobe",
+		label:  fmt.Sprintf("kprobe:%#x", addr),
+		offset: addr,
+	}
+}
+
+// Kretprobe returns a Configurator for a kretprobe on the kernel function
+// fn, which fires when fn returns. See Kprobe for more details.
+func Kretprobe(fn string) Configurator {
+	return dynamicProbe{
+		pmu:      "kprobe",
+		label:    "kretprobe:" + fn,
+		target:   fn,
+		retprobe: true,
+	}
+}
+
+// Uprobe returns a Configurator for a uprobe on the executable or library
+// at path, at the specified offset in the file. The probe is created
+// through the uprobe PMU (since Linux 4.17), and is removed automatically
+// when the event is closed.
+//
+// The returned Configurator sets the Label, Type, Config and Config2 fields
+// on attr. The kernel expects Config1 to point to the path: Open takes care
+// of this, and keeps the path alive for the duration of the perf_event_open
+// system call.
+func Uprobe(path string, offset uint64) Configurator {
+	return dynamicProbe{
+		pmu:    "uprobe",
+		label:  fmt.Sprintf("uprobe:%s:%#x", path, offset),
+		target: path,
+		offset: offset,
+	}
+}
+
+// Uretprobe returns a Configurator for a uretprobe on the function at the
+// specified offset in the executable or library at path, which fires when
+// the function returns. See Uprobe for more details.
+func Uretprobe(path string, offset uint64) Configurator {
+	return dynamicProbe{
+		pmu:      "uprobe",
+		label:    fmt.Sprintf("uretprobe:%s:%#x", path, offset),
+		target:   path,
+		offset:   offset,
+		retprobe: true,
+	}
+}
+
+// dynamicProbe is a probe created through the kprobe or uprobe PMUs.
+type dynamicProbe struct {
+	pmu      string
+	label    string
+	target   string // function name or path
+	offset   uint64 // offset or address
+	retprobe bool
+}
+
+// Configure implements the Configurator interface.
+func (dp dynamicProbe) Configure(attr *Attr) error {
+	if strings.IndexByte(dp.target, 0) >= 0 {
+		return fmt.Errorf("perf: %s: target %q contains NUL byte", dp.pmu, dp.target)
+	}
+	pmu, err := LookupPMU(dp.pmu)
+	if err != nil {
+		return err
+	}
+	attr.Label = dp.label
+	attr.Type = pmu.Type
+	attr.Config = 0
+	if dp.retprobe {
+		f, ok := pmu.Formats["retprobe"]
+		if !ok {
+			return fmt.Errorf("perf: %s PMU does not support return probes", dp.pmu)
+		}
+		if err := f.Encode(attr, 1); err != nil {
+			return err
+		}
+	}
+	attr.Config1 = 0
+	attr.Config2 = dp.offset
+	attr.probeTarget = dp.target
+	return nil
+}
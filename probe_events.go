@@ -0,0 +1,446 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ProbeEvent is a dynamic tracepoint, created by writing a probe definition
+// to the kprobe_events or uprobe_events files in the tracing file system.
+//
+// ProbeEvents are the legacy counterpart to Kprobe and Uprobe, for kernels
+// (or containers) where the kprobe and uprobe PMUs are not available. Once
+// created, a ProbeEvent is a regular tracepoint, which can be opened using
+// its Configure method.
+//
+// Each ProbeEvent is created in a group of its own, named after the process
+// which created it. The probe definition is removed by Close.
+//
+// Unlike file descriptors, probe definitions are not released by the
+// kernel when the process which created them exits, and package perf has
+// no way to run code at exit. Programs which create ProbeEvents should
+// therefore call CloseProbeEvents before exiting, typically using defer in
+// main, and from a handler for the signals which terminate them:
+//
+//	defer perf.CloseProbeEvents()
+//
+// Nothing is cleaned up when a process exits without doing so. Instead,
+// definitions left behind by such processes are removed the next time a
+// process creates its first ProbeEvent, or calls RemoveStaleProbeEvents.
+// The group name records the PID namespace, the process ID and the start
+// time of the owner, so that a new process which reuses the ID of a dead
+// owner does not keep its probes alive. Since the tracing file system may
+// be shared by containers in other PID namespaces, whose processes are not
+// visible to us, only definitions created in the PID namespace of the
+// current process are ever removed. Others must be removed explicitly,
+// using RemoveProbeEvent.
+type ProbeEvent struct {
+	// Group is the name of the tracepoint category, which is unique
+	// to the ProbeEvent.
+	Group string
+
+	// Event is the name of the tracepoint.
+	Event string
+
+	file   string // kprobe_events or uprobe_events
+	closed bool
+}
+
+// NewKprobeEvent creates a kprobe on the kernel function fn, at the specified
+// offset from the start of the function.
+//
+// fetchargs specify data to record in samples, in the syntax described in
+// Documentation/trace/kprobetrace.rst, for example "+0(%di):string" or
+// "fd=%di:s32". The recorded data is available in SampleRecord.Raw.
+func NewKprobeEvent(fn string, offset uint64, fetchargs ...string) (*ProbeEvent, error) {
+	location := fn
+	if offset != 0 {
+		location = fmt.Sprintf("%s+%d", fn, offset)
+	}
+	return newProbeEvent("kprobe_events", "p", fn, location, fetchargs)
+}
+
+// NewKretprobeEvent creates a kretprobe on the kernel function fn, which
+// fires when fn returns. See NewKprobeEvent for details about fetchargs.
+// The return value of fn can be fetched using "$retval".
+func NewKretprobeEvent(fn string, fetchargs ...string) (*ProbeEvent, error) {
+	return newProbeEvent("kprobe_events", "r", fn, fn, fetchargs)
+}
+
+// NewUprobeEvent creates a uprobe on the executable or library at path,
+// at the specified offset in the file. fetchargs specify data to record in
+// samples, in the syntax described in Documentation/trace/uprobetracer.rst.
+func NewUprobeEvent(path string, offset uint64, fetchargs ...string) (*ProbeEvent, error) {
+	location := fmt.Sprintf("%s:%#x", path, offset)
+	return newProbeEvent("uprobe_events", "p", filepath.Base(path), location, fetchargs)
+}
+
+// NewUretprobeEvent creates a uretprobe on the function at the specified
+// offset in the executable or library at path, which fires when the
+// function returns. See NewUprobeEvent for details about fetchargs.
+func NewUretprobeEvent(path string, offset uint64, fetchargs ...string) (*ProbeEvent, error) {
+	location := fmt.Sprintf("%s:%#x", path, offset)
+	return newProbeEvent("uprobe_events", "r", filepath.Base(path), location, fetchargs)
+}
+
+// Configure implements the Configurator interface. It configures attr to
+// measure the tracepoint associated with pe.
+func (pe *ProbeEvent) Configure(attr *Attr) error {
+	return Tracepoint(pe.Group, pe.Event).Configure(attr)
+}
+
+// Close removes the probe definition. Events opened on the tracepoint must
+// be closed before calling Close, otherwise the kernel refuses to remove
+// the definition.
+func (pe *ProbeEvent) Close() error {
+	probeEvents.Lock()
+	defer probeEvents.Unlock()
+
+	if pe.closed {
+		return os.ErrClosed
+	}
+	if err := writeProbeEvents(pe.file, fmt.Sprintf("-:%s/%s", pe.Group, pe.Event)); err != nil {
+		return err
+	}
+	pe.closed = true
+	delete(probeEvents.live, pe)
+	return nil
+}
+
+// CloseProbeEvents removes all the probe definitions created by the
+// current process, which have not been removed already.
+func CloseProbeEvents() error {
+	probeEvents.Lock()
+	live := make([]*ProbeEvent, 0, len(probeEvents.live))
+	for pe := range probeEvents.live {
+		live = append(live, pe)
+	}
+	probeEvents.Unlock()
+
+	var first error
+	for _, pe := range live {
+		if err := pe.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ProbeEventInfo describes a probe definition, as listed in kprobe_events
+// or uprobe_events.
+type ProbeEventInfo struct {
+	// Uprobe is set for probes listed in uprobe_events, and unset for
+	// probes listed in kprobe_events.
+	Uprobe bool
+
+	// Return is set for return probes.
+	Return bool
+
+	// Group and Event name the tracepoint associated with the probe.
+	Group string
+	Event string
+
+	// Location is the location of the probe: fn[+offset] for kprobes,
+	// path:offset for uprobes.
+	Location string
+
+	// FetchArgs are the fetch arguments of the probe.
+	FetchArgs []string
+}
+
+// ListProbeEvents lists all the probe definitions in kprobe_events and
+// uprobe_events, including the ones not created by the current process.
+func ListProbeEvents() ([]ProbeEventInfo, error) {
+	kprobes, err := readProbeEvents("kprobe_events")
+	if err != nil {
+		return nil, err
+	}
+	uprobes, err := readProbeEvents("uprobe_events")
+	if err != nil {
+		return nil, err
+	}
+	return append(kprobes, uprobes...), nil
+}
+
+// RemoveProbeEvent removes the probe definition described by info. It can
+// be used to remove probes created by other processes.
+func RemoveProbeEvent(info ProbeEventInfo) error {
+	file := "kprobe_events"
+	if info.Uprobe {
+		file = "uprobe_events"
+	}
+	return writeProbeEvents(file, fmt.Sprintf("-:%s/%s", info.Group, info.Event))
+}
+
+// probeGroupPrefix is the prefix of the groups of probes created by package
+// perf. Groups are named <prefix><pid ns>_<pid>_<start time>_<sequence
+// number>, where the PID namespace is identified by the inode number of
+// /proc/<pid>/ns/pid, and the start time of the process is as found in
+// /proc/<pid>/stat.
+const probeGroupPrefix = "goperf_"
+
+// probeEvents tracks the live ProbeEvents created by the current process.
+var probeEvents struct {
+	sync.Mutex
+	seq   int
+	swept bool
+	live  map[*ProbeEvent]struct{}
+}
+
+func newProbeEvent(file, typ, name, location string, fetchargs []string) (*ProbeEvent, error) {
+	if strings.ContainsAny(location, " \t\n") {
+		return nil, fmt.Errorf("perf: bad probe location %q", location)
+	}
+	for _, arg := range fetchargs {
+		if arg == "" || strings.ContainsAny(arg, " \t\n") {
+			return nil, fmt.Errorf("perf: bad probe fetch argument %q", arg)
+		}
+	}
+
+	probeEvents.Lock()
+	defer probeEvents.Unlock()
+
+	if !probeEvents.swept {
+		// Best effort: failure to clean up after other processes
+		// should not prevent us from creating new probes.
+		removeStaleProbeEvents()
+		probeEvents.swept = true
+	}
+
+	ns, err := pidNamespace()
+	if err != nil {
+		return nil, fmt.Errorf("perf: reading PID namespace: %v", err)
+	}
+	start, err := procStartTime(os.Getpid())
+	if err != nil {
+		return nil, fmt.Errorf("perf: reading process start time: %v", err)
+	}
+	probeEvents.seq++
+	pe := &ProbeEvent{
+		Group: fmt.Sprintf("%s%d_%d_%d_%d", probeGroupPrefix, ns, os.Getpid(), start, probeEvents.seq),
+		Event: probeEventName(name),
+		file:  file,
+	}
+	def := fmt.Sprintf("%s:%s/%s %s", typ, pe.Group, pe.Event, location)
+	if len(fetchargs) > 0 {
+		def += " " + strings.Join(fetchargs, " ")
+	}
+	if err := writeProbeEvents(file, def); err != nil {
+		return nil, err
+	}
+	if probeEvents.live == nil {
+		probeEvents.live = map[*ProbeEvent]struct{}{}
+	}
+	probeEvents.live[pe] = struct{}{}
+	return pe, nil
+}
+
+// probeEventName turns name into a valid tracepoint name.
+func probeEventName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "probe"
+	}
+	return string(b)
+}
+
+// RemoveStaleProbeEvents removes the probe definitions created by package
+// perf in processes of the current PID namespace which have exited,
+// without removing them. See ProbeEvent for details. Definitions which cannot be removed, for example
+// because events are still open on them, are left in place, and the first
+// such error is returned.
+func RemoveStaleProbeEvents() error {
+	probeEvents.Lock()
+	defer probeEvents.Unlock()
+
+	return removeStaleProbeEvents()
+}
+
+// removeStaleProbeEvents implements RemoveStaleProbeEvents. probeEvents
+// must be locked.
+func removeStaleProbeEvents() error {
+	ns, err := pidNamespace()
+	if err != nil {
+		return err
+	}
+	infos, err := ListProbeEvents()
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, info := range infos {
+		if !staleProbeGroup(info.Group, ns) {
+			continue
+		}
+		if err := RemoveProbeEvent(info); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// staleProbeGroup reports whether group names a group of probes created
+// by package perf, in a process of the PID namespace ns which no longer
+// exists. Groups created in other PID namespaces are never stale, since
+// we cannot tell whether their owners exist.
+func staleProbeGroup(group string, ns uint64) bool {
+	if !strings.HasPrefix(group, probeGroupPrefix) {
+		return false
+	}
+	fields := strings.Split(strings.TrimPrefix(group, probeGroupPrefix), "_")
+	if len(fields) != 4 {
+		return false
+	}
+	if owner, err := strconv.ParseUint(fields[0], 10, 64); err != nil || owner != ns {
+		return false
+	}
+	pid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false
+	}
+	start, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return false
+	}
+	cur, err := procStartTime(pid)
+	if os.IsNotExist(err) {
+		return true
+	}
+	// A process with a different start time reuses the ID of the owner.
+	return err == nil && cur != start
+}
+
+// pidNamespace returns the inode number of the PID namespace of the
+// current process, as found in /proc/self/ns/pid.
+func pidNamespace() (uint64, error) {
+	link, err := os.Readlink("/proc/self/ns/pid")
+	if err != nil {
+		return 0, err
+	}
+	// The link target looks like pid:[4026531836].
+	if !strings.HasPrefix(link, "pid:[") || !strings.HasSuffix(link, "]") {
+		return 0, fmt.Errorf("bad /proc/self/ns/pid link %q", link)
+	}
+	return strconv.ParseUint(link[len("pid:["):len(link)-1], 10, 64)
+}
+
+// procStartTime returns the start time of the process with the specified
+// ID, in clock ticks since boot, as found in /proc/<pid>/stat.
+func procStartTime(pid int) (uint64, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name, in parentheses, may contain spaces and
+	// parentheses. The fields after it start with the state, which is
+	// field 3. The start time is field 22.
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return 0, fmt.Errorf("bad /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("bad /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// writeProbeEvents appends a line to the specified probe events file.
+func writeProbeEvents(file, line string) error {
+	path, err := tracefsPath(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("perf: writing %q to %s: %v", line, path, err)
+	}
+	return nil
+}
+
+// readProbeEvents parses the specified probe events file. If the file
+// does not exist, readProbeEvents returns no probes, and no error.
+func readProbeEvents(file string) ([]ProbeEventInfo, error) {
+	path, err := tracefsPath(file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var infos []ProbeEventInfo
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		info, err := parseProbeEventLine(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("perf: %s: %v", file, err)
+		}
+		info.Uprobe = file == "uprobe_events"
+		infos = append(infos, info)
+	}
+	return infos, sc.Err()
+}
+
+var errBadProbeEventLine = errors.New("bad probe definition")
+
+// parseProbeEventLine parses a line of the form
+//
+//	p[:[group/]event] location [fetchargs...]
+//
+// where p may also be r, optionally followed by a maxactive count.
+func parseProbeEventLine(line string) (ProbeEventInfo, error) {
+	var info ProbeEventInfo
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return info, errBadProbeEventLine
+	}
+	colon := strings.Index(fields[0], ":")
+	slash := strings.Index(fields[0], "/")
+	if colon < 1 || slash < colon {
+		return info, errBadProbeEventLine
+	}
+	switch fields[0][0] {
+	case 'p':
+	case 'r':
+		info.Return = true
+	default:
+		return info, errBadProbeEventLine
+	}
+	info.Group = fields[0][colon+1 : slash]
+	info.Event = fields[0][slash+1:]
+	info.Location = fields[1]
+	info.FetchArgs = fields[2:]
+	return info, nil
+}
@@ -0,0 +1,283 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"acln.ro/perf"
+)
+
+func TestDynamicProbes(t *testing.T) {
+	t.Run("Kprobe", testKprobe)
+	t.Run("Kretprobe", testKretprobe)
+	t.Run("Uprobe", testUprobe)
+	t.Run("Uretprobe", testUretprobe)
+}
+
+func testKprobe(t *testing.T) {
+	requires(t, paranoid(1), pmu("kprobe"))
+
+	testProbeCount(t, perf.Kprobe("__x64_sys_getpid", 0), "kprobe:__x64_sys_getpid", getpidTrigger)
+}
+
+func testKretprobe(t *testing.T) {
+	requires(t, paranoid(1), pmu("kprobe"))
+
+	testProbeCount(t, perf.Kretprobe("__x64_sys_getpid"), "kretprobe:__x64_sys_getpid", getpidTrigger)
+}
+
+func testUprobe(t *testing.T) {
+	requires(t, paranoid(1), pmu("uprobe"))
+
+	path, offset := uprobeTarget(t)
+	label := fmt.Sprintf("uprobe:%s:%#x", path, offset)
+	testProbeCount(t, perf.Uprobe(path, offset), label, uprobeTrigger)
+}
+
+func testUretprobe(t *testing.T) {
+	requires(t, paranoid(1), pmu("uprobe"))
+
+	path, offset := uprobeTarget(t)
+	label := fmt.Sprintf("uretprobe:%s:%#x", path, offset)
+	testProbeCount(t, perf.Uretprobe(path, offset), label, uprobeTrigger)
+}
+
+func testProbeCount(t *testing.T, cfg perf.Configurator, label string, trigger func()) {
+	pa := new(perf.Attr)
+	if err := cfg.Configure(pa); err != nil {
+		t.Fatal(err)
+	}
+	if pa.Label != label {
+		t.Fatalf("got label %q, want %q", pa.Label, label)
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	probe, err := perf.Open(pa, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+
+	c, err := probe.Measure(func() {
+		trigger()
+		trigger()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Value != 2 {
+		t.Fatalf("got %d hits, want 2", c.Value)
+	}
+}
+
+//go:noinline
+func uprobeTrigger() {
+	runtime.Gosched()
+}
+
+// uprobeTarget returns the path to the test executable, and the file
+// offset of uprobeTrigger within it, computed from /proc/self/maps.
+func uprobeTarget(t *testing.T) (string, uint64) {
+	t.Helper()
+
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := uint64(reflect.ValueOf(uprobeTrigger).Pointer())
+	maps, err := ioutil.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(maps), "\n") {
+		// start-end perms offset dev inode path
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[5] != path {
+			continue
+		}
+		var start, end, offset uint64
+		if _, err := fmt.Sscanf(fields[0], "%x-%x", &start, &end); err != nil {
+			continue
+		}
+		if _, err := fmt.Sscanf(fields[2], "%x", &offset); err != nil {
+			continue
+		}
+		if addr >= start && addr < end {
+			return path, addr - start + offset
+		}
+	}
+	t.Skipf("could not find mapping for uprobeTrigger at %#x", addr)
+	return "", 0
+}
+
+func TestProbeEvents(t *testing.T) {
+	t.Run("Kprobe", testKprobeEvent)
+	t.Run("Uprobe", testUprobeEvent)
+	t.Run("BadArguments", testProbeEventBadArguments)
+	t.Run("Stale", testProbeEventStale)
+}
+
+func testKprobeEvent(t *testing.T) {
+	requires(t, paranoid(1), tracefs)
+	requiresProbeEvents(t, "kprobe_events")
+
+	pe, err := perf.NewKprobeEvent("__x64_sys_getpid", 0, "+0(%di):u64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pe.Close()
+
+	infos, err := perf.ListProbeEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, info := range infos {
+		if info.Group == pe.Group && info.Event == pe.Event {
+			found = true
+			if info.Uprobe || info.Return {
+				t.Errorf("got %+v, want kprobe", info)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("%s/%s not listed in %+v", pe.Group, pe.Event, infos)
+	}
+
+	testProbeCount(t, pe, pe.Group+":"+pe.Event, getpidTrigger)
+
+	if err := pe.Close(); err != nil {
+		t.Fatal(err)
+	}
+	infos, err = perf.ListProbeEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Group == pe.Group {
+			t.Fatalf("%s/%s still listed after Close", pe.Group, pe.Event)
+		}
+	}
+}
+
+func testUprobeEvent(t *testing.T) {
+	requires(t, paranoid(1), tracefs)
+	requiresProbeEvents(t, "uprobe_events")
+
+	path, offset := uprobeTarget(t)
+	pe, err := perf.NewUprobeEvent(path, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pe.Close()
+
+	testProbeCount(t, pe, pe.Group+":"+pe.Event, uprobeTrigger)
+}
+
+func testProbeEventBadArguments(t *testing.T) {
+	if _, err := perf.NewKprobeEvent("do_sys_open", 0, "a b"); err == nil {
+		t.Error("NewKprobeEvent succeeded with whitespace in fetch argument")
+	}
+	if _, err := perf.NewKprobeEvent("do_sys_open", 0, ""); err == nil {
+		t.Error("NewKprobeEvent succeeded with empty fetch argument")
+	}
+	if _, err := perf.NewUprobeEvent("/bin/some binary", 0); err == nil {
+		t.Error("NewUprobeEvent succeeded with whitespace in path")
+	}
+}
+
+func testProbeEventStale(t *testing.T) {
+	requires(t, paranoid(1), tracefs)
+	requiresProbeEvents(t, "uprobe_events")
+
+	path, offset := uprobeTarget(t)
+	pe, err := perf.NewUprobeEvent(path, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pe.Close()
+
+	// A probe left behind by a process which had our process ID, but
+	// started at a different time, and a probe created in another PID
+	// namespace, by a process we cannot see.
+	link, err := os.Readlink("/proc/self/ns/pid")
+	if err != nil {
+		t.Skip(err)
+	}
+	var ns uint64
+	if _, err := fmt.Sscanf(link, "pid:[%d]", &ns); err != nil {
+		t.Fatalf("bad /proc/self/ns/pid link %q", link)
+	}
+	root, err := perf.TracefsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(root, "uprobe_events"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := fmt.Sprintf("goperf_%d_%d_1_1", ns, os.Getpid())
+	foreign := fmt.Sprintf("goperf_%d_%d_1_1", ns+1, 1<<30)
+	_, err = fmt.Fprintf(f, "p:%s/stale %s:%#x\n", stale, path, offset)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "p:%s/foreign %s:%#x\n", foreign, path, offset)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer perf.RemoveProbeEvent(perf.ProbeEventInfo{Uprobe: true, Group: foreign, Event: "foreign"})
+
+	if err := perf.RemoveStaleProbeEvents(); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := perf.ListProbeEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, kept := false, false
+	for _, info := range infos {
+		switch info.Group {
+		case stale:
+			t.Errorf("stale probe %s/%s not removed", info.Group, info.Event)
+		case pe.Group:
+			live = true
+		case foreign:
+			kept = true
+		}
+	}
+	if !live {
+		t.Errorf("live probe %s/%s removed", pe.Group, pe.Event)
+	}
+	if !kept {
+		t.Errorf("probe %s/foreign from another PID namespace removed", foreign)
+	}
+}
+
+// requiresProbeEvents skips the test if the specified probe events file
+// is not writable.
+func requiresProbeEvents(t *testing.T, file string) {
+	t.Helper()
+
+	root, err := perf.TracefsRoot()
+	if err != nil {
+		t.Skip(err)
+	}
+	f, err := os.OpenFile(filepath.Join(root, file), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Skipf("%s is not writable: %v", file, err)
+	}
+	f.Close()
+}
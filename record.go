@@ -727,6 +727,7 @@ func (rr *ReadGroupRecord) DecodeFrom(raw *RawRecord, ev *Event) error {
 	f := raw.fields()
 	f.uint32(&rr.Pid, &rr.Tid)
 	f.groupCount(&rr.GroupCount, ev.a.CountFormat)
+	ev.labelGroupCount(&rr.GroupCount)
 	f.idCond(ev.a.Options.SampleIDAll, &rr.SampleID, ev.a.SampleFormat)
 	return nil
 }
@@ -936,6 +937,7 @@ func (sr *SampleGroupRecord) DecodeFrom(raw *RawRecord, ev *Event) error {
 	f.uint64Cond(ev.a.SampleFormat.Period, &sr.Period)
 	if ev.a.SampleFormat.Count {
 		f.groupCount(&sr.Count, ev.a.CountFormat)
+		ev.labelGroupCount(&sr.Count)
 	}
 	if ev.a.SampleFormat.Callchain {
 		var nr uint64
@@ -16,7 +16,7 @@ import (
 )
 
 func TestSampleUserRegisters(t *testing.T) {
-	requires(t, tracepointPMU, debugfs) // TODO(acln): paranoid
+	requires(t, tracepointPMU, tracefs) // TODO(acln): paranoid
 
 	wea := &perf.Attr{
 		CountFormat: perf.CountFormat{
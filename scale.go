@@ -0,0 +1,134 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// CountState describes how a counter value was obtained.
+type CountState int
+
+// Count states.
+const (
+	// Counted means that the counter ran for the entire time it was
+	// enabled, and its value is exact.
+	Counted CountState = iota
+
+	// Multiplexed means that the counter ran for part of the time it
+	// was enabled, because it shared the PMU with other counters. Its
+	// value is an estimate.
+	Multiplexed
+
+	// NotCounted means that the counter was enabled, but never
+	// scheduled on the PMU (Running == 0), so no estimate is possible.
+	NotCounted
+
+	// NotSupported means that the event could not be opened, because
+	// the PMU or the kernel does not support it.
+	NotSupported
+)
+
+var countStateStrings = [...]string{
+	Counted:      "counted",
+	Multiplexed:  "multiplexed",
+	NotCounted:   "<not counted>",
+	NotSupported: "<not supported>",
+}
+
+func (s CountState) String() string {
+	if s < 0 || int(s) >= len(countStateStrings) {
+		return fmt.Sprintf("CountState(%d)", int(s))
+	}
+	return countStateStrings[s]
+}
+
+// ScaledValue is a counter value, scaled to account for multiplexing.
+type ScaledValue struct {
+	Label string
+
+	// Raw is the value read from the counter.
+	Raw uint64
+
+	// Value estimates what the counter would have read had it run for
+	// the entire time it was enabled: Raw * Enabled / Running. Value is
+	// zero if State is NotCounted or NotSupported.
+	Value float64
+
+	// Percent is the percentage of the enabled time the counter was
+	// running for. It is the confidence in Value: 100 for exact values,
+	// and lower as the counter is multiplexed more.
+	Percent float64
+
+	State CountState
+}
+
+// scale scales value based on the enabled and running times. If both times
+// are zero, they were not read, and value is taken as is.
+func scale(label string, value uint64, enabled, running int64) ScaledValue {
+	sv := ScaledValue{Label: label, Raw: value}
+	switch {
+	case enabled == 0 && running == 0:
+		sv.Value = float64(value)
+		sv.Percent = 100
+		sv.State = Counted
+	case running == 0:
+		sv.State = NotCounted
+	case running >= enabled:
+		sv.Value = float64(value)
+		sv.Percent = 100
+		sv.State = Counted
+	default:
+		sv.Value = float64(value) * float64(enabled) / float64(running)
+		sv.Percent = 100 * float64(running) / float64(enabled)
+		sv.State = Multiplexed
+	}
+	return sv
+}
+
+// Scaled scales c to account for multiplexing. Scaling requires
+// CountFormat.Enabled and CountFormat.Running to be set on the event.
+// Otherwise, c.Value is reported as Counted, without scaling.
+func (c Count) Scaled() ScaledValue {
+	return scale(c.Label, c.Value, int64(c.Enabled), int64(c.Running))
+}
+
+// Scaled scales each of gc.Values to account for multiplexing. Scaling
+// requires CountFormat.Enabled and CountFormat.Running to be set on the
+// group leader. All values in a group share the same running percentage.
+func (gc GroupCount) Scaled() []ScaledValue {
+	svs := make([]ScaledValue, 0, len(gc.Values))
+	for _, v := range gc.Values {
+		svs = append(svs, scale(v.Label, v.Value, int64(gc.Enabled), int64(gc.Running)))
+	}
+	return svs
+}
+
+// NotSupportedValue returns the ScaledValue reported for an event which
+// could not be opened, as reported by Unsupported.
+func NotSupportedValue(label string) ScaledValue {
+	return ScaledValue{Label: label, State: NotSupported}
+}
+
+// Unsupported reports whether err, as returned by Open, indicates that the
+// event is not supported by the PMU or by the kernel, as opposed to being
+// misconfigured or forbidden.
+func Unsupported(err error) bool {
+	oe, ok := err.(*OpenError)
+	if !ok {
+		return false
+	}
+	if _, ok := oe.Err.(*FeatureError); ok {
+		return true
+	}
+	switch oe.Errno {
+	case unix.ENOENT, unix.ENXIO, unix.EOPNOTSUPP:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"acln.ro/perf"
+)
+
+func TestScale(t *testing.T) {
+	t.Run("Count", testScaleCount)
+	t.Run("PrintScaled", testPrintScaled)
+	t.Run("Unsupported", testScaleUnsupported)
+}
+
+func testScaleCount(t *testing.T) {
+	tests := []struct {
+		c       perf.Count
+		value   float64
+		percent float64
+		state   perf.CountState
+	}{
+		{
+			c:       perf.Count{Value: 100, Enabled: time.Second, Running: time.Second},
+			value:   100,
+			percent: 100,
+			state:   perf.Counted,
+		},
+		{
+			c:       perf.Count{Value: 100, Enabled: time.Second, Running: 250 * time.Millisecond},
+			value:   400,
+			percent: 25,
+			state:   perf.Multiplexed,
+		},
+		{
+			c:     perf.Count{Value: 0, Enabled: time.Second, Running: 0},
+			state: perf.NotCounted,
+		},
+		{
+			// Enabled and Running were not read.
+			c:       perf.Count{Value: 5},
+			value:   5,
+			percent: 100,
+			state:   perf.Counted,
+		},
+	}
+	for _, tt := range tests {
+		sv := tt.c.Scaled()
+		if sv.Value != tt.value || sv.Percent != tt.percent || sv.State != tt.state {
+			t.Errorf("%+v: got %+v, want value %v, percent %v, state %v",
+				tt.c, sv, tt.value, tt.percent, tt.state)
+		}
+		if sv.Raw != tt.c.Value {
+			t.Errorf("%+v: got raw value %d, want %d", tt.c, sv.Raw, tt.c.Value)
+		}
+	}
+}
+
+func scaledGroupCount(running time.Duration) perf.GroupCount {
+	gc := perf.GroupCount{Enabled: time.Second, Running: running}
+	for _, label := range []string{"cycles", "instructions"} {
+		gc.Values = append(gc.Values, struct {
+			Value uint64
+			ID    uint64
+			Label string
+		}{Value: 1000, Label: label})
+	}
+	return gc
+}
+
+func testPrintScaled(t *testing.T) {
+	var buf bytes.Buffer
+	if err := scaledGroupCount(500*time.Millisecond).PrintValuesMode(&buf, perf.PrintScaled); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"running", "2000", "50.00%"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output %q does not contain %q", out, want)
+		}
+	}
+
+	buf.Reset()
+	if err := scaledGroupCount(0).PrintValuesMode(&buf, perf.PrintScaled); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(buf.String(), "<not counted>"); got != 2 {
+		t.Errorf("got %d <not counted> values in %q, want 2", got, buf.String())
+	}
+
+	buf.Reset()
+	if err := scaledGroupCount(500 * time.Millisecond).PrintValues(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "running") || strings.Contains(out, "2000") {
+		t.Errorf("raw output %q contains scaled values", out)
+	}
+}
+
+func testScaleUnsupported(t *testing.T) {
+	requires(t, paranoid(1))
+
+	attr := &perf.Attr{Label: "bogus", Type: bogusPMU}
+	_, err := perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+	if !perf.Unsupported(err) {
+		t.Fatalf("%v: not reported as unsupported", err)
+	}
+	if sv := perf.NotSupportedValue("bogus"); sv.State != perf.NotSupported {
+		t.Fatalf("got state %v, want %v", sv.State, perf.NotSupported)
+	}
+
+	_, err = perf.Open(new(perf.Attr), 1<<30, perf.AnyCPU, nil)
+	if perf.Unsupported(err) {
+		t.Fatalf("%v: reported as unsupported", err)
+	}
+}
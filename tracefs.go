@@ -0,0 +1,224 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Errors describing why the tracing file system is not usable.
+var (
+	// ErrTracefsMissing indicates that the kernel does not support
+	// the tracing file system.
+	ErrTracefsMissing = errors.New("tracefs is not supported by the kernel")
+
+	// ErrTracefsNotMounted indicates that the kernel supports the tracing
+	// file system, but it is not mounted anywhere.
+	ErrTracefsNotMounted = errors.New("tracefs is not mounted")
+
+	// ErrTracefsUnreadable indicates that the tracing file system is
+	// mounted, but it cannot be read by the current process.
+	ErrTracefsUnreadable = errors.New("tracefs is not readable")
+)
+
+// TracefsError is returned by functions which need the tracing file system,
+// when it is not usable.
+type TracefsError struct {
+	// Path is the directory at which tracefs was expected to be found.
+	// It is empty if no candidate directory was found.
+	Path string
+
+	// Err is one of ErrTracefsMissing, ErrTracefsNotMounted or
+	// ErrTracefsUnreadable.
+	Err error
+
+	// Cause is the underlying error, if any.
+	Cause error
+}
+
+func (e *TracefsError) Error() string {
+	msg := "perf: " + e.Err.Error()
+	if e.Path != "" {
+		msg += " at " + e.Path
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+// Unwrap returns e.Err.
+func (e *TracefsError) Unwrap() error { return e.Err }
+
+// tracefsDirs are the directories at which tracefs is usually found,
+// in order of preference, used if /proc/self/mountinfo is not helpful.
+var tracefsDirs = []string{
+	"/sys/kernel/tracing",
+	"/sys/kernel/debug/tracing",
+}
+
+// tracefs holds the state of tracefs discovery.
+var tracefs struct {
+	sync.Mutex
+	root string // override, or cached result of discovery
+}
+
+// SetTracefsRoot overrides tracefs discovery: subsequent operations which
+// need the tracing file system use dir as its root. If dir is empty,
+// SetTracefsRoot discards the override, and the root is discovered again.
+func SetTracefsRoot(dir string) {
+	tracefs.Lock()
+	defer tracefs.Unlock()
+
+	tracefs.root = dir
+}
+
+// TracefsRoot returns the directory at which the tracing file system is
+// mounted, as set by SetTracefsRoot, or as discovered by inspecting
+// /proc/self/mountinfo. If tracefs does not appear in the mount table,
+// TracefsRoot tries /sys/kernel/tracing, then /sys/kernel/debug/tracing.
+//
+// If the tracing file system is not usable, TracefsRoot returns
+// a *TracefsError.
+func TracefsRoot() (string, error) {
+	tracefs.Lock()
+	defer tracefs.Unlock()
+
+	if tracefs.root != "" {
+		return tracefs.root, nil
+	}
+	root, err := discoverTracefs()
+	if err != nil {
+		return "", err
+	}
+	tracefs.root = root
+	return root, nil
+}
+
+// tracefsPath returns the path to the named file in the tracing file system.
+func tracefsPath(elem ...string) (string, error) {
+	root, err := TracefsRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{root}, elem...)...), nil
+}
+
+func discoverTracefs() (string, error) {
+	var candidates []string
+	if f, err := os.Open("/proc/self/mountinfo"); err == nil {
+		candidates = tracefsMounts(f)
+		f.Close()
+	}
+	candidates = append(candidates, tracefsDirs...)
+
+	var unreadable *TracefsError
+	for _, dir := range candidates {
+		// A mounted tracefs always contains a trace file.
+		_, err := os.Stat(filepath.Join(dir, "trace"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			_, err = ioutil.ReadDir(dir)
+		}
+		if err != nil {
+			if unreadable == nil {
+				unreadable = &TracefsError{
+					Path:  dir,
+					Err:   ErrTracefsUnreadable,
+					Cause: err,
+				}
+			}
+			continue
+		}
+		return dir, nil
+	}
+	if unreadable != nil {
+		return "", unreadable
+	}
+	if !kernelSupportsTracefs() {
+		return "", &TracefsError{Err: ErrTracefsMissing}
+	}
+	return "", &TracefsError{Err: ErrTracefsNotMounted}
+}
+
+// tracefsMounts returns the tracefs mount points listed in mountinfo, and
+// the tracing directories of debugfs mount points, in order.
+func tracefsMounts(mountinfo io.Reader) []string {
+	var dirs []string
+	sc := bufio.NewScanner(mountinfo)
+	for sc.Scan() {
+		// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		sep := -1
+		for i := 5; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		mountpoint := unescapeMountPath(fields[4])
+		switch fields[sep+1] {
+		case "tracefs":
+			dirs = append(dirs, mountpoint)
+		case "debugfs":
+			dirs = append(dirs, filepath.Join(mountpoint, "tracing"))
+		}
+	}
+	return dirs
+}
+
+// unescapeMountPath decodes the octal escapes used by the kernel for
+// whitespace and backslashes in paths in /proc/self/mountinfo.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				sb.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// kernelSupportsTracefs reports whether tracefs is listed in
+// /proc/filesystems. If /proc/filesystems cannot be read,
+// kernelSupportsTracefs optimistically returns true.
+func kernelSupportsTracefs() bool {
+	content, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return true
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == "tracefs" {
+			return true
+		}
+	}
+	return false
+}
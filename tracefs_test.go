@@ -0,0 +1,78 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"acln.ro/perf"
+)
+
+// fixtureTracefs is the directory containing a fixture tracing file system.
+var fixtureTracefs = filepath.Join("testdata", "tracefs")
+
+func TestTracefs(t *testing.T) {
+	t.Run("Discover", testTracefsDiscover)
+	t.Run("Override", testTracefsOverride)
+	t.Run("MissingTracepoint", testTracefsMissingTracepoint)
+}
+
+func testTracefsDiscover(t *testing.T) {
+	root, err := perf.TracefsRoot()
+	if err != nil {
+		tferr, ok := err.(*perf.TracefsError)
+		if !ok {
+			t.Fatalf("got %T, want *perf.TracefsError", err)
+		}
+		switch tferr.Err {
+		case perf.ErrTracefsMissing, perf.ErrTracefsNotMounted, perf.ErrTracefsUnreadable:
+			t.Skip(err)
+		default:
+			t.Fatalf("unexpected error kind %v", tferr.Err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "trace")); err != nil {
+		t.Fatalf("discovered root %q does not look like tracefs: %v", root, err)
+	}
+}
+
+func testTracefsOverride(t *testing.T) {
+	perf.SetTracefsRoot(fixtureTracefs)
+	defer perf.SetTracefsRoot("")
+
+	root, err := perf.TracefsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != fixtureTracefs {
+		t.Fatalf("got root %q, want %q", root, fixtureTracefs)
+	}
+	cfg, err := perf.LookupTracepointConfig("sched", "sched_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != 316 {
+		t.Fatalf("got config %d, want 316", cfg)
+	}
+
+	a := new(perf.Attr)
+	if err := perf.Tracepoint("syscalls", "sys_enter_getpid").Configure(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Type != perf.TracepointEvent || a.Config != 172 || a.Label != "syscalls:sys_enter_getpid" {
+		t.Fatalf("got type %d, config %d, label %q", a.Type, a.Config, a.Label)
+	}
+}
+
+func testTracefsMissingTracepoint(t *testing.T) {
+	perf.SetTracefsRoot(fixtureTracefs)
+	defer perf.SetTracefsRoot("")
+
+	if _, err := perf.LookupTracepointConfig("sched", "no_such_event"); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want a not-exist error", err)
+	}
+}
@@ -0,0 +1,507 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// TracepointFormat describes the layout of the raw data recorded by
+// a tracepoint, as listed in <tracefs>/events/<category>/<event>/format.
+//
+// Raw data is delivered in SampleRecord.Raw, if SampleFormat.Raw is set.
+type TracepointFormat struct {
+	// Name is the name of the tracepoint.
+	Name string
+
+	// ID is the Attr.Config value associated with the tracepoint.
+	ID uint64
+
+	// Common holds the fields common to all tracepoints, such as
+	// common_type and common_pid. See also DecodeCommon.
+	Common []TracepointField
+
+	// Fields holds the fields specific to the tracepoint.
+	Fields []TracepointField
+
+	// PrintFmt is the format string the kernel uses to print the
+	// tracepoint, as found in the format file.
+	PrintFmt string
+}
+
+// TracepointField describes a field of the raw data recorded by a tracepoint.
+type TracepointField struct {
+	// Name is the name of the field.
+	Name string
+
+	// Type is the C type of the field, without array dimensions, and
+	// without the __data_loc or __rel_loc qualifiers.
+	Type string
+
+	// Offset and Size describe the location of the field in the raw data.
+	// For dynamic fields, they describe the location of the 32-bit
+	// descriptor which points to the data.
+	Offset int
+	Size   int
+
+	// Signed indicates that the field (or, for arrays, each element
+	// of the field) is a signed integer.
+	Signed bool
+
+	// Array indicates that the field is an array. For fixed size arrays,
+	// ArrayLen is the number of elements. For dynamic arrays, ArrayLen is 0.
+	Array    bool
+	ArrayLen int
+
+	// Dynamic indicates that the field is a __data_loc or __rel_loc
+	// dynamic array, whose contents are stored after the fixed fields.
+	Dynamic bool
+
+	// Relative indicates that the offset of a dynamic array is relative
+	// to the end of the descriptor (__rel_loc), rather than to the start
+	// of the raw data (__data_loc).
+	Relative bool
+}
+
+// LookupTracepointFormat reads and parses the format of the specified
+// tracepoint, from <tracefs>/events/<category>/<event>/format.
+func LookupTracepointFormat(category, event string) (*TracepointFormat, error) {
+	p, err := tracefsPath("events", category, event, "format")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTracepointFormat(f)
+}
+
+// ParseTracepointFormat parses a tracepoint format description, in the
+// format used by the tracing file system.
+func ParseTracepointFormat(r io.Reader) (*TracepointFormat, error) {
+	tf := new(TracepointFormat)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "name:"):
+			tf.Name = strings.TrimSpace(strings.TrimPrefix(line, "name:"))
+		case strings.HasPrefix(line, "ID:"):
+			id, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "ID:")), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("perf: bad tracepoint ID: %v", err)
+			}
+			tf.ID = id
+		case strings.HasPrefix(line, "field:"):
+			field, err := parseTracepointField(line)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(field.Name, "common_") {
+				tf.Common = append(tf.Common, field)
+			} else {
+				tf.Fields = append(tf.Fields, field)
+			}
+		case strings.HasPrefix(line, "print fmt:"):
+			tf.PrintFmt = strings.TrimSpace(strings.TrimPrefix(line, "print fmt:"))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(tf.Common) == 0 && len(tf.Fields) == 0 {
+		return nil, errors.New("perf: tracepoint format has no fields")
+	}
+	return tf, nil
+}
+
+// parseTracepointField parses a line of the form
+//
+//	field:<declaration>;	offset:<n>;	size:<n>;	signed:<0|1>;
+func parseTracepointField(line string) (TracepointField, error) {
+	var field TracepointField
+	var haveOffset, haveSize bool
+	for _, part := range strings.Split(line, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		colon := strings.Index(part, ":")
+		if colon < 0 {
+			return field, fmt.Errorf("perf: bad tracepoint field %q", line)
+		}
+		key, val := part[:colon], part[colon+1:]
+		var err error
+		switch key {
+		case "field":
+			err = field.parseDeclaration(val)
+		case "offset":
+			field.Offset, err = strconv.Atoi(val)
+			haveOffset = true
+		case "size":
+			field.Size, err = strconv.Atoi(val)
+			haveSize = true
+		case "signed":
+			field.Signed = val == "1"
+		}
+		if err != nil {
+			return field, fmt.Errorf("perf: bad tracepoint field %q: %v", line, err)
+		}
+	}
+	if field.Name == "" || !haveOffset || !haveSize {
+		return field, fmt.Errorf("perf: bad tracepoint field %q", line)
+	}
+	return field, nil
+}
+
+// parseDeclaration parses a C declaration such as "char comm[16]",
+// "__data_loc char[] name" or "unsigned long addr".
+func (field *TracepointField) parseDeclaration(decl string) error {
+	decl = strings.TrimSpace(decl)
+	switch {
+	case strings.HasPrefix(decl, "__data_loc "):
+		field.Dynamic = true
+		decl = strings.TrimPrefix(decl, "__data_loc ")
+	case strings.HasPrefix(decl, "__rel_loc "):
+		field.Dynamic = true
+		field.Relative = true
+		decl = strings.TrimPrefix(decl, "__rel_loc ")
+	}
+
+	// The name is the last identifier. Array dimensions follow the name
+	// for fixed size arrays, and the type for dynamic arrays.
+	end := len(decl)
+	if strings.HasSuffix(decl, "]") {
+		open := strings.LastIndex(decl, "[")
+		if open < 0 {
+			return errors.New("unbalanced brackets")
+		}
+		field.Array = true
+		if n, err := strconv.Atoi(decl[open+1 : len(decl)-1]); err == nil {
+			field.ArrayLen = n
+		}
+		end = open
+	}
+	start := strings.LastIndexAny(decl[:end], " *") + 1
+	field.Name = decl[start:end]
+	typ := strings.TrimSpace(decl[:start])
+	if strings.HasSuffix(typ, "[]") {
+		field.Array = true
+		typ = strings.TrimSpace(strings.TrimSuffix(typ, "[]"))
+	}
+	field.Type = typ
+	if field.Name == "" || field.Type == "" {
+		return errors.New("missing type or name")
+	}
+	return nil
+}
+
+// elemSize returns the size of an element of an array field.
+func (field *TracepointField) elemSize() int {
+	if field.Array && !field.Dynamic && field.ArrayLen > 0 {
+		return field.Size / field.ArrayLen
+	}
+	if !field.Dynamic {
+		return field.Size
+	}
+	switch strings.TrimPrefix(strings.TrimPrefix(field.Type, "const "), "unsigned ") {
+	case "char", "u8", "s8", "__u8", "__s8", "bool":
+		return 1
+	case "short", "u16", "s16", "__u16", "__s16":
+		return 2
+	case "int", "u32", "s32", "__u32", "__s32", "pid_t":
+		return 4
+	case "long long", "u64", "s64", "__u64", "__s64":
+		return 8
+	}
+	if field.Type == "long" || strings.HasSuffix(field.Type, "*") {
+		return int(unsafe.Sizeof(uintptr(0)))
+	}
+	return 1
+}
+
+// isString reports whether the field holds a NUL-terminated string.
+func (field *TracepointField) isString() bool {
+	return field.Array && field.Type == "char"
+}
+
+// TracepointCommon holds the common fields of tracepoint raw data.
+type TracepointCommon struct {
+	Type         uint16
+	Flags        uint8
+	PreemptCount uint8
+	PID          int32
+}
+
+// DecodeCommon decodes the common fields of raw.
+func (tf *TracepointFormat) DecodeCommon(raw []byte) (TracepointCommon, error) {
+	var c TracepointCommon
+	for i := range tf.Common {
+		field := &tf.Common[i]
+		v, err := field.decodeUint(raw)
+		if err != nil {
+			return c, err
+		}
+		switch field.Name {
+		case "common_type":
+			c.Type = uint16(v)
+		case "common_flags":
+			c.Flags = uint8(v)
+		case "common_preempt_count":
+			c.PreemptCount = uint8(v)
+		case "common_pid":
+			c.PID = int32(v)
+		}
+	}
+	return c, nil
+}
+
+// Decode decodes the tracepoint specific fields of raw into a map from
+// field names to values.
+//
+// Integer fields are decoded to int8, int16, int32, int64, or their unsigned
+// counterparts, according to their size and signedness. Fixed size and
+// dynamic char arrays are decoded to strings. Other arrays are decoded to
+// slices of integers. Fields of other sizes are decoded to []byte.
+func (tf *TracepointFormat) Decode(raw []byte) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(tf.Fields))
+	for i := range tf.Fields {
+		v, err := tf.Fields[i].decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		m[tf.Fields[i].Name] = v
+	}
+	return m, nil
+}
+
+// Unmarshal decodes raw into the struct pointed to by v. Struct fields are
+// associated with tracepoint fields (including common fields) by means of
+// perf:"name" tags. Untagged struct fields are ignored.
+//
+// Tagged integer fields may be of any integer kind. Strings may be decoded
+// into string or []byte fields. Arrays may be decoded into slices of any
+// integer kind.
+func (tf *TracepointFormat) Unmarshal(raw []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("perf: Unmarshal: need non-nil struct pointer, got %T", v)
+	}
+	sv := rv.Elem()
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		name := st.Field(i).Tag.Get("perf")
+		if name == "" || name == "-" {
+			continue
+		}
+		if !sv.Field(i).CanSet() {
+			return fmt.Errorf("perf: Unmarshal: cannot set unexported field %s.%s", st.Name(), st.Field(i).Name)
+		}
+		field := tf.field(name)
+		if field == nil {
+			return fmt.Errorf("perf: Unmarshal: tracepoint %s has no field %q", tf.Name, name)
+		}
+		val, err := field.decode(raw)
+		if err != nil {
+			return err
+		}
+		if err := assignTracepointValue(sv.Field(i), val); err != nil {
+			return fmt.Errorf("perf: Unmarshal: field %q into %s.%s: %v", name, st.Name(), st.Field(i).Name, err)
+		}
+	}
+	return nil
+}
+
+// field returns the field with the specified name, or nil.
+func (tf *TracepointFormat) field(name string) *TracepointField {
+	for i := range tf.Common {
+		if tf.Common[i].Name == name {
+			return &tf.Common[i]
+		}
+	}
+	for i := range tf.Fields {
+		if tf.Fields[i].Name == name {
+			return &tf.Fields[i]
+		}
+	}
+	return nil
+}
+
+// bytes returns the bytes holding the field's data in raw.
+func (field *TracepointField) bytes(raw []byte) ([]byte, error) {
+	if field.Offset < 0 || field.Offset+field.Size > len(raw) {
+		return nil, fmt.Errorf("perf: raw data too short for field %s", field.Name)
+	}
+	b := raw[field.Offset : field.Offset+field.Size]
+	if !field.Dynamic {
+		return b, nil
+	}
+	if field.Size != 4 {
+		return nil, fmt.Errorf("perf: bad descriptor size %d for dynamic field %s", field.Size, field.Name)
+	}
+	loc := nativeEndian.Uint32(b)
+	off, size := int(loc&0xffff), int(loc>>16)
+	if field.Relative {
+		off += field.Offset + field.Size
+	}
+	if off+size > len(raw) {
+		return nil, fmt.Errorf("perf: raw data too short for dynamic field %s", field.Name)
+	}
+	return raw[off : off+size], nil
+}
+
+// decodeUint decodes an integer field, zero-extended to 64 bits.
+func (field *TracepointField) decodeUint(raw []byte) (uint64, error) {
+	b, err := field.bytes(raw)
+	if err != nil {
+		return 0, err
+	}
+	switch len(b) {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(nativeEndian.Uint16(b)), nil
+	case 4:
+		return uint64(nativeEndian.Uint32(b)), nil
+	case 8:
+		return nativeEndian.Uint64(b), nil
+	}
+	return 0, fmt.Errorf("perf: field %s is not an integer", field.Name)
+}
+
+func (field *TracepointField) decode(raw []byte) (interface{}, error) {
+	b, err := field.bytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	if field.isString() {
+		if i := strings.IndexByte(string(b), 0); i >= 0 {
+			b = b[:i]
+		}
+		return string(b), nil
+	}
+	if !field.Array {
+		if v, ok := decodeInteger(b, field.Signed); ok {
+			return v, nil
+		}
+		return append([]byte(nil), b...), nil
+	}
+	return decodeIntegers(b, field.elemSize(), field.Signed), nil
+}
+
+// decodeInteger decodes an integer of size len(b).
+func decodeInteger(b []byte, signed bool) (interface{}, bool) {
+	switch len(b) {
+	case 1:
+		if signed {
+			return int8(b[0]), true
+		}
+		return b[0], true
+	case 2:
+		v := nativeEndian.Uint16(b)
+		if signed {
+			return int16(v), true
+		}
+		return v, true
+	case 4:
+		v := nativeEndian.Uint32(b)
+		if signed {
+			return int32(v), true
+		}
+		return v, true
+	case 8:
+		v := nativeEndian.Uint64(b)
+		if signed {
+			return int64(v), true
+		}
+		return v, true
+	}
+	return nil, false
+}
+
+// decodeIntegers decodes an array of integers of the specified size into
+// a slice of the appropriate type. If the size is not that of an integer,
+// decodeIntegers returns a copy of b.
+func decodeIntegers(b []byte, size int, signed bool) interface{} {
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		return append([]byte(nil), b...)
+	}
+	n := len(b) / size
+	zero, _ := decodeInteger(make([]byte, size), signed)
+	s := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(zero)), n, n)
+	for i := 0; i < n; i++ {
+		v, _ := decodeInteger(b[i*size:(i+1)*size], signed)
+		s.Index(i).Set(reflect.ValueOf(v))
+	}
+	return s.Interface()
+}
+
+// assignTracepointValue stores a value produced by decode into dst.
+func assignTracepointValue(dst reflect.Value, val interface{}) error {
+	src := reflect.ValueOf(val)
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	switch src.Kind() {
+	case reflect.String:
+		if dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes([]byte(src.String()))
+			return nil
+		}
+	case reflect.Slice:
+		if dst.Kind() != reflect.Slice {
+			break
+		}
+		s := reflect.MakeSlice(dst.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			if err := assignTracepointValue(s.Index(i), src.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+		return nil
+	default:
+		switch dst.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			switch src.Kind() {
+			case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				dst.SetInt(src.Int())
+			default:
+				dst.SetInt(int64(src.Uint()))
+			}
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			switch src.Kind() {
+			case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				dst.SetUint(uint64(src.Int()))
+			default:
+				dst.SetUint(src.Uint())
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot assign %s to %s", src.Type(), dst.Type())
+}
+
+// nativeEndian is the byte order of the machine.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
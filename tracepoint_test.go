@@ -0,0 +1,232 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"acln.ro/perf"
+)
+
+func TestTracepointFormat(t *testing.T) {
+	t.Run("Parse", testParseTracepointFormat)
+	t.Run("Decode", testTracepointDecode)
+	t.Run("DecodeDynamic", testTracepointDecodeDynamic)
+	t.Run("DecodeRelative", testTracepointDecodeRelative)
+	t.Run("Unmarshal", testTracepointUnmarshal)
+	t.Run("Errors", testTracepointFormatErrors)
+}
+
+func lookupFixtureFormat(t *testing.T, category, event string) *perf.TracepointFormat {
+	t.Helper()
+
+	perf.SetTracefsRoot(fixtureTracefs)
+	defer perf.SetTracefsRoot("")
+
+	tf, err := perf.LookupTracepointFormat(category, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+func testParseTracepointFormat(t *testing.T) {
+	tf := lookupFixtureFormat(t, "sched", "sched_switch")
+	if tf.Name != "sched_switch" || tf.ID != 316 {
+		t.Fatalf("got name %q, ID %d, want sched_switch, 316", tf.Name, tf.ID)
+	}
+	if len(tf.Common) != 4 || len(tf.Fields) != 7 {
+		t.Fatalf("got %d common fields, %d fields, want 4, 7", len(tf.Common), len(tf.Fields))
+	}
+	want := perf.TracepointField{
+		Name:     "prev_comm",
+		Type:     "char",
+		Offset:   8,
+		Size:     16,
+		Array:    true,
+		ArrayLen: 16,
+	}
+	if got := tf.Fields[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	want = perf.TracepointField{
+		Name:   "prev_state",
+		Type:   "long",
+		Offset: 32,
+		Size:   8,
+		Signed: true,
+	}
+	if got := tf.Fields[3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !strings.HasPrefix(tf.PrintFmt, `"prev_comm=%s`) {
+		t.Errorf("got print fmt %q", tf.PrintFmt)
+	}
+}
+
+// rawHeader returns the common fields of tracepoint raw data.
+func rawHeader(typ uint16, pid int32) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint16(b[0:], typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(pid))
+	return b
+}
+
+func putUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func testTracepointDecode(t *testing.T) {
+	tf := lookupFixtureFormat(t, "sched", "sched_switch")
+
+	raw := rawHeader(316, 42)
+	raw = append(raw, "swapper/0\x00\x00\x00\x00\x00\x00\x00"...)
+	raw = putUint32(raw, 0)
+	raw = putUint32(raw, 120)
+	raw = append(raw, 1, 0, 0, 0, 0, 0, 0, 0)
+	raw = append(raw, "perf.test\x00\x00\x00\x00\x00\x00\x00"...)
+	raw = putUint32(raw, 1234)
+	raw = putUint32(raw, 0xffffffff)
+
+	common, err := tf.DecodeCommon(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if common.Type != 316 || common.PID != 42 {
+		t.Errorf("got common fields %+v", common)
+	}
+
+	got, err := tf.Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"prev_comm":  "swapper/0",
+		"prev_pid":   int32(0),
+		"prev_prio":  int32(120),
+		"prev_state": int64(1),
+		"next_comm":  "perf.test",
+		"next_pid":   int32(1234),
+		"next_prio":  int32(-1),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func testTracepointDecodeDynamic(t *testing.T) {
+	tf := lookupFixtureFormat(t, "sched", "sched_process_exec")
+
+	raw := rawHeader(314, 7)
+	raw = putUint32(raw, 20|10<<16)
+	raw = putUint32(raw, 7)
+	raw = putUint32(raw, 7)
+	raw = append(raw, "/bin/true\x00"...)
+
+	got, err := tf.Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["filename"] != "/bin/true" {
+		t.Fatalf("got filename %q, want %q", got["filename"], "/bin/true")
+	}
+}
+
+func testTracepointDecodeRelative(t *testing.T) {
+	const format = `name: rel
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__rel_loc u16[] ports;	offset:8;	size:4;	signed:0;
+`
+	tf, err := perf.ParseTracepointFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := tf.Fields[0]
+	if !f.Dynamic || !f.Relative || !f.Array || f.Type != "u16" {
+		t.Fatalf("got %+v", f)
+	}
+
+	raw := rawHeader(1, 1)
+	raw = putUint32(raw, 0|4<<16)
+	raw = append(raw, 80, 0, 0xbb, 0x01)
+	got, err := tf.Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint16{80, 443}; !reflect.DeepEqual(got["ports"], want) {
+		t.Fatalf("got ports %v, want %v", got["ports"], want)
+	}
+}
+
+func testTracepointUnmarshal(t *testing.T) {
+	tf := lookupFixtureFormat(t, "sched", "sched_process_exec")
+
+	raw := rawHeader(314, 7)
+	raw = putUint32(raw, 20|10<<16)
+	raw = putUint32(raw, 7)
+	raw = putUint32(raw, 5)
+	raw = append(raw, "/bin/true\x00"...)
+
+	var exec struct {
+		PID      int    `perf:"common_pid"`
+		Filename string `perf:"filename"`
+		OldPID   uint64 `perf:"old_pid"`
+		Ignored  string
+	}
+	if err := tf.Unmarshal(raw, &exec); err != nil {
+		t.Fatal(err)
+	}
+	if exec.PID != 7 || exec.Filename != "/bin/true" || exec.OldPID != 5 {
+		t.Fatalf("got %+v", exec)
+	}
+
+	var bad struct {
+		Missing int `perf:"missing"`
+	}
+	if err := tf.Unmarshal(raw, &bad); err == nil {
+		t.Error("Unmarshal succeeded with missing field")
+	}
+	var mistyped struct {
+		Filename int `perf:"filename"`
+	}
+	if err := tf.Unmarshal(raw, &mistyped); err == nil {
+		t.Error("Unmarshal succeeded with mistyped field")
+	}
+	var unexported struct {
+		pid int `perf:"common_pid"`
+	}
+	if err := tf.Unmarshal(raw, &unexported); err == nil {
+		t.Errorf("Unmarshal succeeded with unexported field, got pid %d", unexported.pid)
+	}
+	if err := tf.Unmarshal(raw, exec); err == nil {
+		t.Error("Unmarshal succeeded with non-pointer")
+	}
+}
+
+func testTracepointFormatErrors(t *testing.T) {
+	tf := lookupFixtureFormat(t, "sched", "sched_switch")
+	if _, err := tf.Decode(make([]byte, 32)); err == nil {
+		t.Error("Decode succeeded with short raw data")
+	}
+	for _, format := range []string{
+		"",
+		"name: x\nformat:\n\tfield:int;\toffset:0;\tsize:4;\tsigned:1;\n",
+		"name: x\nformat:\n\tfield:int a;\toffset:x;\tsize:4;\tsigned:1;\n",
+		"name: x\nformat:\n\tfield:int a;\tsize:4;\tsigned:1;\n",
+	} {
+		if _, err := perf.ParseTracepointFormat(strings.NewReader(format)); err == nil {
+			t.Errorf("ParseTracepointFormat(%q) succeeded", format)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LookupUncoreBoxes loads the uncore PMUs of the specified type, as
+// registered under /sys/bus/event_source/devices. See LoadUncoreBoxes.
+func LookupUncoreBoxes(typ string) ([]*PMU, error) {
+	return LoadUncoreBoxes(pmuDevicesDir, typ)
+}
+
+// LoadUncoreBoxes loads the uncore PMUs of the specified type from the
+// specified sysfs directory. Uncore units are often replicated in boxes,
+// registered as separate PMUs named <type>_<n>: for example, the caching
+// and home agents of the last level cache are named uncore_cha_0 through
+// uncore_cha_N. A PMU named <type> is also loaded, if present. The boxes
+// are sorted by number.
+//
+// LoadUncoreBoxes returns an error if no boxes are found, or if any of
+// them lacks a cpumask.
+func LoadUncoreBoxes(dir string, typ string) ([]*PMU, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type box struct {
+		n    int
+		name string
+	}
+	var found []box
+	for _, info := range infos {
+		name := info.Name()
+		if name == typ {
+			found = append(found, box{n: -1, name: name})
+			continue
+		}
+		if !strings.HasPrefix(name, typ+"_") {
+			continue
+		}
+		n, err := strconv.Atoi(name[len(typ)+1:])
+		if err != nil || n < 0 {
+			continue
+		}
+		found = append(found, box{n: n, name: name})
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("perf: no uncore PMUs of type %q", typ)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].n < found[j].n })
+
+	boxes := make([]*PMU, 0, len(found))
+	for _, b := range found {
+		pmu, err := LoadPMU(filepath.Join(dir, b.name))
+		if err != nil {
+			return nil, err
+		}
+		if len(pmu.CPUMask) == 0 {
+			return nil, fmt.Errorf("perf: PMU %s is not an uncore PMU: no cpumask", pmu.Name)
+		}
+		boxes = append(boxes, pmu)
+	}
+	return boxes, nil
+}
+
+// UncoreEvent is an event opened on a set of uncore boxes of the same type.
+//
+// Uncore PMUs count system-wide, on behalf of a socket or die, rather than
+// on behalf of a task. Each box lists, in its cpumask, one CPU per socket
+// or die, and events must be opened on exactly those CPUs: opening an
+// uncore event on every CPU counts the same events many times over.
+// OpenUncore opens one event per box, per CPU in the cpumask of the box.
+type UncoreEvent struct {
+	label  string
+	scale  float64
+	unit   string
+	boxes  []*PMU
+	cpus   []int
+	events []*Event
+}
+
+// OpenUncore opens an event on each of the specified boxes, on each CPU in
+// their cpumask, measuring all threads. The event is specified by a comma
+// separated list of terms, as for PMU.Event, and is encoded separately for
+// each box. The terms must be valid for every box.
+//
+// If a is not nil, it serves as a template for the options and count
+// format of the events. The Enabled and Running count format options are
+// set automatically, so that counts can be scaled.
+//
+// Measuring uncore events requires CAP_PERFMON or CAP_SYS_ADMIN, or a
+// perf_event_paranoid setting of at most 0.
+func OpenUncore(boxes []*PMU, terms string, a *Attr) (*UncoreEvent, error) {
+	if len(boxes) == 0 {
+		return nil, fmt.Errorf("perf: no uncore PMUs for %q", terms)
+	}
+	ue := &UncoreEvent{
+		label: fmt.Sprintf("%s/%s/", uncoreBoxType(boxes[0].Name), terms),
+		scale: 1,
+	}
+	if scale, unit, ok := boxes[0].eventScale(terms); ok {
+		ue.scale, ue.unit = scale, unit
+	}
+	for _, box := range boxes {
+		if len(box.CPUMask) == 0 {
+			ue.Close()
+			return nil, fmt.Errorf("perf: PMU %s is not an uncore PMU: no cpumask", box.Name)
+		}
+		for _, cpu := range box.CPUMask {
+			attr := new(Attr)
+			if a != nil {
+				*attr = *a
+			}
+			attr.CountFormat.Enabled = true
+			attr.CountFormat.Running = true
+			if err := box.Encode(attr, terms); err != nil {
+				ue.Close()
+				return nil, err
+			}
+			attr.Label = fmt.Sprintf("%s/%s/", box.Name, terms)
+			ev, err := Open(attr, AllThreads, cpu, nil)
+			if err != nil {
+				ue.Close()
+				return nil, err
+			}
+			ue.boxes = append(ue.boxes, box)
+			ue.cpus = append(ue.cpus, cpu)
+			ue.events = append(ue.events, ev)
+		}
+	}
+	return ue, nil
+}
+
+// uncoreBoxType returns the type of the uncore box called name, e.g.
+// uncore_cha for uncore_cha_3.
+func uncoreBoxType(name string) string {
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return name
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return name
+	}
+	return name[:i]
+}
+
+// eventScale returns the scale and unit of the named event in terms, if
+// the PMU describes them.
+func (pmu *PMU) eventScale(terms string) (scale float64, unit string, ok bool) {
+	ts, err := parsePMUTerms(terms)
+	if err != nil {
+		return 0, "", false
+	}
+	for _, t := range ts {
+		if !t.bare {
+			continue
+		}
+		if s, found := pmu.Scales[t.name]; found {
+			return s, pmu.Units[t.name], true
+		}
+	}
+	return 0, "", false
+}
+
+// Events returns the underlying events, one per box and CPU.
+func (ue *UncoreEvent) Events() []*Event {
+	return ue.events
+}
+
+// Enable enables the event on all boxes.
+func (ue *UncoreEvent) Enable() error {
+	return ue.each((*Event).Enable)
+}
+
+// Disable disables the event on all boxes.
+func (ue *UncoreEvent) Disable() error {
+	return ue.each((*Event).Disable)
+}
+
+// Reset resets the counters on all boxes.
+func (ue *UncoreEvent) Reset() error {
+	return ue.each((*Event).Reset)
+}
+
+// Close closes the event on all boxes. It returns the first error
+// encountered, if any.
+func (ue *UncoreEvent) Close() error {
+	return ue.each((*Event).Close)
+}
+
+func (ue *UncoreEvent) each(fn func(*Event) error) error {
+	var first error
+	for _, ev := range ue.events {
+		if err := fn(ev); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// UncoreCount is a measurement taken by an UncoreEvent, aggregated across
+// boxes and sockets.
+type UncoreCount struct {
+	// Label is the label of the event, "<type>/<terms>/".
+	Label string
+
+	// Raw is the sum of the raw counts.
+	Raw uint64
+
+	// Value is the sum of the counts, each scaled to account for
+	// multiplexing, then multiplied by the scale of the event, as
+	// found in the <event>.scale file of the PMU.
+	Value float64
+
+	// Unit is the unit of Value, as found in the <event>.unit file of
+	// the PMU, if any.
+	Unit string
+
+	// Enabled and Running are the longest times any of the underlying
+	// events was enabled and running for.
+	Enabled time.Duration
+	Running time.Duration
+
+	// PerBox holds the counts of each box, on each CPU.
+	PerBox []UncoreBoxCount
+}
+
+// UncoreBoxCount is the count of an uncore event on a specific box, on a
+// specific CPU.
+type UncoreBoxCount struct {
+	// PMU is the name of the box, e.g. uncore_cha_3.
+	PMU string
+
+	// CPU is the CPU the event was opened on.
+	CPU int
+
+	Count
+
+	// Scaled is the scaled value of the count, as for UncoreCount.Value.
+	Scaled float64
+}
+
+// ReadCount reads the counts of all boxes, and aggregates them. Counts
+// which were never scheduled do not contribute to the aggregated value.
+func (ue *UncoreEvent) ReadCount() (UncoreCount, error) {
+	uc := UncoreCount{Label: ue.label, Unit: ue.unit}
+	for i, ev := range ue.events {
+		c, err := ev.ReadCount()
+		if err != nil {
+			return UncoreCount{}, err
+		}
+		sv := c.Scaled()
+		bc := UncoreBoxCount{
+			PMU:    ue.boxes[i].Name,
+			CPU:    ue.cpus[i],
+			Count:  c,
+			Scaled: sv.Value * ue.scale,
+		}
+		uc.PerBox = append(uc.PerBox, bc)
+		uc.Raw += c.Value
+		uc.Value += bc.Scaled
+		if c.Enabled > uc.Enabled {
+			uc.Enabled = c.Enabled
+		}
+		if c.Running > uc.Running {
+			uc.Running = c.Running
+		}
+	}
+	return uc, nil
+}
+
+// Measure disables and resets the event on all boxes, enables it, runs f,
+// disables it again, then reads the aggregated count.
+func (ue *UncoreEvent) Measure(f func()) (UncoreCount, error) {
+	if err := ue.Disable(); err != nil {
+		return UncoreCount{}, err
+	}
+	if err := ue.Reset(); err != nil {
+		return UncoreCount{}, err
+	}
+	if err := ue.Enable(); err != nil {
+		return UncoreCount{}, err
+	}
+	f()
+	if err := ue.Disable(); err != nil {
+		return UncoreCount{}, err
+	}
+	return ue.ReadCount()
+}
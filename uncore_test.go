@@ -0,0 +1,133 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"acln.ro/perf"
+)
+
+// fixtureUncoreDevices is the directory containing fixture uncore PMUs.
+// The uncore_sw boxes are backed by the software PMU, so that events can
+// be opened on them on machines without uncore PMUs.
+var fixtureUncoreDevices = filepath.Join("testdata", "sysfs-uncore", "bus", "event_source", "devices")
+
+func TestUncore(t *testing.T) {
+	t.Run("LoadBoxes", testLoadUncoreBoxes)
+	t.Run("LoadBoxesErrors", testLoadUncoreBoxesErrors)
+	t.Run("ScaleUnit", testUncoreScaleUnit)
+	t.Run("NoCPUMask", testOpenUncoreNoCPUMask)
+	t.Run("Aggregate", testOpenUncoreAggregate)
+}
+
+func testLoadUncoreBoxes(t *testing.T) {
+	boxes, err := perf.LoadUncoreBoxes(fixtureUncoreDevices, "uncore_cha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, box := range boxes {
+		names = append(names, box.Name)
+		if !reflect.DeepEqual(box.CPUMask, []int{0, 18}) {
+			t.Errorf("%s: got cpumask %v, want [0 18]", box.Name, box.CPUMask)
+		}
+	}
+	want := []string{"uncore_cha_0", "uncore_cha_1", "uncore_cha_2", "uncore_cha_10"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got boxes %q, want %q", names, want)
+	}
+}
+
+func testLoadUncoreBoxesErrors(t *testing.T) {
+	if _, err := perf.LoadUncoreBoxes(fixtureUncoreDevices, "uncore_upi"); err == nil {
+		t.Error("loaded missing uncore boxes")
+	}
+	if _, err := perf.LoadUncoreBoxes(fixtureUncoreDevices, "cpu"); err == nil {
+		t.Error("loaded core PMU as an uncore box")
+	}
+}
+
+func testUncoreScaleUnit(t *testing.T) {
+	boxes, err := perf.LoadUncoreBoxes(fixtureUncoreDevices, "uncore_imc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, box := range boxes {
+		if got := box.Scales["cas_count_read"]; got != 6.103515625e-5 {
+			t.Errorf("%s: got scale %v, want 6.103515625e-5", box.Name, got)
+		}
+		if got := box.Units["cas_count_read"]; got != "MiB" {
+			t.Errorf("%s: got unit %q, want MiB", box.Name, got)
+		}
+		if _, ok := box.Scales["clockticks"]; ok {
+			t.Errorf("%s: clockticks has a scale", box.Name)
+		}
+		want := []string{"cas_count_read", "clockticks"}
+		if got := box.EventNames(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got events %q, want %q", box.Name, got, want)
+		}
+	}
+}
+
+func testOpenUncoreNoCPUMask(t *testing.T) {
+	cpu, err := perf.LoadPMU(filepath.Join(fixtureUncoreDevices, "cpu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := perf.OpenUncore([]*perf.PMU{cpu}, "event=0x3c", nil); err == nil {
+		t.Fatal("opened uncore event on PMU without cpumask")
+	}
+}
+
+func testOpenUncoreAggregate(t *testing.T) {
+	requires(t, paranoid(0), softwarePMU)
+
+	boxes, err := perf.LoadUncoreBoxes(fixtureUncoreDevices, "uncore_sw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &perf.Attr{
+		Options: perf.Options{Disabled: true},
+	}
+	ue, err := perf.OpenUncore(boxes, "clock", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ue.Close()
+
+	uc, err := ue.Measure(func() {
+		spin(5 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uc.Label != "uncore_sw/clock/" || uc.Unit != "msec" {
+		t.Errorf("got label %q, unit %q, want uncore_sw/clock/, msec", uc.Label, uc.Unit)
+	}
+	if len(uc.PerBox) != 2 {
+		t.Fatalf("got %d per-box counts, want 2", len(uc.PerBox))
+	}
+	var raw uint64
+	for i, bc := range uc.PerBox {
+		if bc.PMU != boxes[i].Name || bc.CPU != 0 {
+			t.Errorf("count %d: got %s on CPU %d, want %s on CPU 0", i, bc.PMU, bc.CPU, boxes[i].Name)
+		}
+		if bc.Value == 0 {
+			t.Errorf("%s: not counted", bc.PMU)
+		}
+		raw += bc.Value
+	}
+	if uc.Raw != raw {
+		t.Errorf("got raw value %d, want the sum of per-box values, %d", uc.Raw, raw)
+	}
+	if want := float64(raw) * 1e-6; math.Abs(uc.Value-want) > want*1e-9 {
+		t.Errorf("got scaled value %v msec, want %v", uc.Value, want)
+	}
+}
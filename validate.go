@@ -0,0 +1,96 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ValidationError is returned by Attr.Validate if the attributes are
+// known to be rejected by the kernel. It lists all the problems found.
+type ValidationError struct {
+	// Label is the label of the offending Attr.
+	Label string
+
+	// Problems describes each violated rule, in plain words.
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	what := "attributes"
+	if e.Label != "" {
+		what = fmt.Sprintf("attributes for %q", e.Label)
+	}
+	return fmt.Sprintf("perf: invalid %s: %s", what, strings.Join(e.Problems, "; "))
+}
+
+// Validate checks a for combinations of fields which are known to be
+// invalid, and which would otherwise cause Open to fail with a plain
+// EINVAL. If any problems are found, Validate returns a *ValidationError
+// describing all of them.
+//
+// Validate does not guarantee that Open will succeed: support for events
+// and features varies between kernels and hardware.
+func (a *Attr) Validate() error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if a.Options.Inherit && a.CountFormat.Group {
+		report("Options.Inherit cannot be combined with CountFormat.Group")
+	}
+	if a.Type == BreakpointEvent {
+		bt := BreakpointType(a.BreakpointType)
+		if bt&BreakpointTypeX != 0 && bt&BreakpointTypeRW != 0 {
+			report("BreakpointTypeR and BreakpointTypeW cannot be combined with BreakpointTypeX")
+		}
+	}
+	if a.SampleMaxStack != 0 {
+		if max, err := MaxStack(); err == nil && a.SampleMaxStack >= max {
+			report("SampleMaxStack (%d) must be less than MaxStack() (%d)", a.SampleMaxStack, max)
+		}
+	}
+	if a.Options.Freq && a.Sample == 0 {
+		report("Options.Freq is set, but the sample frequency (Sample) is zero")
+	}
+	if a.Options.Watermark && a.Wakeup == 0 {
+		report("Options.Watermark is set, but the watermark (Wakeup) is zero")
+	}
+	if a.Options.UseClockID && !validClockID(a.ClockID) {
+		report("Options.UseClockID is set, but ClockID (%d) is not a supported clock", a.ClockID)
+	}
+	if a.SampleFormat.UserStack {
+		switch {
+		case a.SampleStackUser == 0:
+			report("SampleFormat.UserStack is set, but SampleStackUser is zero")
+		case a.SampleStackUser%8 != 0:
+			report("SampleStackUser (%d) must be a multiple of 8", a.SampleStackUser)
+		case a.SampleStackUser >= 1<<16-1:
+			report("SampleStackUser (%d) must be less than 65535", a.SampleStackUser)
+		}
+	}
+	if a.SampleFormat.BranchStack && a.BranchSampleFormat.Sample == 0 {
+		report("SampleFormat.BranchStack is set, but BranchSampleFormat specifies no branch types")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Label: a.Label, Problems: problems}
+}
+
+// validClockID reports whether id is a clock accepted by perf_event_open.
+func validClockID(id int32) bool {
+	switch id {
+	case unix.CLOCK_REALTIME, unix.CLOCK_MONOTONIC, unix.CLOCK_MONOTONIC_RAW,
+		unix.CLOCK_BOOTTIME, unix.CLOCK_TAI:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"strings"
+	"testing"
+
+	"acln.ro/perf"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestValidate(t *testing.T) {
+	t.Run("Valid", testValidateValid)
+	t.Run("Rules", testValidateRules)
+	t.Run("AllProblems", testValidateAllProblems)
+	t.Run("Open", testValidateOpen)
+	t.Run("Group", testValidateGroup)
+}
+
+func testValidateValid(t *testing.T) {
+	attrs := []*perf.Attr{
+		new(perf.Attr),
+		{
+			Type:           perf.BreakpointEvent,
+			BreakpointType: uint32(perf.BreakpointTypeRW),
+		},
+		{
+			Sample:          1000,
+			Options:         perf.Options{Freq: true, UseClockID: true},
+			ClockID:         unix.CLOCK_MONOTONIC,
+			SampleFormat:    perf.SampleFormat{UserStack: true},
+			SampleStackUser: 8192,
+		},
+	}
+	for _, a := range attrs {
+		if err := a.Validate(); err != nil {
+			t.Errorf("%+v: %v", a, err)
+		}
+	}
+}
+
+func testValidateRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		attr    perf.Attr
+		problem string
+	}{
+		{
+			name: "InheritGroup",
+			attr: perf.Attr{
+				Options:     perf.Options{Inherit: true},
+				CountFormat: perf.CountFormat{Group: true},
+			},
+			problem: "Inherit",
+		},
+		{
+			name: "BreakpointRX",
+			attr: perf.Attr{
+				Type:           perf.BreakpointEvent,
+				BreakpointType: uint32(perf.BreakpointTypeR | perf.BreakpointTypeX),
+			},
+			problem: "BreakpointTypeX",
+		},
+		{
+			name:    "FreqZero",
+			attr:    perf.Attr{Options: perf.Options{Freq: true}},
+			problem: "Freq",
+		},
+		{
+			name:    "WatermarkZero",
+			attr:    perf.Attr{Options: perf.Options{Watermark: true}},
+			problem: "Watermark",
+		},
+		{
+			name: "BadClockID",
+			attr: perf.Attr{
+				Options: perf.Options{UseClockID: true},
+				ClockID: 42,
+			},
+			problem: "ClockID",
+		},
+		{
+			name:    "UserStackZero",
+			attr:    perf.Attr{SampleFormat: perf.SampleFormat{UserStack: true}},
+			problem: "SampleStackUser",
+		},
+		{
+			name: "UserStackUnaligned",
+			attr: perf.Attr{
+				SampleFormat:    perf.SampleFormat{UserStack: true},
+				SampleStackUser: 100,
+			},
+			problem: "multiple of 8",
+		},
+		{
+			name:    "BranchStack",
+			attr:    perf.Attr{SampleFormat: perf.SampleFormat{BranchStack: true}},
+			problem: "BranchSampleFormat",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.attr.Validate()
+			verr, ok := err.(*perf.ValidationError)
+			if !ok {
+				t.Fatalf("got %v, want *perf.ValidationError", err)
+			}
+			if len(verr.Problems) != 1 || !strings.Contains(verr.Problems[0], tt.problem) {
+				t.Fatalf("got problems %q, want one mentioning %q", verr.Problems, tt.problem)
+			}
+		})
+	}
+
+	t.Run("SampleMaxStack", func(t *testing.T) {
+		max, err := perf.MaxStack()
+		if err != nil {
+			t.Skip(err)
+		}
+		a := &perf.Attr{SampleMaxStack: max}
+		if err := a.Validate(); err == nil {
+			t.Fatal("Validate succeeded with SampleMaxStack == MaxStack()")
+		}
+	})
+}
+
+func testValidateAllProblems(t *testing.T) {
+	a := &perf.Attr{
+		Label:        "bad",
+		Options:      perf.Options{Freq: true, Watermark: true},
+		SampleFormat: perf.SampleFormat{BranchStack: true},
+	}
+	err := a.Validate()
+	verr, ok := err.(*perf.ValidationError)
+	if !ok {
+		t.Fatalf("got %v, want *perf.ValidationError", err)
+	}
+	if len(verr.Problems) != 3 {
+		t.Fatalf("got %d problems (%q), want 3", len(verr.Problems), verr.Problems)
+	}
+	if !strings.Contains(err.Error(), `"bad"`) {
+		t.Errorf("error %q does not mention the label", err)
+	}
+}
+
+func testValidateOpen(t *testing.T) {
+	a := &perf.Attr{Options: perf.Options{Freq: true}}
+	perf.PageFaults.Configure(a)
+
+	opts := perf.OpenOptions{Validate: true}
+	_, err := perf.OpenWithOptions(a, perf.CallingThread, perf.AnyCPU, nil, opts)
+	if _, ok := err.(*perf.ValidationError); !ok {
+		t.Fatalf("got %v, want *perf.ValidationError", err)
+	}
+}
+
+func testValidateGroup(t *testing.T) {
+	g := perf.Group{
+		Options:     perf.Options{Watermark: true},
+		OpenOptions: perf.OpenOptions{Validate: true},
+	}
+	g.Add(perf.PageFaults)
+	_, err := g.Open(perf.CallingThread, perf.AnyCPU)
+	if err == nil || !strings.Contains(err.Error(), "Watermark") {
+		t.Fatalf("got %v, want validation error", err)
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EventTableFS is a read-only, slash-separated file system holding vendor
+// event tables, such as a checkout of tools/perf/pmu-events/arch/x86 from
+// the Linux source tree, or of the Intel perfmon repository.
+type EventTableFS interface {
+	// Open opens the named file for reading.
+	Open(name string) (io.ReadCloser, error)
+
+	// ReadDir returns the names of the entries in the named directory.
+	ReadDir(name string) ([]string, error)
+}
+
+// DirFS is an EventTableFS rooted at a directory on disk.
+type DirFS string
+
+// Open implements EventTableFS.
+func (dir DirFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(dir), filepath.FromSlash(name)))
+}
+
+// ReadDir implements EventTableFS.
+func (dir DirFS) ReadDir(name string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(string(dir), filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, nil
+}
+
+// VendorEvent is a named micro-architectural event, as described by vendor
+// event tables. VendorEvent implements Configurator.
+type VendorEvent struct {
+	// Name is the name of the event, e.g. "MEM_LOAD_RETIRED.L3_MISS".
+	Name string
+
+	// Description is a short description of the event.
+	Description string
+
+	// EventCode, UMask, CounterMask, Invert, EdgeDetect and AnyThread
+	// are the fields of the event select register.
+	EventCode   uint64
+	UMask       uint64
+	CounterMask uint64
+	Invert      bool
+	EdgeDetect  bool
+	AnyThread   bool
+
+	// MSRIndex and MSRValue describe an auxiliary MSR used by the event,
+	// such as an offcore response or load latency MSR. MSRValue is
+	// encoded into Attr.Config1.
+	MSRIndex uint64
+	MSRValue uint64
+
+	// PEBS indicates the level of precise event based sampling support:
+	// 0 for none, 1 if supported, 2 if required.
+	PEBS int
+
+	// SampleAfterValue is the recommended sample period for the event.
+	SampleAfterValue uint64
+
+	// Unit is the uncore unit counting the event, e.g. "iMC". It is empty
+	// for core events.
+	Unit string
+}
+
+// Configure configures attr to measure the event. It sets the Label, Type,
+// Config and Config1 fields on attr.
+//
+// Core events are encoded as raw events, using the x86 event select layout.
+// Uncore events are encoded for the uncore_<unit> PMU, or the first box of
+// the unit, uncore_<unit>_0.
+func (ve *VendorEvent) Configure(attr *Attr) error {
+	attr.Label = ve.Name
+	attr.Type = RawEvent
+	if ve.Unit != "" {
+		unit := "uncore_" + strings.ToLower(ve.Unit)
+		pmu, err := LookupPMU(unit)
+		if err != nil {
+			pmu, err = LookupPMU(unit + "_0")
+		}
+		if err != nil {
+			return fmt.Errorf("perf: %s: no PMU for unit %s", ve.Name, ve.Unit)
+		}
+		attr.Type = pmu.Type
+	}
+	attr.Config = ve.config()
+	attr.Config1 = 0
+	if ve.MSRIndex != 0 {
+		attr.Config1 = ve.MSRValue
+	}
+	return nil
+}
+
+// config returns the raw configuration of the event.
+func (ve *VendorEvent) config() uint64 {
+	config := ve.EventCode&0xff | (ve.EventCode>>8&0xf)<<32
+	config |= (ve.UMask & 0xff) << 8
+	if ve.EdgeDetect {
+		config |= 1 << 18
+	}
+	if ve.AnyThread {
+		config |= 1 << 21
+	}
+	if ve.Invert {
+		config |= 1 << 23
+	}
+	config |= (ve.CounterMask & 0xff) << 24
+	return config
+}
+
+// EventTable is a collection of vendor events for a specific CPU.
+type EventTable struct {
+	events  map[string]*VendorEvent
+	metrics []*Metric
+}
+
+// Event returns the named event. Names are not case sensitive.
+func (t *EventTable) Event(name string) (*VendorEvent, error) {
+	ve, ok := t.events[strings.ToUpper(name)]
+	if !ok {
+		return nil, fmt.Errorf("perf: unknown vendor event %q", name)
+	}
+	return ve, nil
+}
+
+// EventNames returns the names of the events in the table, sorted.
+func (t *EventTable) EventNames() []string {
+	names := make([]string, 0, len(t.events))
+	for _, ve := range t.events {
+		names = append(names, ve.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadHostEventTable is like LoadEventTable, for the CPU of the host, as
+// identified by LookupCPUID.
+func LoadHostEventTable(fsys EventTableFS) (*EventTable, error) {
+	cpuid, err := LookupCPUID()
+	if err != nil {
+		return nil, err
+	}
+	return LoadEventTable(fsys, cpuid)
+}
+
+// LoadEventTable loads the core event tables for the CPU identified by
+// cpuid (see LookupCPUID) from fsys.
+//
+// The root of fsys must hold a mapfile.csv file, as found in the Linux
+// source tree and in the Intel perfmon repository. Lines in mapfile.csv
+// associate CPUID regular expressions with a file or directory of JSON
+// event tables. All matching lines with a core event type are loaded.
+func LoadEventTable(fsys EventTableFS, cpuid string) (*EventTable, error) {
+	files, err := matchMapfile(fsys, cpuid)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("perf: no event tables for CPU %s", cpuid)
+	}
+	t := &EventTable{events: map[string]*VendorEvent{}}
+	for _, file := range files {
+		if err := t.load(fsys, file); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Metrics returns the metrics defined alongside the events in the table,
+// in the order in which they were loaded. Metrics whose expressions use
+// syntax which ParseMetric does not support are omitted.
+func (t *EventTable) Metrics() []*Metric {
+	return t.metrics
+}
+
+// load loads the events in the named file, or in the JSON files of the
+// named directory.
+func (t *EventTable) load(fsys EventTableFS, name string) error {
+	names := []string{name}
+	if path.Ext(name) != ".json" {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		names = names[:0]
+		for _, entry := range entries {
+			if path.Ext(entry) == ".json" {
+				names = append(names, path.Join(name, entry))
+			}
+		}
+	}
+	for _, name := range names {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		entries, err := parseEventTableEntries(data)
+		if err != nil {
+			return fmt.Errorf("perf: %s: %v", name, err)
+		}
+		for _, e := range entries {
+			switch {
+			case e.EventName != "":
+				ve := e.event()
+				t.events[strings.ToUpper(ve.Name)] = &ve
+			case e.MetricName != "" && e.MetricExpr != "":
+				m, err := e.metric()
+				if err != nil {
+					continue // uses syntax we do not support
+				}
+				t.metrics = append(t.metrics, m)
+			}
+		}
+	}
+	return nil
+}
+
+// matchMapfile returns the event table files associated with cpuid
+// in mapfile.csv.
+func matchMapfile(fsys EventTableFS, cpuid string) ([]string, error) {
+	f, err := fsys.Open("mapfile.csv")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("perf: mapfile.csv: %v", err)
+	}
+
+	// Identifiers may or may not include the stepping.
+	ids := []string{cpuid}
+	if strings.Count(cpuid, "-") == 3 {
+		ids = append(ids, cpuid[:strings.LastIndex(cpuid, "-")])
+	}
+
+	var files []string
+	for _, rec := range records {
+		if len(rec) < 3 || rec[0] == "Family-model" {
+			continue
+		}
+		if len(rec) >= 4 && rec[3] != "" && rec[3] != "core" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + rec[0] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("perf: mapfile.csv: %v", err)
+		}
+		for _, id := range ids {
+			if re.MatchString(id) {
+				files = append(files, strings.TrimPrefix(rec[2], "/"))
+				break
+			}
+		}
+	}
+	return files, nil
+}
+
+// ParseEventTableJSON parses vendor events in JSON format. It accepts
+// the format used by tools/perf/pmu-events in the Linux source tree (an
+// array of events), as well as the one used by the Intel perfmon repository
+// (an object holding the array in its Events field).
+func ParseEventTableJSON(r io.Reader) ([]VendorEvent, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseEventTableEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]VendorEvent, 0, len(entries))
+	for _, e := range entries {
+		if e.EventName == "" {
+			continue // e.g. metric definitions
+		}
+		events = append(events, e.event())
+	}
+	return events, nil
+}
+
+// parseEventTableEntries parses the entries of a JSON event table.
+func parseEventTableEntries(data []byte) ([]jsonVendorEvent, error) {
+	var entries []jsonVendorEvent
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var doc struct {
+			Events []jsonVendorEvent
+		}
+		err = json.Unmarshal(data, &doc)
+		entries = doc.Events
+	} else {
+		err = json.Unmarshal(data, &entries)
+	}
+	return entries, err
+}
+
+// event returns the event described by e.
+func (e *jsonVendorEvent) event() VendorEvent {
+	return VendorEvent{
+		Name:             e.EventName,
+		Description:      e.BriefDescription,
+		EventCode:        uint64(e.EventCode),
+		UMask:            uint64(e.UMask),
+		CounterMask:      uint64(e.CounterMask),
+		Invert:           e.Invert != 0,
+		EdgeDetect:       e.EdgeDetect != 0,
+		AnyThread:        e.AnyThread != 0,
+		MSRIndex:         uint64(e.MSRIndex),
+		MSRValue:         uint64(e.MSRValue),
+		PEBS:             int(e.PEBS),
+		SampleAfterValue: uint64(e.SampleAfterValue),
+		Unit:             e.Unit,
+	}
+}
+
+// jsonVendorEvent is the JSON representation of a vendor event.
+type jsonVendorEvent struct {
+	EventName        string
+	BriefDescription string
+	EventCode        jsonUint
+	UMask            jsonUint
+	CounterMask      jsonUint
+	Invert           jsonUint
+	EdgeDetect       jsonUint
+	AnyThread        jsonUint
+	MSRIndex         jsonUint
+	MSRValue         jsonUint
+	PEBS             jsonUint
+	SampleAfterValue jsonUint
+	Unit             string
+
+	MetricName  string
+	MetricExpr  string
+	MetricGroup string
+	ScaleUnit   string
+}
+
+// jsonUint is an unsigned integer, encoded in JSON as a number or as
+// a string such as "0xD1". Where a list of values is given, such as
+// "0xB7, 0xBB", the first one is used. Empty strings decode to zero.
+type jsonUint uint64
+
+func (u *jsonUint) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	if s == "" || s == "null" || strings.EqualFold(s, "na") {
+		*u = 0
+		return nil
+	}
+	v, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return fmt.Errorf("bad value %q: %v", s, err)
+	}
+	*u = jsonUint(v)
+	return nil
+}
+
+// LookupCPUID returns the identifier of the host CPU, as read from
+// /proc/cpuinfo. See ParseCPUID for the format of the identifier.
+func LookupCPUID() (string, error) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return ParseCPUID(f)
+}
+
+// ParseCPUID returns the identifier of the first CPU listed in r, which
+// holds data in the format of /proc/cpuinfo. The identifier is of the form
+// <vendor>-<family>-<model>-<stepping>, with model and stepping in upper
+// case hexadecimal, e.g. "GenuineIntel-6-55-4". This is the format used
+// by mapfile.csv.
+func ParseCPUID(r io.Reader) (string, error) {
+	var vendor, family, model, stepping string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" && vendor != "" {
+			break // end of the first CPU
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:colon])
+		val := strings.TrimSpace(line[colon+1:])
+		switch key {
+		case "vendor_id":
+			vendor = val
+		case "cpu family":
+			family = val
+		case "model":
+			model = val
+		case "stepping":
+			stepping = val
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	if vendor == "" || family == "" || model == "" {
+		return "", fmt.Errorf("perf: cpuinfo does not identify the CPU")
+	}
+	m, err := strconv.ParseUint(model, 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("perf: bad CPU model %q", model)
+	}
+	id := fmt.Sprintf("%s-%s-%X", vendor, family, m)
+	if s, err := strconv.ParseUint(stepping, 10, 32); err == nil {
+		id += fmt.Sprintf("-%X", s)
+	}
+	return id, nil
+}
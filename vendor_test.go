@@ -0,0 +1,138 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perf_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"acln.ro/perf"
+)
+
+// fixtureEventTables is an EventTableFS holding fixture vendor event tables.
+var fixtureEventTables = perf.DirFS(filepath.Join("testdata", "pmu-events"))
+
+func TestVendorEvents(t *testing.T) {
+	t.Run("CPUID", testParseCPUID)
+	t.Run("Load", testLoadEventTable)
+	t.Run("LoadPerfmon", testLoadPerfmonEventTable)
+	t.Run("Encode", testVendorEventEncode)
+	t.Run("NoTable", testLoadEventTableNoMatch)
+	t.Run("BadJSON", testParseEventTableBadJSON)
+}
+
+func testParseCPUID(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "cpuinfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	id, err := perf.ParseCPUID(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "GenuineIntel-6-55-4"; id != want {
+		t.Fatalf("got %q, want %q", id, want)
+	}
+	if _, err := perf.ParseCPUID(strings.NewReader("processor : 0\n")); err == nil {
+		t.Fatal("ParseCPUID succeeded without vendor information")
+	}
+}
+
+func testLoadEventTable(t *testing.T) {
+	table, err := perf.LoadEventTable(fixtureEventTables, "GenuineIntel-6-55-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"MEM_LOAD_RETIRED.L3_MISS",
+		"MEM_TRANS_RETIRED.LOAD_LATENCY_GT_32",
+		"OCR.DEMAND_DATA_RD.ANY_RESPONSE",
+		"OTHER_ASSISTS.ANY",
+		"UOPS_RETIRED.TOTAL_CYCLES",
+	}
+	if got := table.EventNames(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	ve, err := table.Event("mem_load_retired.l3_miss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ve.PEBS != 1 || ve.SampleAfterValue != 50021 || ve.Unit != "" {
+		t.Errorf("got %+v", ve)
+	}
+	if _, err := table.Event("NO_SUCH.EVENT"); err == nil {
+		t.Error("Event succeeded for unknown event")
+	}
+}
+
+func testLoadPerfmonEventTable(t *testing.T) {
+	table, err := perf.LoadEventTable(fixtureEventTables, "GenuineIntel-6-8F-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ve, err := table.Event("MEM_LOAD_RETIRED.L3_MISS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ve.EventCode != 0xd1 || ve.UMask != 0x20 || ve.SampleAfterValue != 100021 {
+		t.Errorf("got %+v", ve)
+	}
+}
+
+func testVendorEventEncode(t *testing.T) {
+	table, err := perf.LoadEventTable(fixtureEventTables, "GenuineIntel-6-55-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		config, config1 uint64
+	}{
+		{"MEM_LOAD_RETIRED.L3_MISS", 0x20d1, 0},
+		{"MEM_TRANS_RETIRED.LOAD_LATENCY_GT_32", 0x1cd, 0x20},
+		{"OCR.DEMAND_DATA_RD.ANY_RESPONSE", 0x1b7, 0x10001},
+		{"UOPS_RETIRED.TOTAL_CYCLES", 0xa8002c2, 0},
+		{"OTHER_ASSISTS.ANY", 0x1043fc1, 0},
+	}
+	for _, tt := range tests {
+		ve, err := table.Event(tt.name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		a := new(perf.Attr)
+		if err := ve.Configure(a); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if a.Label != tt.name || a.Type != perf.RawEvent || a.Config != tt.config || a.Config1 != tt.config1 {
+			t.Errorf("%s: got label %q, type %d, config %#x, config1 %#x, want %#x, %#x",
+				tt.name, a.Label, a.Type, a.Config, a.Config1, tt.config, tt.config1)
+		}
+	}
+}
+
+func testLoadEventTableNoMatch(t *testing.T) {
+	if _, err := perf.LoadEventTable(fixtureEventTables, "AuthenticAMD-23-31-0"); err == nil {
+		t.Fatal("LoadEventTable succeeded for CPU without tables")
+	}
+}
+
+func testParseEventTableBadJSON(t *testing.T) {
+	for _, doc := range []string{
+		`[{"EventName": "X", "EventCode": "0xzz"}]`,
+		`{"Events": 1}`,
+		`[`,
+	} {
+		if _, err := perf.ParseEventTableJSON(strings.NewReader(doc)); err == nil {
+			t.Errorf("ParseEventTableJSON(%q) succeeded", doc)
+		}
+	}
+}